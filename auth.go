@@ -0,0 +1,549 @@
+package gop
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The authenticated client of a request
+type User struct {
+	Name   string
+	Method string // Which authenticator accepted them, e.g. "basic"
+}
+
+// Checks a request's credentials. Returns the user if they are valid, nil
+// if the request has no credentials of this kind, or an error if they are
+// present but wrong (which fails the request with a 401).
+type Authenticator interface {
+	Authenticate(g *Req) (*User, error)
+	// The WWW-Authenticate challenge to send with a 401, or ""
+	Challenge() string
+}
+
+// The authenticated user, or nil for an anonymous request
+func (g *Req) User() *User {
+	return g.user
+}
+
+// Try each authenticator in turn, so the first to recognise credentials wins
+func authenticate(g *Req, auths []Authenticator) (*User, error) {
+	for _, auth := range auths {
+		user, err := auth.Authenticate(g)
+		if err != nil || user != nil {
+			return user, err
+		}
+	}
+	return nil, nil
+}
+
+func unauthorized(auths []Authenticator, msg string) HTTPError {
+	httpErr := HTTPError{
+		Code:      http.StatusUnauthorized,
+		Body:      msg,
+		ErrorCode: "unauthorized",
+	}
+	for _, auth := range auths {
+		if challenge := auth.Challenge(); challenge != "" {
+			if httpErr.Headers == nil {
+				httpErr.Headers = make(http.Header)
+			}
+			httpErr.Headers.Add("WWW-Authenticate", challenge)
+		}
+	}
+	if httpErr.Headers == nil {
+		// No credentials we could ask for would help
+		httpErr.Code = http.StatusForbidden
+		httpErr.ErrorCode = "forbidden"
+	}
+	return httpErr
+}
+
+// Use these authenticators for every request, in place of those from
+// auth_* config. Requests without credentials are let through with no
+// User unless auth_required is set; use RequireUser() for single routes.
+func (a *App) SetAuthenticators(auths ...Authenticator) {
+	a.authMu.Lock()
+	defer a.authMu.Unlock()
+	a.authenticators = auths
+	a.authenticatorsSet = true
+}
+
+// Use these authenticators for the /gop/ admin URLs (except health
+// checks), in place of those from admin_auth_* config.
+func (a *App) SetAdminAuthenticators(auths ...Authenticator) {
+	a.authMu.Lock()
+	defer a.authMu.Unlock()
+	a.adminAuthenticators = auths
+	a.adminAuthenticatorsSet = true
+}
+
+func (a *App) getAuthenticators() ([]Authenticator, []Authenticator) {
+	a.authMu.RLock()
+	defer a.authMu.RUnlock()
+	return a.authenticators, a.adminAuthenticators
+}
+
+// Build the authenticators from config, now and whenever it changes
+func (a *App) initAuth() {
+	a.loadAuthConfig()
+	a.Cfg.AddOnChangeCallback(func(cfg *Config) { a.loadAuthConfig() })
+}
+
+func (a *App) loadAuthConfig() {
+	auths := a.authenticatorsFromConfig("auth_", "")
+	// Behind a proxy on this host every client looks local, so local
+	// clients are only let in by default once we know who the proxies are
+	adminAllowIPs := ""
+	if proxies, _ := a.Cfg.Get("gop", "trusted_proxies", ""); proxies != "" {
+		adminAllowIPs = "127.0.0.1/8,::1"
+	}
+	adminAuths := a.authenticatorsFromConfig("admin_auth_", adminAllowIPs)
+
+	a.authMu.Lock()
+	defer a.authMu.Unlock()
+	if !a.authenticatorsSet {
+		a.authenticators = auths
+	}
+	if !a.adminAuthenticatorsSet {
+		a.adminAuthenticators = adminAuths
+	}
+}
+
+func (a *App) authenticatorsFromConfig(prefix, defaultAllowIPs string) []Authenticator {
+	var auths []Authenticator
+	realm, _ := a.Cfg.Get("gop", prefix+"realm", a.AppName)
+
+	if fname, _ := a.Cfg.Get("gop", prefix+"htpasswd_file", ""); fname != "" {
+		auth, err := NewHtpasswdAuthenticator(fname, realm)
+		if err != nil {
+			a.Error("Failed to load %shtpasswd_file: %s", prefix, err.Error())
+		} else {
+			auth.logger = a
+			auths = append(auths, auth)
+		}
+	}
+	if fname, _ := a.Cfg.Get("gop", prefix+"bearer_tokens_file", ""); fname != "" {
+		auth, err := NewBearerTokenFileAuthenticator(fname, realm)
+		if err != nil {
+			a.Error("Failed to load %sbearer_tokens_file: %s", prefix, err.Error())
+		} else {
+			auths = append(auths, auth)
+		}
+	}
+	if cns, _ := a.Cfg.Get("gop", prefix+"cert_cns", ""); cns != "" {
+		auths = append(auths, NewCertAuthenticator(splitList(cns)...))
+	}
+	if ips, _ := a.Cfg.Get("gop", prefix+"allow_ips", defaultAllowIPs); ips != "" {
+		auth, err := NewIPAllowlistAuthenticator(splitList(ips)...)
+		if err != nil {
+			a.Error("Bad %sallow_ips: %s", prefix, err.Error())
+		} else {
+			auths = append(auths, auth)
+		}
+	}
+	return auths
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Authenticate every request, failing those with bad credentials (or none,
+// if auth_required is set, or the route's group requires it). gop's own
+// URLs are left to AdminAuth (or are open, as health checks are).
+func (a *App) AuthMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if isGopRoute(g.R) {
+				return next(g)
+			}
+			auths, adminAuths := a.getAuthenticators()
+			policy := AuthDefault
+			if g.group != nil {
+				policy = g.group.auth
+				if g.group.authenticators != nil {
+					auths = g.group.authenticators
+				}
+			}
+			if policy == AuthAdmin {
+				auths = adminAuths
+			}
+			user, err := authenticate(g, auths)
+			if err != nil {
+				g.Debug("Authentication failed: %s", err.Error())
+				a.Stats.Inc("auth.failed", 1)
+				return unauthorized(auths, "Authentication failed")
+			}
+			required, _ := g.Cfg.GetBool("gop", "auth_required", false)
+			switch policy {
+			case AuthRequired, AuthAdmin:
+				required = true
+			case AuthOptional:
+				required = false
+			}
+			if user == nil && required {
+				return unauthorized(auths, "Authentication required")
+			}
+			g.user = user
+			return next(g)
+		}
+	}
+}
+
+// Middleware to turn away anonymous requests
+func RequireUser() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.user == nil {
+				auths, _ := g.app.getAuthenticators()
+				return unauthorized(auths, "Authentication required")
+			}
+			return next(g)
+		}
+	}
+}
+
+// Middleware for the admin URLs. Unlike other routes, anonymous
+// requests are always refused.
+func (a *App) AdminAuth() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			_, adminAuths := a.getAuthenticators()
+			user, err := authenticate(g, adminAuths)
+			if err != nil || user == nil {
+				a.Stats.Inc("auth.admin_refused", 1)
+				if err != nil {
+					g.Error("Admin authentication failed for [%s]: %s", g.RealRemoteIP, err.Error())
+				}
+				return unauthorized(adminAuths, "Admin authentication required")
+			}
+			g.user = user
+			return next(g)
+		}
+	}
+}
+
+type gopRouteKey struct{}
+
+// Marks requests for the routes gop registers itself, which AuthMiddleware
+// leaves alone. Matching on the path would also let through any app
+// routes under /gop/.
+func gopRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), gopRouteKey{}, true)))
+	})
+}
+
+func isGopRoute(r *http.Request) bool {
+	isGop, _ := r.Context().Value(gopRouteKey{}).(bool)
+	return isGop
+}
+
+// HTTP basic auth against an Apache htpasswd file. Supports {SHA} and
+// $apr1$ (MD5) hashes; lines with other hashes (e.g. bcrypt) are skipped.
+// The file is re-read when it changes.
+type HtpasswdAuthenticator struct {
+	filename string
+	realm    string
+	logger   Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	hashes  map[string]string
+}
+
+func NewHtpasswdAuthenticator(filename, realm string) (*HtpasswdAuthenticator, error) {
+	auth := &HtpasswdAuthenticator{filename: filename, realm: realm}
+	err := auth.maybeReload()
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (h *HtpasswdAuthenticator) maybeReload() error {
+	info, err := os.Stat(h.filename)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if info.ModTime().Equal(h.modTime) {
+		return nil
+	}
+
+	f, err := os.Open(h.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if !strings.HasPrefix(parts[1], "{SHA}") && !strings.HasPrefix(parts[1], "$apr1$") {
+			if h.logger != nil {
+				h.logger.Error("Skipping user [%s] in %s - unsupported hash", parts[0], h.filename)
+			}
+			continue
+		}
+		hashes[parts[0]] = parts[1]
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+	h.hashes = hashes
+	h.modTime = info.ModTime()
+	return nil
+}
+
+func (h *HtpasswdAuthenticator) Authenticate(g *Req) (*User, error) {
+	name, password, ok := g.R.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	err := h.maybeReload()
+	if err != nil && h.logger != nil {
+		// Carry on with what we had
+		h.logger.Error("Failed to reload %s: %s", h.filename, err.Error())
+	}
+	h.mu.Lock()
+	hash, found := h.hashes[name]
+	h.mu.Unlock()
+	if !found || !checkHtpasswd(hash, password) {
+		return nil, fmt.Errorf("Bad password for user [%s]", name)
+	}
+	return &User{Name: name, Method: "basic"}, nil
+}
+
+func (h *HtpasswdAuthenticator) Challenge() string {
+	return fmt.Sprintf("Basic realm=%q", h.realm)
+}
+
+func checkHtpasswd(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		computed = apr1Hash(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// Apache's variant of MD5-crypt
+func apr1Hash(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	alt := md5.Sum([]byte(password + salt + password))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(final[idx[0]])<<16|uint(final[idx[1]])<<8|uint(final[idx[2]]), 4)
+	}
+	to64(uint(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
+
+// Bearer token auth ("Authorization: Bearer <token>"), checked by Validate
+type BearerAuthenticator struct {
+	Realm string
+	// Return the token's user, or an error if it isn't valid
+	Validate func(token string) (*User, error)
+}
+
+func (b *BearerAuthenticator) Authenticate(g *Req) (*User, error) {
+	authHeader := g.R.Header.Get("Authorization")
+	if len(authHeader) < 7 || !strings.EqualFold(authHeader[:7], "Bearer ") {
+		return nil, nil
+	}
+	if b.Validate == nil {
+		return nil, fmt.Errorf("BearerAuthenticator for realm [%s] has no Validate func", b.Realm)
+	}
+	user, err := b.Validate(strings.TrimSpace(authHeader[7:]))
+	if err != nil {
+		return nil, err
+	}
+	if user != nil && user.Method == "" {
+		user.Method = "bearer"
+	}
+	return user, nil
+}
+
+func (b *BearerAuthenticator) Challenge() string {
+	return fmt.Sprintf("Bearer realm=%q", b.Realm)
+}
+
+// Bearer auth with tokens from a file of "<user> <token>" lines
+func NewBearerTokenFileAuthenticator(filename, realm string) (*BearerAuthenticator, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Keyed by hash, so lookups don't leak token prefixes through timing
+	users := make(map[[sha256.Size]byte]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Bad line in %s - want '<user> <token>'", filename)
+		}
+		users[sha256.Sum256([]byte(fields[1]))] = fields[0]
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return &BearerAuthenticator{
+		Realm: realm,
+		Validate: func(token string) (*User, error) {
+			name, ok := users[sha256.Sum256([]byte(token))]
+			if !ok {
+				return nil, fmt.Errorf("Unknown bearer token")
+			}
+			return &User{Name: name}, nil
+		},
+	}, nil
+}
+
+// Accepts clients presenting a verified TLS client certificate with one of
+// the given Common Names ("*" for any)
+type CertAuthenticator struct {
+	allowed map[string]bool
+}
+
+func NewCertAuthenticator(commonNames ...string) *CertAuthenticator {
+	allowed := make(map[string]bool)
+	for _, cn := range commonNames {
+		allowed[cn] = true
+	}
+	return &CertAuthenticator{allowed: allowed}
+}
+
+func (c *CertAuthenticator) Authenticate(g *Req) (*User, error) {
+	if g.R.TLS == nil || len(g.R.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cn := g.R.TLS.VerifiedChains[0][0].Subject.CommonName
+	if !c.allowed["*"] && !c.allowed[cn] {
+		return nil, fmt.Errorf("Client certificate CN [%s] not allowed", cn)
+	}
+	return &User{Name: cn, Method: "cert"}, nil
+}
+
+func (c *CertAuthenticator) Challenge() string {
+	return ""
+}
+
+// Accepts clients connecting from the given IPs or CIDR ranges, naming
+// them by IP
+type IPAllowlistAuthenticator struct {
+	nets []*net.IPNet
+}
+
+func NewIPAllowlistAuthenticator(cidrs ...string) (*IPAllowlistAuthenticator, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &IPAllowlistAuthenticator{nets: nets}, nil
+}
+
+func (i *IPAllowlistAuthenticator) Authenticate(g *Req) (*User, error) {
+	ipStr := g.remoteIP()
+	ip := net.ParseIP(ipStr)
+	if ip != nil && ipInNets(ip, i.nets) {
+		return &User{Name: ipStr, Method: "ip"}, nil
+	}
+	return nil, nil
+}
+
+func (i *IPAllowlistAuthenticator) Challenge() string {
+	return ""
+}
@@ -0,0 +1,77 @@
+package gop
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGopRouteAuth(t *testing.T) {
+	tests := []struct {
+		allowIPs       string
+		trustedProxies string
+		forwardedFor   string
+		path           string
+		code           int
+	}{
+		{"", "", "", "/gop/mine", http.StatusForbidden},
+		{"", "", "", "/gop/health/live", http.StatusOK},
+		// Local clients might all be coming through a local proxy
+		{"", "", "", "/gop/status", http.StatusForbidden},
+		{"127.0.0.1", "", "", "/gop/status", http.StatusOK},
+		{"10.0.0.0/8", "", "", "/gop/status", http.StatusForbidden},
+		{"", "10.0.0.0/8", "", "/gop/status", http.StatusOK},
+		// Once the proxy is trusted, the real client isn't local
+		{"", "127.0.0.1", "203.0.113.9", "/gop/status", http.StatusForbidden},
+		{"", "127.0.0.1", "127.0.0.1", "/gop/status", http.StatusOK},
+	}
+	for _, test := range tests {
+		// Config can't change under running requests, so an app each
+		a, srv := newTestApp(t, "auth")
+		a.Cfg.TransientOverride("gop", "enable_gop_urls", "true")
+		a.Cfg.TransientOverride("gop", "auth_required", "true")
+		a.Cfg.TransientOverride("gop", "trusted_proxies", test.trustedProxies)
+		if test.allowIPs != "" {
+			a.Cfg.TransientOverride("gop", "admin_auth_allow_ips", test.allowIPs)
+		}
+		// Under /gop/, but the app's own, so AuthMiddleware still applies
+		a.HandleFunc("/gop/mine", func(g *Req) error {
+			g.SendText([]byte("mine"))
+			return nil
+		})
+		a.registerGopHandlers()
+
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s with admin_auth_allow_ips %q, trusted_proxies %q, X-Forwarded-For %q: got %d, want %d",
+				test.path, test.allowIPs, test.trustedProxies, test.forwardedFor, resp.StatusCode, test.code)
+		}
+	}
+}
+
+func TestBearerAuthenticatorWithoutValidate(t *testing.T) {
+	a, srv := newTestApp(t, "auth")
+	a.SetAuthenticators(&BearerAuthenticator{Realm: "test"})
+	a.HandleFunc("/", func(g *Req) error {
+		g.SendText([]byte("hello"))
+		return nil
+	})
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,191 @@
+package gop
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set the response's ETag. tag is quoted for you. Use a weak tag if
+// equivalent responses may not be byte-identical. If the request's
+// If-None-Match matches, a 304 is sent in place of the response.
+func (g *Req) SetETag(tag string, weak bool) {
+	tag = `"` + tag + `"`
+	if weak {
+		tag = "W/" + tag
+	}
+	g.W.Header().Set("Etag", tag)
+}
+
+// Set the response's Last-Modified time. If the request's
+// If-Modified-Since is no earlier, a 304 is sent in place of the response.
+func (g *Req) SetLastModified(t time.Time) {
+	g.W.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// Set the response's Cache-Control, overriding any cache_control config
+func (g *Req) SetCacheControl(policy string) {
+	g.W.Header().Set("Cache-Control", policy)
+}
+
+// True if the client's copy is current, given the ETag and Last-Modified
+// set so far. The 304 is sent anyway once the handler writes; this lets
+// it skip building the body.
+func (g *Req) NotModified() bool {
+	return notModified(g.R, g.W.Header())
+}
+
+func notModified(r *http.Request, h http.Header) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	// If-None-Match takes precedence
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, h.Get("Etag"))
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ims)
+}
+
+// Weak comparison, as If-None-Match calls for
+func etagMatches(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Called as the header is sent. Adds the default Cache-Control, and turns
+// a 200 into a 304 if the client's copy is current. Must hold w.mu.
+func (w *responseWriter) applyCaching(code int) int {
+	h := w.Header()
+	if w.cacheControl != "" && h.Get("Cache-Control") == "" &&
+		(code >= 200 && code < 300 || code == http.StatusNotModified) {
+		h.Set("Cache-Control", w.cacheControl)
+	}
+	if code == http.StatusOK && w.req != nil && notModified(w.req.R, h) {
+		w.notModified = true
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		return http.StatusNotModified
+	}
+	return code
+}
+
+// Middleware to give GET responses an ETag computed from the body, so
+// unchanged responses become 304s. The whole response is held in memory,
+// so don't use it on large or streamed responses. Handlers which set
+// their own ETag keep it.
+func AutoETag(weak bool) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.W == nil || (g.R.Method != "GET" && g.R.Method != "HEAD") {
+				return next(g)
+			}
+			g.W.holdResponse()
+			released := false
+			defer func() {
+				if !released {
+					// Panicking, so let the panic response through instead
+					g.W.dropHeld()
+				}
+			}()
+			err := next(g)
+			g.W.releaseHeld(weak)
+			released = true
+			return err
+		}
+	}
+}
+
+func (w *responseWriter) holdResponse() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.wroteHeader && w.held == nil {
+		w.held = &bufferedResponse{}
+	}
+}
+
+func (w *responseWriter) dropHeld() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.held != nil {
+		w.held = nil
+		w.size = 0
+	}
+}
+
+// Send the held response, with an ETag computed from its body
+func (w *responseWriter) releaseHeld(weak bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	held := w.held
+	w.held = nil
+	if held == nil || w.timedOut {
+		return
+	}
+	if held.code == 0 && held.body.Len() == 0 {
+		// Nothing sent, so leave the response to the error middleware
+		return
+	}
+
+	code := held.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	h := w.Header()
+	if code == http.StatusOK && h.Get("Etag") == "" {
+		sum := sha256.Sum256(held.body.Bytes())
+		tag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+		if weak {
+			tag = "W/" + tag
+		}
+		h.Set("Etag", tag)
+	}
+	if h.Get("Content-Length") == "" {
+		h.Set("Content-Length", strconv.Itoa(held.body.Len()))
+	}
+	w.writeHeader(code)
+	if held.body.Len() > 0 {
+		w.write(held.body.Bytes())
+	}
+}
+
+// Set the default Cache-Control for successful GET and HEAD responses,
+// from cache_control:<route> or cache_control config. Handlers can
+// override it with g.SetCacheControl().
+func (a *App) CacheControlMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.W != nil && (g.R.Method == "GET" || g.R.Method == "HEAD") {
+				policy, _ := g.Cfg.Get("gop", "cache_control", "")
+				if tmpl := g.routeTemplate(); tmpl != "" {
+					policy, _ = g.Cfg.Get("gop", "cache_control:"+tmpl, policy)
+				}
+				g.W.mu.Lock()
+				g.W.cacheControl = policy
+				g.W.mu.Unlock()
+			}
+			return next(g)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package gop
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	a, srv := newTestApp(t, "cache")
+	a.Cfg.TransientOverride("gop", "cache_control", "no-cache")
+	a.Cfg.TransientOverride("gop", "cache_control:/page", "public, max-age=60")
+	// The POST has no CSRF token
+	a.Cfg.TransientOverride("gop", "csrf_enable", "false")
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	a.HandleFunc("/page", func(g *Req) error {
+		g.SetETag("v1", false)
+		g.SetLastModified(modified)
+		return g.SendText([]byte("hello"))
+	})
+	a.HandleFunc("/dated", func(g *Req) error {
+		g.SetLastModified(modified)
+		return g.SendText([]byte("hello"))
+	})
+	a.HandleFunc("/own", func(g *Req) error {
+		g.SetETag("v1", true)
+		g.SetCacheControl("private")
+		return g.SendText([]byte("hello"))
+	})
+
+	before := modified.Add(-time.Hour).Format(http.TimeFormat)
+	after := modified.Add(time.Hour).Format(http.TimeFormat)
+	tests := []struct {
+		method       string
+		path         string
+		header       string
+		value        string
+		code         int
+		cacheControl string
+	}{
+		{"GET", "/page", "", "", http.StatusOK, "public, max-age=60"},
+		{"GET", "/page", "If-None-Match", `"v1"`, http.StatusNotModified, "public, max-age=60"},
+		{"GET", "/page", "If-None-Match", `"v0", W/"v1"`, http.StatusNotModified, "public, max-age=60"},
+		{"GET", "/page", "If-None-Match", "*", http.StatusNotModified, "public, max-age=60"},
+		// If-None-Match takes precedence over the If-Modified-Since sent with it
+		{"GET", "/page", "If-None-Match", `"v0"`, http.StatusOK, "public, max-age=60"},
+		{"HEAD", "/page", "If-None-Match", `"v1"`, http.StatusNotModified, "public, max-age=60"},
+		// Only GET and HEAD become 304s
+		{"POST", "/page", "If-None-Match", `"v1"`, http.StatusOK, ""},
+		{"GET", "/dated", "If-Modified-Since", after, http.StatusNotModified, "no-cache"},
+		{"GET", "/dated", "If-Modified-Since", modified.Format(http.TimeFormat), http.StatusNotModified, "no-cache"},
+		{"GET", "/dated", "If-Modified-Since", before, http.StatusOK, "no-cache"},
+		{"GET", "/dated", "If-Modified-Since", "yesterday", http.StatusOK, "no-cache"},
+		{"GET", "/own", "If-None-Match", `"v1"`, http.StatusNotModified, "private"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, srv.URL+test.path, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		if test.path == "/page" && test.header == "If-None-Match" {
+			// Would match on its own
+			req.Header.Set("If-Modified-Since", after)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.method, test.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		desc := test.method + " " + test.path + " with " + test.header + " " + test.value
+		if resp.StatusCode != test.code {
+			t.Errorf("%s: got %d, want %d", desc, resp.StatusCode, test.code)
+			continue
+		}
+		if cc := resp.Header.Get("Cache-Control"); cc != test.cacheControl {
+			t.Errorf("%s: Cache-Control %q, want %q", desc, cc, test.cacheControl)
+		}
+		if test.code != http.StatusNotModified {
+			continue
+		}
+		if len(body) != 0 || resp.Header.Get("Content-Type") != "" {
+			t.Errorf("%s: 304 with body %q, Content-Type %q", desc, body, resp.Header.Get("Content-Type"))
+		}
+		if test.path != "/dated" && resp.Header.Get("Etag") == "" {
+			t.Errorf("%s: 304 without its ETag", desc)
+		}
+	}
+}
+
+func TestAutoETag(t *testing.T) {
+	a, srv := newTestApp(t, "cache")
+	a.HandleFunc("/auto", Chain(func(g *Req) error {
+		// Held until the handler returns, so sent with a Content-Length
+		io.WriteString(g.W, "hello ")
+		g.W.Flush()
+		io.WriteString(g.W, "world")
+		return nil
+	}, AutoETag(false)))
+	a.HandleFunc("/own", Chain(func(g *Req) error {
+		g.SetETag("mine", false)
+		return g.SendText([]byte("hello"))
+	}, AutoETag(true)))
+	a.HandleFunc("/created", Chain(func(g *Req) error {
+		g.W.WriteHeader(http.StatusCreated)
+		io.WriteString(g.W, "made")
+		return nil
+	}, AutoETag(false)))
+	a.HandleFunc("/error", Chain(func(g *Req) error {
+		return HTTPError{Code: http.StatusNotFound, Body: "Gone"}
+	}, AutoETag(false)))
+
+	get := func(path, ifNoneMatch string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, body := get("/auto", "")
+	etag := resp.Header.Get("Etag")
+	if resp.StatusCode != http.StatusOK || body != "hello world" {
+		t.Fatalf("Got %d %q", resp.StatusCode, body)
+	}
+	if !strings.HasPrefix(etag, `"`) || resp.ContentLength != int64(len(body)) {
+		t.Errorf("Got ETag %q, Content-Length %d, want a strong tag and %d", etag, resp.ContentLength, len(body))
+	}
+	if resp, _ := get("/auto", ""); resp.Header.Get("Etag") != etag {
+		t.Errorf("ETag changed from %q to %q", etag, resp.Header.Get("Etag"))
+	}
+	if resp, body := get("/auto", etag); resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("With If-None-Match: got %d %q, want 304", resp.StatusCode, body)
+	}
+
+	if resp, _ := get("/own", ""); resp.Header.Get("Etag") != `"mine"` {
+		t.Errorf("Handler's ETag replaced with %q", resp.Header.Get("Etag"))
+	}
+	// Only 200s are tagged
+	if resp, body := get("/created", ""); resp.StatusCode != http.StatusCreated || body != "made" || resp.Header.Get("Etag") != "" {
+		t.Errorf("/created: got %d %q, ETag %q", resp.StatusCode, body, resp.Header.Get("Etag"))
+	}
+	if resp, body := get("/error", ""); resp.StatusCode != http.StatusNotFound || strings.TrimSpace(body) != "Gone" || resp.Header.Get("Etag") != "" {
+		t.Errorf("/error: got %d %q, ETag %q", resp.StatusCode, body, resp.Header.Get("Etag"))
+	}
+}
+
+func TestCommitHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("X-Removed", "1")
+	rec.Header().Set("X-Kept", "1")
+	w := &responseWriter{ResponseWriter: rec}
+
+	w.bufferHeaders()
+	w.Header().Del("X-Removed")
+	w.Header().Set("X-Added", "1")
+	if rec.Header().Get("X-Added") != "" {
+		t.Errorf("Buffered header reached the client before the write")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	h := rec.Result().Header
+	if h.Get("X-Removed") != "" || h.Get("X-Kept") != "1" || h.Get("X-Added") != "1" {
+		t.Errorf("Got headers %v", h)
+	}
+}
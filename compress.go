@@ -0,0 +1,302 @@
+package gop
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Creates a compressing writer for a Content-Encoding. level is the
+// compression_level config value (-1 for the encoder's default).
+type CompressorFunc func(w io.Writer, level int) io.WriteCloser
+
+// Make a Content-Encoding available to the compression middleware, e.g.
+// "zstd". It is only used if also listed in compression_encodings. br, gzip
+// and deflate are built in.
+func (a *App) RegisterCompressor(encoding string, f CompressorFunc) {
+	a.compressorsMu.Lock()
+	defer a.compressorsMu.Unlock()
+	if a.compressors == nil {
+		a.compressors = make(map[string]CompressorFunc)
+	}
+	a.compressors[encoding] = f
+}
+
+func (a *App) getCompressor(encoding string) CompressorFunc {
+	switch encoding {
+	case "br":
+		return newBrotliWriter
+	case "gzip":
+		return newGzipWriter
+	case "deflate":
+		return newFlateWriter
+	}
+	a.compressorsMu.Lock()
+	defer a.compressorsMu.Unlock()
+	return a.compressors[encoding]
+}
+
+// The built-in encoders are expensive to create, so are pooled per level
+var brotliPools, gzipPools, flatePools sync.Map // int -> *sync.Pool
+
+type pooledWriter struct {
+	io.WriteCloser
+	reset func(io.Writer)
+	pool  *sync.Pool
+}
+
+func (pw *pooledWriter) Close() error {
+	err := pw.WriteCloser.Close()
+	pw.reset(io.Discard)
+	pw.pool.Put(pw)
+	return err
+}
+
+func (pw *pooledWriter) Flush() error {
+	return pw.WriteCloser.(interface{ Flush() error }).Flush()
+}
+
+// brotli's levels run from 0 to 11, so -1 and anything out of range get
+// its default
+func newBrotliWriter(w io.Writer, level int) io.WriteCloser {
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		level = brotli.DefaultCompression
+	}
+	p, _ := brotliPools.LoadOrStore(level, &sync.Pool{})
+	pool := p.(*sync.Pool)
+	if pw, ok := pool.Get().(*pooledWriter); ok {
+		pw.reset(w)
+		return pw
+	}
+	bw := brotli.NewWriterLevel(w, level)
+	return &pooledWriter{WriteCloser: bw, reset: bw.Reset, pool: pool}
+}
+
+func newGzipWriter(w io.Writer, level int) io.WriteCloser {
+	p, _ := gzipPools.LoadOrStore(level, &sync.Pool{})
+	pool := p.(*sync.Pool)
+	if pw, ok := pool.Get().(*pooledWriter); ok {
+		pw.reset(w)
+		return pw
+	}
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		gw = gzip.NewWriter(w)
+	}
+	return &pooledWriter{WriteCloser: gw, reset: gw.Reset, pool: pool}
+}
+
+func newFlateWriter(w io.Writer, level int) io.WriteCloser {
+	p, _ := flatePools.LoadOrStore(level, &sync.Pool{})
+	pool := p.(*sync.Pool)
+	if pw, ok := pool.Get().(*pooledWriter); ok {
+		pw.reset(w)
+		return pw
+	}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		fw, _ = flate.NewWriter(w, flate.DefaultCompression)
+	}
+	return &pooledWriter{WriteCloser: fw, reset: fw.Reset, pool: pool}
+}
+
+// Compress responses according to the client's Accept-Encoding, if
+// compression_enable is set. Responses are only compressed once they reach
+// compression_min_bytes, and if their Content-Type is in compression_types.
+func (a *App) CompressionMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			enabled, _ := g.Cfg.GetBool("gop", "compression_enable", false)
+			if !enabled || g.W == nil {
+				return next(g)
+			}
+
+			c := &compressor{}
+			c.minSize, _ = g.Cfg.GetInt("gop", "compression_min_bytes", 1024)
+			c.level, _ = g.Cfg.GetInt("gop", "compression_level", -1)
+			typeList, _ := g.Cfg.Get("gop", "compression_types", defaultCompressionTypes)
+			c.types = strings.Split(typeList, ",")
+			for i := range c.types {
+				c.types[i] = strings.TrimSpace(c.types[i])
+			}
+
+			// Even if we don't compress for this client, the response
+			// varies by Accept-Encoding, so the compressor still runs
+			acceptEncoding := g.R.Header.Get("Accept-Encoding")
+			if acceptEncoding != "" && g.R.Method != "HEAD" {
+				encodingList, _ := g.Cfg.Get("gop", "compression_encodings", "br,gzip,deflate")
+				var offers []string
+				for _, encoding := range strings.Split(encodingList, ",") {
+					encoding = strings.TrimSpace(encoding)
+					if g.app.getCompressor(encoding) != nil {
+						offers = append(offers, encoding)
+					}
+				}
+				if len(offers) > 0 {
+					c.encoding = negotiate(acceptEncoding, offers)
+					c.newWriter = g.app.getCompressor(c.encoding)
+				}
+			}
+
+			g.W.setCompressor(c)
+			err := next(g)
+			g.W.finishCompression()
+
+			if c.cw != nil {
+				a.Stats.Inc("compression."+c.encoding+".bytes_in", int64(g.W.size))
+				a.Stats.Inc("compression."+c.encoding+".bytes_out", int64(c.bytesOut))
+			}
+			return err
+		}
+	}
+}
+
+const defaultCompressionTypes = "text/html,text/plain,text/css,text/csv,text/xml,text/javascript," +
+	"application/json,application/problem+json,application/javascript,application/xml,image/svg+xml"
+
+// Per-response compression state. The first compression_min_bytes are
+// held back (along with the status code) until we know whether to compress.
+type compressor struct {
+	encoding  string // "" if the client accepts none of ours
+	newWriter CompressorFunc
+	level     int
+	minSize   int
+	types     []string
+
+	buf      []byte
+	started  bool
+	cw       io.WriteCloser // nil if not compressing
+	bytesOut int
+}
+
+// Must hold w.mu
+func (c *compressor) compressible(w *responseWriter) bool {
+	if w.code < 200 || w.code == http.StatusNoContent ||
+		w.code == http.StatusNotModified || w.code == http.StatusPartialContent {
+		return false
+	}
+	h := w.ResponseWriter.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide whether to compress, then send the header and anything held
+// back. Must hold w.mu.
+func (c *compressor) start(w *responseWriter) {
+	c.started = true
+	w.commitHeader()
+	h := w.ResponseWriter.Header()
+	// Once compressed, net/http can no longer sniff the type
+	if h.Get("Content-Type") == "" && len(c.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+	if c.compressible(w) {
+		h.Add("Vary", "Accept-Encoding")
+		if c.newWriter != nil && len(c.buf) >= c.minSize {
+			h.Set("Content-Encoding", c.encoding)
+			h.Del("Content-Length")
+			// The compressed bytes differ, so a strong validator no longer holds
+			if etag := h.Get("Etag"); strings.HasPrefix(etag, `"`) {
+				h.Set("Etag", "W/"+etag)
+			}
+			c.cw = c.newWriter(wireWriter{w}, c.level)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+
+	buf := c.buf
+	c.buf = nil
+	if len(buf) > 0 {
+		c.writeOut(w, buf)
+	}
+}
+
+// Must hold w.mu
+func (c *compressor) writeOut(w *responseWriter, p []byte) error {
+	if c.cw == nil {
+		_, err := wireWriter{w}.Write(p)
+		return err
+	}
+	_, err := c.cw.Write(p)
+	return err
+}
+
+// Must hold w.mu
+func (c *compressor) write(w *responseWriter, p []byte) (int, error) {
+	if !c.started {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) >= c.minSize {
+			c.start(w)
+		}
+		return len(p), nil
+	}
+	return len(p), c.writeOut(w, p)
+}
+
+// Must hold w.mu
+func (c *compressor) flush(w *responseWriter) {
+	if !c.started {
+		// Too late to wait for more data
+		c.start(w)
+	}
+	if f, ok := c.cw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
+
+// Counts bytes actually sent to the client. Must hold w.mu.
+type wireWriter struct {
+	w *responseWriter
+}
+
+func (ww wireWriter) Write(p []byte) (int, error) {
+	n, err := ww.w.ResponseWriter.Write(p)
+	ww.w.wireSize += n
+	if ww.w.compress != nil {
+		ww.w.compress.bytesOut += n
+	}
+	return n, err
+}
+
+func (w *responseWriter) setCompressor(c *compressor) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.wroteHeader || w.timedOut {
+		return
+	}
+	w.compress = c
+}
+
+// Send anything held back and end the compressed stream
+func (w *responseWriter) finishCompression() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c := w.compress
+	if c == nil {
+		return
+	}
+	if !c.started {
+		c.start(w)
+	}
+	if c.cw != nil {
+		c.cw.Close()
+	}
+	w.compress = nil
+}
@@ -0,0 +1,95 @@
+package gop
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	a, srv := newTestApp(t, "compress")
+	a.Cfg.TransientOverride("gop", "compression_enable", "true")
+	a.Cfg.TransientOverride("gop", "compression_encodings", "br,gzip,deflate,zstd")
+	// zstd is listed but never registered
+
+	big := strings.Repeat("compress me ", 200)
+	a.HandleFunc("/big", func(g *Req) error {
+		g.W.Header().Set("Content-Type", "text/plain")
+		io.WriteString(g.W, big)
+		return nil
+	})
+	a.HandleFunc("/small", func(g *Req) error {
+		g.W.Header().Set("Content-Type", "text/plain")
+		io.WriteString(g.W, "tiny")
+		return nil
+	})
+	a.HandleFunc("/png", func(g *Req) error {
+		g.W.Header().Set("Content-Type", "image/png")
+		io.WriteString(g.W, big)
+		return nil
+	})
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		want           string
+	}{
+		{"/big", "", ""},
+		{"/big", "gzip", "gzip"},
+		{"/big", "deflate", "deflate"},
+		// Ties go to our preference
+		{"/big", "deflate, gzip", "gzip"},
+		{"/big", "gzip, br", "br"},
+		{"/big", "gzip;q=0.5, deflate", "deflate"},
+		{"/big", "*", "br"},
+		{"/big", "*, br;q=0", "gzip"},
+		{"/big", "gzip;q=0", ""},
+		{"/big", "identity", ""},
+		{"/big", "zstd", ""},
+		// Below compression_min_bytes
+		{"/small", "gzip", ""},
+		// Not in compression_types
+		{"/png", "gzip", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		// Not http.Get, which would ask for and undo gzip itself
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		var body io.Reader = resp.Body
+		switch resp.Header.Get("Content-Encoding") {
+		case "br":
+			body = brotli.NewReader(resp.Body)
+		case "gzip":
+			body, err = gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatalf("%s with %q: %s", test.path, test.acceptEncoding, err)
+			}
+		case "deflate":
+			body = flate.NewReader(resp.Body)
+		}
+		data, err := io.ReadAll(body)
+		resp.Body.Close()
+
+		if got := resp.Header.Get("Content-Encoding"); got != test.want {
+			t.Errorf("%s with %q: Content-Encoding %q, want %q", test.path, test.acceptEncoding, got, test.want)
+		}
+		if err != nil || (test.path != "/small" && string(data) != big) {
+			t.Errorf("%s with %q: body didn't round trip (%v)", test.path, test.acceptEncoding, err)
+		}
+		vary := resp.Header.Get("Vary")
+		if test.path != "/png" && !strings.Contains(vary, "Accept-Encoding") {
+			t.Errorf("%s with %q: Vary %q lacks Accept-Encoding", test.path, test.acceptEncoding, vary)
+		}
+	}
+}
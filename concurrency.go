@@ -0,0 +1,317 @@
+package gop
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits how many requests run at once. Requests over the limit wait in
+// a bounded FIFO queue for a slot.
+type concurrencyLimiter struct {
+	name string
+
+	mu           sync.Mutex
+	max          int
+	maxQueue     int
+	active       int
+	queue        *list.List // of chan struct{}, closed when granted a slot
+	queueLatency float64    // Moving average of seconds spent queueing
+	shed         int64
+	timedOut     int64
+}
+
+// Weight of each new sample in queueLatency
+const queueLatencyDecay = 0.1
+
+// Must hold cl.mu
+func (cl *concurrencyLimiter) recordWait(d time.Duration) {
+	cl.queueLatency += queueLatencyDecay * (d.Seconds() - cl.queueLatency)
+}
+
+// Must hold cl.mu
+func (cl *concurrencyLimiter) grantQueued() {
+	for cl.active < cl.max && cl.queue.Len() > 0 {
+		waiter := cl.queue.Remove(cl.queue.Front()).(chan struct{})
+		cl.active++
+		close(waiter)
+	}
+}
+
+// Wait for a slot. shedLatency, if non-zero, refuses to queue while the
+// average queue wait is above it.
+func (cl *concurrencyLimiter) acquire(ctx context.Context, queueTimeout, shedLatency time.Duration) error {
+	cl.mu.Lock()
+	if cl.active < cl.max && cl.queue.Len() == 0 {
+		cl.active++
+		// Lets the average recover once the queue drains
+		cl.recordWait(0)
+		cl.mu.Unlock()
+		return nil
+	}
+	if cl.queue.Len() >= cl.maxQueue {
+		cl.shed++
+		cl.mu.Unlock()
+		return errQueueFull
+	}
+	if shedLatency > 0 && cl.queueLatency > shedLatency.Seconds() {
+		cl.shed++
+		cl.mu.Unlock()
+		return errShedding
+	}
+	waiter := make(chan struct{})
+	elem := cl.queue.PushBack(waiter)
+	cl.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.recordWait(time.Since(start))
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-waiter:
+		// Granted as we gave up, so pass the slot on
+		cl.active--
+		cl.grantQueued()
+	default:
+		cl.queue.Remove(elem)
+	}
+	if err == errQueueTimeout {
+		cl.timedOut++
+	}
+	return err
+}
+
+func (cl *concurrencyLimiter) release() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.active--
+	cl.grantQueued()
+}
+
+var (
+	errQueueFull    = fmt.Errorf("Request queue full")
+	errShedding     = fmt.Errorf("Request queue too slow")
+	errQueueTimeout = fmt.Errorf("Timed out waiting in request queue")
+)
+
+// The concurrency limits from config, parsed when it changes
+type concurrencyConfig struct {
+	max          int            // max_concurrent_requests
+	routeMax     map[string]int // max_concurrent_requests:<route>, by route
+	maxQueue     int
+	queueTimeout time.Duration
+	shedLatency  time.Duration
+}
+
+func (c *concurrencyConfig) limitFor(name string) int {
+	if name == "" {
+		return c.max
+	}
+	return c.routeMax[name]
+}
+
+// Load the concurrency limits, now and whenever config changes
+func (a *App) initConcurrencyLimits() {
+	a.loadConcurrencyConfig()
+	a.Cfg.AddOnChangeCallback(func(cfg *Config) { a.loadConcurrencyConfig() })
+}
+
+func (a *App) loadConcurrencyConfig() {
+	c := &concurrencyConfig{routeMax: make(map[string]int)}
+	c.max, _ = a.Cfg.GetInt("gop", "max_concurrent_requests", 0)
+	for _, key := range a.Cfg.SectionKeys("gop") {
+		if tmpl := strings.TrimPrefix(key, "max_concurrent_requests:"); tmpl != key {
+			c.routeMax[tmpl], _ = a.Cfg.GetInt("gop", key, 0)
+		}
+	}
+	c.maxQueue, _ = a.Cfg.GetInt("gop", "concurrency_queue_size", 100)
+	c.queueTimeout, _ = a.Cfg.GetDuration("gop", "concurrency_queue_timeout", time.Second)
+	c.shedLatency, _ = a.Cfg.GetDuration("gop", "concurrency_shed_latency", 0)
+
+	a.concurrencyLimitersMu.Lock()
+	defer a.concurrencyLimitersMu.Unlock()
+	a.concurrencyConfig = c
+	for name, cl := range a.concurrencyLimiters {
+		cl.mu.Lock()
+		cl.max, cl.maxQueue = c.limitFor(name), c.maxQueue
+		// In case the limit went up
+		cl.grantQueued()
+		cl.mu.Unlock()
+	}
+}
+
+func (a *App) getConcurrencyConfig() *concurrencyConfig {
+	a.concurrencyLimitersMu.Lock()
+	defer a.concurrencyLimitersMu.Unlock()
+	return a.concurrencyConfig
+}
+
+// Get (or create) the named limiter. Its limits are kept up to date as
+// config changes.
+func (a *App) getConcurrencyLimiter(name string) *concurrencyLimiter {
+	a.concurrencyLimitersMu.Lock()
+	defer a.concurrencyLimitersMu.Unlock()
+	if a.concurrencyLimiters == nil {
+		a.concurrencyLimiters = make(map[string]*concurrencyLimiter)
+	}
+	cl, ok := a.concurrencyLimiters[name]
+	if !ok {
+		c := a.concurrencyConfig
+		cl = &concurrencyLimiter{name: name, max: c.limitFor(name), maxQueue: c.maxQueue, queue: list.New()}
+		a.concurrencyLimiters[name] = cl
+	}
+	return cl
+}
+
+// Limit concurrent requests to max_concurrent_requests overall and
+// max_concurrent_requests:<route> per route. Requests over the limit queue
+// for up to concurrency_queue_timeout, and are sent a 503 if the queue is
+// full, too slow (see concurrency_shed_latency) or they time out.
+// Websockets and /gop/ URLs are exempt.
+func (a *App) ConcurrencyLimitMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.W == nil || strings.HasPrefix(g.R.URL.Path, "/gop/") {
+				return next(g)
+			}
+			c := a.getConcurrencyConfig()
+			names := []string{""}
+			if tmpl := g.routeTemplate(); tmpl != "" {
+				names = append(names, tmpl)
+			}
+
+			// Take the route's slot first, so a busy route doesn't hold
+			// global slots while it queues
+			for i := len(names) - 1; i >= 0; i-- {
+				if c.limitFor(names[i]) <= 0 {
+					continue
+				}
+				cl := a.getConcurrencyLimiter(names[i])
+				err := cl.acquire(g.Context(), c.queueTimeout, c.shedLatency)
+				a.publishConcurrencyGauges(cl)
+				if err != nil {
+					a.rejectOverloaded(g, names[i], err)
+					return nil
+				}
+				defer func() {
+					cl.release()
+					a.publishConcurrencyGauges(cl)
+				}()
+			}
+			return next(g)
+		}
+	}
+}
+
+func (a *App) rejectOverloaded(g *Req, limiterName string, err error) {
+	switch err {
+	case errQueueFull, errShedding:
+		a.Stats.Inc("concurrency.shed", 1)
+	case errQueueTimeout:
+		a.Stats.Inc("concurrency.queue_timeout", 1)
+	default:
+		// The client went away while queued, so there's no one to tell
+		g.Debug("Client gave up waiting in request queue [%s]", g.R.URL)
+		g.W.mu.Lock()
+		if !g.W.wroteHeader && !g.W.timedOut {
+			g.W.code = statusClientClosedRequest
+		}
+		g.W.mu.Unlock()
+		return
+	}
+	if limiterName == "" {
+		limiterName = "global"
+	}
+	g.Debug("Rejecting request [%s]: %s (%s limit)", g.R.URL, err.Error(), limiterName)
+	// We're outside the error middleware
+	HTTPError{
+		Code:      http.StatusServiceUnavailable,
+		Body:      "Server busy - please retry",
+		ErrorCode: "overloaded",
+		Headers:   http.Header{"Retry-After": {"1"}},
+	}.Write(g.W)
+}
+
+// nginx's code for a client which went away before the response, so the
+// access log and stats don't show a 200
+const statusClientClosedRequest = 499
+
+// Gauges for the global limit are concurrency.*, and for route limits
+// concurrency.<route>.*, e.g. concurrency.api_items_id.active for
+// /api/items/{id}
+func (a *App) publishConcurrencyGauges(cl *concurrencyLimiter) {
+	prefix := "concurrency."
+	if cl.name != "" {
+		prefix += routeStatName(cl.name) + "."
+	}
+	cl.mu.Lock()
+	active, queued := cl.active, cl.queue.Len()
+	queueLatency := cl.queueLatency
+	cl.mu.Unlock()
+	a.Stats.Gauge(prefix+"active", int64(active))
+	a.Stats.Gauge(prefix+"queued", int64(queued))
+	a.Stats.Gauge(prefix+"queue_latency_ms", int64(queueLatency*1000))
+}
+
+var routeStatNameReplacer = strings.NewReplacer("/", "_", ".", "_", "{", "", "}", "")
+
+// A route template as a single stat name component
+func routeStatName(tmpl string) string {
+	name := routeStatNameReplacer.Replace(strings.Trim(tmpl, "/"))
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+type concurrencyLimiterStatus struct {
+	Route          string // Empty for the global limit
+	Max            int
+	Active         int
+	Queued         int
+	MaxQueue       int
+	QueueLatencyMs float64
+	Shed           int64
+	TimedOut       int64
+}
+
+func (a *App) getConcurrencyStatus() []concurrencyLimiterStatus {
+	a.concurrencyLimitersMu.Lock()
+	defer a.concurrencyLimitersMu.Unlock()
+	statuses := make([]concurrencyLimiterStatus, 0, len(a.concurrencyLimiters))
+	for _, cl := range a.concurrencyLimiters {
+		cl.mu.Lock()
+		statuses = append(statuses, concurrencyLimiterStatus{
+			Route:          cl.name,
+			Max:            cl.max,
+			Active:         cl.active,
+			Queued:         cl.queue.Len(),
+			MaxQueue:       cl.maxQueue,
+			QueueLatencyMs: cl.queueLatency * 1000,
+			Shed:           cl.shed,
+			TimedOut:       cl.timedOut,
+		})
+		cl.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Route < statuses[j].Route })
+	return statuses
+}
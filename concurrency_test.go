@@ -0,0 +1,169 @@
+package gop
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+	"github.com/cactus/go-statsd-client/statsd/statsdtest"
+)
+
+// Wait until n requests are queued on cl
+func waitForQueued(t *testing.T, cl *concurrencyLimiter, n int) {
+	for i := 0; i < 100; i++ {
+		cl.mu.Lock()
+		queued := cl.queue.Len()
+		cl.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Never got %d queued requests", n)
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	cl := &concurrencyLimiter{max: 1, maxQueue: 1, queue: list.New()}
+	ctx := context.Background()
+	if err := cl.acquire(ctx, time.Second, 0); err != nil {
+		t.Fatalf("First acquire: %s", err)
+	}
+
+	granted := make(chan error)
+	go func() { granted <- cl.acquire(ctx, time.Second, 0) }()
+	waitForQueued(t, cl, 1)
+	if err := cl.acquire(ctx, time.Second, 0); err != errQueueFull {
+		t.Errorf("With the queue full, got %v, want %v", err, errQueueFull)
+	}
+	// The slot passes to the queued request
+	cl.release()
+	if err := <-granted; err != nil {
+		t.Errorf("Queued acquire: %s", err)
+	}
+
+	if err := cl.acquire(ctx, 10*time.Millisecond, 0); err != errQueueTimeout {
+		t.Errorf("Got %v, want %v", err, errQueueTimeout)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := cl.acquire(cancelled, time.Second, 0); err != context.Canceled {
+		t.Errorf("With the client gone, got %v, want %v", err, context.Canceled)
+	}
+
+	// Refuse to queue while queueing is slow
+	cl.mu.Lock()
+	cl.queueLatency = 1
+	cl.mu.Unlock()
+	if err := cl.acquire(ctx, time.Second, 100*time.Millisecond); err != errShedding {
+		t.Errorf("With slow queueing, got %v, want %v", err, errShedding)
+	}
+
+	cl.release()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.active != 0 || cl.queue.Len() != 0 || cl.shed != 2 || cl.timedOut != 1 {
+		t.Errorf("Got %d active, %d queued, %d shed, %d timed out, want 0, 0, 2, 1",
+			cl.active, cl.queue.Len(), cl.shed, cl.timedOut)
+	}
+}
+
+func TestConcurrencyConfigChange(t *testing.T) {
+	a := InitCmd("gop_test", "concurrency")
+	a.Cfg.TransientOverride("gop", "max_concurrent_requests:/x", "1")
+	cl := a.getConcurrencyLimiter("/x")
+	if cl.max != 1 || cl.maxQueue != 100 {
+		t.Fatalf("Got max %d, queue %d, want 1, 100", cl.max, cl.maxQueue)
+	}
+
+	ctx := context.Background()
+	cl.acquire(ctx, time.Second, 0)
+	granted := make(chan error)
+	go func() { granted <- cl.acquire(ctx, time.Second, 0) }()
+	waitForQueued(t, cl, 1)
+	// Raising the limit lets the queued request in
+	a.Cfg.TransientOverride("gop", "max_concurrent_requests:/x", "2")
+	a.Cfg.TransientOverride("gop", "concurrency_queue_size", "5")
+	if err := <-granted; err != nil {
+		t.Errorf("Queued acquire: %s", err)
+	}
+	cl.mu.Lock()
+	if cl.max != 2 || cl.maxQueue != 5 {
+		t.Errorf("After config change, got max %d, queue %d, want 2, 5", cl.max, cl.maxQueue)
+	}
+	cl.mu.Unlock()
+}
+
+func TestRejectOverloaded(t *testing.T) {
+	a := InitCmd("gop_test", "concurrency")
+	tests := []struct {
+		err  error
+		code int
+		sent bool
+	}{
+		{errQueueFull, http.StatusServiceUnavailable, true},
+		{errShedding, http.StatusServiceUnavailable, true},
+		{errQueueTimeout, http.StatusServiceUnavailable, true},
+		// Nothing to send, but the access log shouldn't show a 200
+		{context.Canceled, statusClientClosedRequest, false},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		g := &Req{common: a.common, app: a, R: httptest.NewRequest("GET", "/x", nil)}
+		g.W = &responseWriter{code: http.StatusOK, ResponseWriter: rec, req: g}
+		a.rejectOverloaded(g, "", test.err)
+		if g.W.code != test.code {
+			t.Errorf("%v: logged code %d, want %d", test.err, g.W.code, test.code)
+		}
+		if sent := rec.Body.Len() > 0; sent != test.sent {
+			t.Errorf("%v: sent %q", test.err, rec.Body.String())
+		}
+		if test.sent && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%v: no Retry-After", test.err)
+		}
+	}
+}
+
+func TestConcurrencyGauges(t *testing.T) {
+	a := InitCmd("gop_test", "concurrency")
+	sender := statsdtest.NewRecordingSender()
+	a.Stats.client, _ = statsd.NewClientWithSender(sender, "test")
+	a.Cfg.TransientOverride("gop", "max_concurrent_requests", "5")
+	a.Cfg.TransientOverride("gop", "max_concurrent_requests:/api/items/{id}", "3")
+
+	for _, name := range []string{"", "/api/items/{id}"} {
+		cl := a.getConcurrencyLimiter(name)
+		cl.acquire(context.Background(), time.Second, 0)
+		a.publishConcurrencyGauges(cl)
+	}
+	var got []string
+	for _, stat := range sender.GetSent() {
+		got = append(got, stat.Stat+"="+stat.Value)
+	}
+	want := "test.concurrency.active=1 test.concurrency.queued=0 test.concurrency.queue_latency_ms=0 " +
+		"test.concurrency.api_items_id.active=1 test.concurrency.api_items_id.queued=0 test.concurrency.api_items_id.queue_latency_ms=0"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Got gauges %v, want %s", got, want)
+	}
+}
+
+func TestRouteStatName(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		want string
+	}{
+		{"/", "root"},
+		{"/status", "status"},
+		{"/api/items/{id}", "api_items_id"},
+		{"/files/{name}.json/", "files_name_json"},
+	}
+	for _, test := range tests {
+		if got := routeStatName(test.tmpl); got != test.want {
+			t.Errorf("routeStatName(%q) = %q, want %q", test.tmpl, got, test.want)
+		}
+	}
+}
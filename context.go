@@ -0,0 +1,73 @@
+package gop
+
+import (
+	"context"
+	"time"
+)
+
+// Set up the request context. It is cancelled when the client goes away,
+// when the handler returns, and when a graceful restart gives up waiting.
+func (g *Req) initContext() {
+	ctx, cancel := context.WithCancel(g.R.Context())
+	stop := context.AfterFunc(g.app.shutdownCtx, cancel)
+	g.cancel = func() {
+		stop()
+		cancel()
+	}
+	g.ctx = ctx
+	// Only this once: every copy of the request would need clearing from
+	// gorilla/context, so later contexts live in g.ctx alone
+	g.R = g.R.WithContext(ctx)
+}
+
+func (g *Req) setContext(ctx context.Context) {
+	g.ctx = ctx
+}
+
+// The context for this request. Pass it to anything which should stop
+// work when the request is abandoned. Use this rather than g.R.Context(),
+// which doesn't see timeouts or values set after the request started.
+func (g *Req) Context() context.Context {
+	if g.ctx == nil {
+		return g.R.Context()
+	}
+	return g.ctx
+}
+
+// Store a request-scoped value, retrievable with Value()
+func (g *Req) SetValue(key, value interface{}) {
+	g.setContext(context.WithValue(g.Context(), key, value))
+}
+
+// Get a value previously stored with SetValue(), or nil
+func (g *Req) Value(key interface{}) interface{} {
+	return g.Context().Value(key)
+}
+
+// Narrow the request context to expire after d. Call the returned
+// func to release resources once done, which also puts back the wider
+// context (unless something has been layered on top of ours since).
+func (g *Req) WithTimeout(d time.Duration) context.CancelFunc {
+	parent := g.Context()
+	ctx, cancel := context.WithTimeout(parent, d)
+	g.setContext(ctx)
+	return func() {
+		cancel()
+		if g.ctx == ctx {
+			g.setContext(parent)
+		}
+	}
+}
+
+// Middleware to set the timeout for a route, overriding config. The
+// context is cancelled, and a timeout error sent, after d.
+//
+//	app.HandleFunc("/slow", gop.Chain(h, gop.Timeout(5*time.Second)))
+func Timeout(d time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			g.SetTimeout(d)
+			return next(g)
+		}
+	}
+}
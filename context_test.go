@@ -0,0 +1,123 @@
+package gop
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gorillacontext "github.com/gorilla/context"
+)
+
+func newContextTestReq(a *App) *Req {
+	r := httptest.NewRequest("GET", "/", nil)
+	g := &Req{common: a.common, app: a, R: r, origR: r}
+	g.initContext()
+	return g
+}
+
+func TestWithTimeoutRestoresContext(t *testing.T) {
+	a := InitCmd("gop_test", "context")
+	g := newContextTestReq(a)
+	defer g.cancel()
+
+	type key struct{}
+	g.SetValue(key{}, "v")
+	outer := g.Context()
+
+	cancel := g.WithTimeout(time.Hour)
+	if _, ok := g.Context().Deadline(); !ok {
+		t.Fatalf("WithTimeout didn't set a deadline")
+	}
+	cancel()
+	if g.Context() != outer {
+		t.Errorf("Context not restored after cancelling WithTimeout")
+	}
+	if g.Context().Err() != nil || g.R.Context().Err() != nil {
+		t.Errorf("Context left cancelled: %v", g.Context().Err())
+	}
+	if g.Value(key{}) != "v" {
+		t.Errorf("Lost value set before WithTimeout")
+	}
+}
+
+func TestContextCancelledOnShutdown(t *testing.T) {
+	a := InitCmd("gop_test", "context")
+	g := newContextTestReq(a)
+	defer g.cancel()
+
+	a.shutdownCancel()
+	select {
+	case <-g.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Request context not cancelled on shutdown")
+	}
+	if g.Context().Err() != context.Canceled {
+		t.Errorf("Err = %v", g.Context().Err())
+	}
+}
+
+func TestSetValueKeepsRequest(t *testing.T) {
+	a := InitCmd("gop_test", "context")
+	g := newContextTestReq(a)
+	defer g.cancel()
+	r := g.R
+
+	type key struct{}
+	g.SetValue(key{}, "v")
+	cancel := g.WithTimeout(time.Hour)
+	defer cancel()
+	if g.R != r {
+		t.Errorf("g.R replaced after the request started")
+	}
+	if g.Value(key{}) != "v" {
+		t.Errorf("Value not set")
+	}
+}
+
+func TestGorillaContextCleared(t *testing.T) {
+	a, srv := newTestApp(t, "context")
+	type key struct{}
+	stashed := make(chan *http.Request, 2)
+	a.Use(func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			g.SetValue(key{}, "v")
+			return next(g)
+		}
+	})
+	a.HandleFunc("/gop", func(g *Req) error {
+		gorillacontext.Set(g.R, key{}, "v")
+		stashed <- g.R
+		return nil
+	})
+	// Passed a copy of g.R, as the context has changed since
+	a.HTTPHandler("/plain", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(key{}) != "v" {
+			t.Errorf("http.Handler didn't get the request's values")
+		}
+		gorillacontext.Set(r, key{}, "v")
+		stashed <- r
+	}))
+
+	for _, path := range []string{"/gop", "/plain"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		resp.Body.Close()
+		r := <-stashed
+		// Cleared once requestMaker has heard the request is done
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, ok := gorillacontext.GetOk(r, key{}); !ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("%s: gorilla/context stash not cleared", path)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
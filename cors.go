@@ -0,0 +1,124 @@
+package gop
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Answer CORS preflight requests and add CORS headers to responses, for
+// origins allowed by cors_origins (or cors_origins:<route>). Preflights
+// are answered here, so never reach auth or the handler.
+func (a *App) CORSMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.W == nil {
+				return next(g)
+			}
+			origins := splitList(g.routeSetting("cors_origins", ""))
+			if len(origins) == 0 {
+				return next(g)
+			}
+			h := g.W.Header()
+			h.Add("Vary", "Origin")
+			origin := g.R.Header.Get("Origin")
+			if origin == "" {
+				return next(g)
+			}
+			preflight := g.R.Method == "OPTIONS" && g.R.Header.Get("Access-Control-Request-Method") != ""
+			if !corsOriginAllowed(origin, origins) {
+				if preflight {
+					a.Stats.Inc("cors.rejected", 1)
+					g.Debug("CORS preflight from disallowed origin [%s]", origin)
+					// We're outside the error middleware
+					HTTPError{Code: http.StatusForbidden, Body: "Origin not allowed"}.Write(g.W)
+					return nil
+				}
+				return next(g)
+			}
+
+			credentials, _ := strconv.ParseBool(g.routeSetting("cors_credentials", "false"))
+			setOriginHeaders := func() {
+				if credentials || !listContains(origins, "*") {
+					h.Set("Access-Control-Allow-Origin", origin)
+				} else {
+					h.Set("Access-Control-Allow-Origin", "*")
+				}
+				if credentials {
+					h.Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+			if !preflight {
+				setOriginHeaders()
+				if expose := g.routeSetting("cors_expose_headers", ""); expose != "" {
+					h.Set("Access-Control-Expose-Headers", strings.Join(splitList(expose), ", "))
+				}
+				return next(g)
+			}
+
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			method := g.R.Header.Get("Access-Control-Request-Method")
+			methods := splitList(g.routeSetting("cors_methods", "GET,HEAD,POST,PUT,PATCH,DELETE"))
+			if !listContains(methods, method) {
+				a.Stats.Inc("cors.rejected", 1)
+				HTTPError{Code: http.StatusForbidden, Body: "Method not allowed by CORS policy"}.Write(g.W)
+				return nil
+			}
+			allowHeaders := splitList(g.routeSetting("cors_headers", "Accept,Authorization,Content-Type,X-Requested-With"))
+			requested := splitList(g.R.Header.Get("Access-Control-Request-Headers"))
+			if listContains(allowHeaders, "*") {
+				// A literal "*" isn't honoured with credentials, so echo them back
+				allowHeaders = requested
+			} else {
+				for _, header := range requested {
+					if !listContains(allowHeaders, header) {
+						a.Stats.Inc("cors.rejected", 1)
+						HTTPError{Code: http.StatusForbidden, Body: "Header [" + header + "] not allowed by CORS policy"}.Write(g.W)
+						return nil
+					}
+				}
+			}
+			setOriginHeaders()
+			h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if len(allowHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(allowHeaders, ", "))
+			}
+			maxAge, err := time.ParseDuration(g.routeSetting("cors_max_age", "10m"))
+			if err == nil && maxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+			}
+			g.W.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+}
+
+// Origins may be exact ("https://app.example.com"), patterns
+// ("https://*.example.com") or "*" for any
+func corsOriginAllowed(origin string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		if strings.Contains(pattern, "*") {
+			// * doesn't match "/", so can't stretch past the host
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Case-insensitive, as for methods and header names
+func listContains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package gop
+
+import "testing"
+
+func TestCORSOriginAllowed(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"https://example.com", nil, false},
+		{"https://example.com", []string{"*"}, true},
+		{"https://example.com", []string{"https://example.com"}, true},
+		{"HTTPS://Example.COM", []string{"https://example.com"}, true},
+		{"http://example.com", []string{"https://example.com"}, false},
+		{"https://example.com:8443", []string{"https://example.com"}, false},
+		{"https://example.com.evil.net", []string{"https://example.com"}, false},
+		{"https://other.com", []string{"https://example.com", "https://other.com"}, true},
+		{"null", []string{"https://example.com"}, false},
+		// Wildcards match within the host only
+		{"https://app.example.com", []string{"https://*.example.com"}, true},
+		{"https://App.Example.com", []string{"https://*.example.com"}, true},
+		{"https://a.b.example.com", []string{"https://*.example.com"}, true},
+		{"https://example.com", []string{"https://*.example.com"}, false},
+		{"https://evilexample.com", []string{"https://*.example.com"}, false},
+		{"https://evil.com/.example.com", []string{"https://*.example.com"}, false},
+		{"http://app.example.com", []string{"https://*.example.com"}, false},
+		{"https://app.example.com:8443", []string{"https://*.example.com"}, false},
+		{"https://app.example.com:8443", []string{"https://*.example.com:*"}, true},
+		{"https://app.example.com", []string{"https://[.example.com"}, false},
+	}
+	for _, test := range tests {
+		if got := corsOriginAllowed(test.origin, test.allowed); got != test.want {
+			t.Errorf("corsOriginAllowed(%q, %q) = %v, want %v", test.origin, test.allowed, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,581 @@
+package gop
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/schema"
+)
+
+// Used by DecodeForm when decode_strict is false
+var lenientDecoder = func() *schema.Decoder {
+	d := schema.NewDecoder()
+	d.IgnoreUnknownKeys(true)
+	return d
+}()
+
+// A problem with one field of a decoded request
+type FieldError struct {
+	Field string
+	Error string
+}
+
+// Returned by the Decode helpers when the request doesn't decode or
+// validate. Sent to the client as a 400 problem+json document with the
+// field errors as its details.
+type ValidationError struct {
+	Message string
+	Fields  []FieldError
+}
+
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v.Fields))
+	for i, f := range v.Fields {
+		msgs[i] = f.Field + ": " + f.Error
+	}
+	return v.Message + ": " + strings.Join(msgs, ", ")
+}
+
+func (v ValidationError) HTTPError() HTTPError {
+	httpErr := HTTPError{
+		Code:      http.StatusBadRequest,
+		Body:      v.Message,
+		ErrorCode: "invalid_request",
+	}
+	// Only set if we have some, so a nil slice doesn't force JSON
+	if len(v.Fields) > 0 {
+		httpErr.Details = v.Fields
+	}
+	return httpErr
+}
+
+func decodeError(msg string) error {
+	return ValidationError{Message: msg}.HTTPError()
+}
+
+// Decode the request body into v according to its Content-Type. JSON is
+// decoded with DecodeJSON, forms (and requests with no body) with DecodeForm.
+func (g *Req) Decode(v interface{}) error {
+	contentType := g.R.Header.Get("Content-Type")
+	if contentType == "" {
+		return g.DecodeForm(v)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return decodeError("Bad Content-Type: " + err.Error())
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return g.DecodeJSON(v)
+	case mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data":
+		return g.DecodeForm(v)
+	default:
+		return HTTPError{
+			Code: http.StatusUnsupportedMediaType,
+			Body: "Can't decode request with Content-Type " + mediaType,
+		}
+	}
+}
+
+// Decode a JSON request body into v and validate it. Bodies over
+// max_body_bytes are rejected, as are unknown fields if decode_strict is set.
+func (g *Req) DecodeJSON(v interface{}) error {
+	maxBytes, _ := g.Cfg.GetInt64("gop", "max_body_bytes", 10*1024*1024)
+	strict, _ := g.Cfg.GetBool("gop", "decode_strict", true)
+
+	var w http.ResponseWriter
+	if g.W != nil {
+		w = g.W
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, g.R.Body, maxBytes))
+
+	// Held, so we can look for unknown fields once it has decoded
+	var raw json.RawMessage
+	err := dec.Decode(&raw)
+	if err == nil && dec.More() {
+		err = errors.New("Unexpected data after JSON value")
+	}
+	if err == nil {
+		err = json.Unmarshal(raw, v)
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		var typeErr *json.UnmarshalTypeError
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			return HTTPError{
+				Code: http.StatusRequestEntityTooLarge,
+				Body: fmt.Sprintf("Request body larger than %d bytes", maxBytes),
+			}
+		case errors.As(err, &typeErr):
+			return ValidationError{
+				Message: "Invalid JSON",
+				Fields:  []FieldError{{Field: typeErr.Field, Error: "must be " + typeErr.Type.String()}},
+			}.HTTPError()
+		case errors.As(err, &syntaxErr):
+			return decodeError(fmt.Sprintf("Invalid JSON at offset %d: %s", syntaxErr.Offset, syntaxErr.Error()))
+		case err == io.EOF:
+			return decodeError("Empty request body")
+		default:
+			return decodeError("Invalid JSON: " + err.Error())
+		}
+	}
+	if strict {
+		if field := unknownJSONField(raw, reflect.TypeOf(v)); field != "" {
+			return ValidationError{
+				Message: "Invalid JSON",
+				Fields:  []FieldError{{Field: field, Error: "unknown field"}},
+			}.HTTPError()
+		}
+	}
+
+	return validateRequest(v, "json")
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// The first key in data with no field to decode into in t, as a dotted
+// path, or "" if there are none. Follows encoding/json's naming rules,
+// rather than relying on the text of its errors.
+func unknownJSONField(data []byte, t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Types which decode themselves can take what they like
+	if t.Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(data, &obj) != nil {
+			return ""
+		}
+		fields := jsonFields(t)
+		for _, key := range sortedKeys(obj) {
+			ft, ok := fields[strings.ToLower(key)]
+			if !ok {
+				return key
+			}
+			if sub := unknownJSONField(obj[key], ft); sub != "" {
+				return key + "." + sub
+			}
+		}
+	case reflect.Map:
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(data, &obj) != nil {
+			return ""
+		}
+		for _, key := range sortedKeys(obj) {
+			if sub := unknownJSONField(obj[key], t.Elem()); sub != "" {
+				return key + "." + sub
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var list []json.RawMessage
+		if json.Unmarshal(data, &list) != nil {
+			return ""
+		}
+		for i, elem := range list {
+			if sub := unknownJSONField(elem, t.Elem()); sub != "" {
+				return strconv.Itoa(i) + "." + sub
+			}
+		}
+	}
+	return ""
+}
+
+func sortedKeys(obj map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Field types are fixed, so each struct's JSON names are found once
+var jsonFieldsCache sync.Map // reflect.Type -> map[string]reflect.Type
+
+// The lower-cased JSON names of t's fields (including those promoted from
+// embedded structs), mapped to their types. encoding/json matches names
+// case-insensitively.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	if fields, ok := jsonFieldsCache.Load(t); ok {
+		return fields.(map[string]reflect.Type)
+	}
+	fields := make(map[string]reflect.Type)
+	addJSONFields(fields, t, map[reflect.Type]bool{})
+	jsonFieldsCache.Store(t, fields)
+	return fields
+}
+
+func addJSONFields(fields map[string]reflect.Type, t reflect.Type, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			// Even unexported, an embedded struct's fields are promoted
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields[strings.ToLower(name)] = sf.Type
+	}
+	// Our own fields win over promoted ones
+	for _, ft := range embedded {
+		promoted := make(map[string]reflect.Type)
+		addJSONFields(promoted, ft, seen)
+		for name, pt := range promoted {
+			if _, ok := fields[name]; !ok {
+				fields[name] = pt
+			}
+		}
+	}
+}
+
+// Decode the request's form values into v (using `schema` tags) and
+// validate it. Forms in the body are decoded without the query string
+// (so e.g. a cache buster isn't an unknown key); otherwise the query
+// string is decoded. Unknown keys are rejected if decode_strict is set.
+// The csrf_field is left to the CSRF middleware.
+func (g *Req) DecodeForm(v interface{}) error {
+	strict, _ := g.Cfg.GetBool("gop", "decode_strict", true)
+	decoder := lenientDecoder
+	if strict {
+		decoder = g.Decoder
+	}
+
+	form, err := g.formValues()
+	if err != nil {
+		return err
+	}
+	csrfField, _ := g.Cfg.Get("gop", "csrf_field", "csrf_token")
+	if _, ok := form[csrfField]; ok {
+		withoutCSRF := make(url.Values, len(form))
+		for k, vs := range form {
+			if k != csrfField {
+				withoutCSRF[k] = vs
+			}
+		}
+		form = withoutCSRF
+	}
+	err = decoder.Decode(v, form)
+	if err != nil {
+		var multiErr schema.MultiError
+		if !errors.As(err, &multiErr) {
+			return decodeError("Invalid form: " + err.Error())
+		}
+		fieldErrs := make([]FieldError, 0, len(multiErr))
+		for key, keyErr := range multiErr {
+			msg := keyErr.Error()
+			var unknownErr schema.UnknownKeyError
+			var convErr schema.ConversionError
+			if errors.As(keyErr, &unknownErr) {
+				msg = "unknown field"
+			} else if errors.As(keyErr, &convErr) {
+				msg = "must be " + convErr.Type.String()
+			}
+			fieldErrs = append(fieldErrs, FieldError{Field: key, Error: msg})
+		}
+		sort.Slice(fieldErrs, func(i, j int) bool { return fieldErrs[i].Field < fieldErrs[j].Field })
+		return ValidationError{Message: "Invalid form", Fields: fieldErrs}.HTTPError()
+	}
+
+	return validateRequest(v, "schema")
+}
+
+// The values DecodeForm decodes: the body's, if it's a form, otherwise
+// the query string's
+func (g *Req) formValues() (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(g.R.Header.Get("Content-Type"))
+	if g.R.Method != "POST" && g.R.Method != "PUT" && g.R.Method != "PATCH" {
+		// No body form, as far as net/http is concerned
+		mediaType = ""
+	}
+	switch mediaType {
+	case "multipart/form-data":
+		maxBytes, _ := g.Cfg.GetInt64("gop", "max_body_bytes", 10*1024*1024)
+		err := g.R.ParseMultipartForm(maxBytes)
+		if err != nil {
+			return nil, decodeError("Failed to parse form: " + err.Error())
+		}
+		return g.R.PostForm, nil
+	case "application/x-www-form-urlencoded":
+		// Usually already done by the time the handler runs
+		err := g.R.ParseForm()
+		if err != nil {
+			return nil, decodeError("Failed to parse form: " + err.Error())
+		}
+		return g.R.PostForm, nil
+	default:
+		err := g.R.ParseForm()
+		if err != nil {
+			return nil, decodeError("Failed to parse form: " + err.Error())
+		}
+		return g.R.Form, nil
+	}
+}
+
+func validateRequest(v interface{}, nameTag string) error {
+	fieldErrs, err := Validate(v, nameTag)
+	if err != nil {
+		return err
+	}
+	if len(fieldErrs) > 0 {
+		return ValidationError{Message: "Validation failed", Fields: fieldErrs}.HTTPError()
+	}
+	return nil
+}
+
+// Check v (a struct or pointer to one) against its `validate` tags, e.g.
+//
+//	Name  string  `json:"name" validate:"required,max=64,regex=^[a-z]+$"`
+//	Count int     `json:"count" validate:"min=1,max=10"`
+//	Kind  string  `json:"kind" validate:"omitempty,enum=big|small"`
+//	Limit *int    `json:"limit" validate:"max=100"`
+//
+// min and max apply to the value of numbers and the length of strings,
+// slices and maps. regex must come last, since it may contain commas.
+// Rules apply to zero values too, unless the field has omitempty. Nil
+// pointers are only checked by required.
+// Fields are named in errors by nameTag (e.g. "json"), falling back to
+// the field name. Nested structs are validated too. A malformed tag is
+// returned as the error.
+func Validate(v interface{}, nameTag string) ([]FieldError, error) {
+	var fieldErrs []FieldError
+	err := validateValue(reflect.ValueOf(v), "", nameTag, &fieldErrs)
+	return fieldErrs, err
+}
+
+func validateValue(rv reflect.Value, prefix, nameTag string, fieldErrs *[]FieldError) error {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := fieldName(sf, nameTag)
+		if name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		rules, err := parseValidateTag(sf.Tag.Get("validate"))
+		if err != nil {
+			return fmt.Errorf("Bad validate tag on %s.%s: %s", rt.Name(), sf.Name, err)
+		}
+		fv := rv.Field(i)
+		for _, msg := range checkField(fv, rules) {
+			*fieldErrs = append(*fieldErrs, FieldError{Field: name, Error: msg})
+		}
+		err = validateValue(fv, name, nameTag, fieldErrs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fieldName(sf reflect.StructField, nameTag string) string {
+	tag := sf.Tag.Get(nameTag)
+	if tag == "" {
+		return sf.Name
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return sf.Name
+	}
+	return name
+}
+
+// One rule of a validate tag, with its argument parsed
+type validateRule struct {
+	name  string
+	arg   string
+	limit float64        // min, max
+	re    *regexp.Regexp // regex
+}
+
+type parsedValidateTag struct {
+	rules []validateRule
+	err   error
+}
+
+// Tags are fixed per type, so each is parsed once
+var validateTags sync.Map // string -> parsedValidateTag
+
+func parseValidateTag(tag string) ([]validateRule, error) {
+	if tag == "" {
+		return nil, nil
+	}
+	if parsed, ok := validateTags.Load(tag); ok {
+		return parsed.(parsedValidateTag).rules, parsed.(parsedValidateTag).err
+	}
+	rules, err := parseValidateRules(tag)
+	validateTags.Store(tag, parsedValidateTag{rules: rules, err: err})
+	return rules, err
+}
+
+func parseValidateRules(tag string) ([]validateRule, error) {
+	var rules []validateRule
+	for tag != "" {
+		// Keep regex (which may contain commas) whole
+		rule := tag
+		if strings.HasPrefix(tag, "regex=") {
+			tag = ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			tag = ""
+		}
+
+		r := validateRule{name: rule}
+		if i := strings.IndexByte(rule, '='); i >= 0 {
+			r.name, r.arg = rule[:i], rule[i+1:]
+		}
+		var err error
+		switch r.name {
+		case "required", "omitempty":
+		case "min", "max":
+			r.limit, err = strconv.ParseFloat(r.arg, 64)
+		case "regex":
+			r.re, err = regexp.Compile(r.arg)
+		case "enum":
+			if r.arg == "" {
+				err = errors.New("no values")
+			}
+		default:
+			err = errors.New("unknown rule")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %s", rule, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func checkField(fv reflect.Value, rules []validateRule) []string {
+	var msgs []string
+
+	isZero := fv.IsZero()
+	for _, r := range rules {
+		if r.name == "omitempty" && isZero {
+			return nil
+		}
+	}
+	for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+		fv = fv.Elem()
+	}
+	for _, r := range rules {
+		switch r.name {
+		case "required":
+			if isZero {
+				msgs = append(msgs, "is required")
+			}
+			continue
+		case "omitempty":
+			continue
+		}
+		// Nothing to check in a nil pointer, i.e. one which wasn't given
+		if fv.Kind() == reflect.Ptr {
+			continue
+		}
+		switch r.name {
+		case "min", "max":
+			n, isLength, ok := fieldMagnitude(fv)
+			if !ok {
+				continue
+			}
+			what := "be"
+			if isLength {
+				what = "have length"
+			}
+			if r.name == "min" && n < r.limit {
+				msgs = append(msgs, fmt.Sprintf("must %s at least %s", what, r.arg))
+			} else if r.name == "max" && n > r.limit {
+				msgs = append(msgs, fmt.Sprintf("must %s at most %s", what, r.arg))
+			}
+		case "regex":
+			if fv.Kind() == reflect.String && !r.re.MatchString(fv.String()) {
+				msgs = append(msgs, "must match "+r.arg)
+			}
+		case "enum":
+			s := fmt.Sprint(fv.Interface())
+			found := false
+			for _, allowed := range strings.Split(r.arg, "|") {
+				if s == allowed {
+					found = true
+					break
+				}
+			}
+			if !found {
+				msgs = append(msgs, "must be one of "+strings.Replace(r.arg, "|", ", ", -1))
+			}
+		}
+	}
+	return msgs
+}
+
+// The number min/max compare against: the value of numbers, or the length
+// of strings and containers
+func fieldMagnitude(fv reflect.Value) (n float64, isLength, ok bool) {
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), false, true
+	case reflect.String:
+		return float64(len([]rune(fv.String()))), true, true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(fv.Len()), true, true
+	}
+	return 0, false, false
+}
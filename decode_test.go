@@ -0,0 +1,263 @@
+package gop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckField(t *testing.T) {
+	zero, three, eleven := 0, 3, 11
+	tests := []struct {
+		value interface{}
+		tag   string
+		want  []string
+	}{
+		{"", "", nil},
+		{"", "required", []string{"is required"}},
+		{"bob", "required", nil},
+		// Zero values are checked, not skipped
+		{0, "min=1,max=10", []string{"must be at least 1"}},
+		{"", "min=2", []string{"must have length at least 2"}},
+		{"", "enum=big|small", []string{"must be one of big, small"}},
+		{"", "regex=^[a-z]+$", []string{"must match ^[a-z]+$"}},
+		{"big", "enum=big|small", nil},
+		{"huge", "enum=big|small", []string{"must be one of big, small"}},
+		{"héllo", "max=5", nil},
+		{"abc,def", "regex=^[a-z]+,[a-z]+$", nil},
+		{[]int{1, 2, 3}, "max=2", []string{"must have length at most 2"}},
+		// Unless they're optional
+		{"", "omitempty,enum=big|small", nil},
+		{"huge", "omitempty,enum=big|small", []string{"must be one of big, small"}},
+		{0, "omitempty,min=1", nil},
+		// Nil pointers weren't given, so only required applies
+		{(*int)(nil), "min=1", nil},
+		{(*int)(nil), "required,min=1", []string{"is required"}},
+		{&zero, "min=1", []string{"must be at least 1"}},
+		{&zero, "required", nil},
+		{&three, "min=1,max=10", nil},
+		{&eleven, "min=1,max=10", []string{"must be at most 10"}},
+	}
+	for _, test := range tests {
+		rules, err := parseValidateTag(test.tag)
+		if err != nil {
+			t.Errorf("parseValidateTag(%q): %s", test.tag, err)
+			continue
+		}
+		got := checkField(reflect.ValueOf(test.value), rules)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("checkField(%#v, %q) = %q, want %q", test.value, test.tag, got, test.want)
+		}
+	}
+}
+
+func TestParseValidateTagErrors(t *testing.T) {
+	for _, tag := range []string{
+		"min=one",
+		"max=",
+		"regex=[a-",
+		"enum=",
+		"requried",
+		"required,maximum=3",
+	} {
+		if _, err := parseValidateTag(tag); err == nil {
+			t.Errorf("parseValidateTag(%q) succeeded, want error", tag)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	type inner struct {
+		Kind string `json:"kind" validate:"enum=a|b"`
+	}
+	type request struct {
+		Name  string `json:"name" validate:"required"`
+		Count int    `json:"count" validate:"min=1"`
+		Inner inner  `json:"inner"`
+		Limit *int   `json:"limit" validate:"max=100"`
+	}
+	fieldErrs, err := Validate(&request{Inner: inner{Kind: "c"}}, "json")
+	if err != nil {
+		t.Fatalf("Validate: %s", err)
+	}
+	want := []FieldError{
+		{Field: "name", Error: "is required"},
+		{Field: "count", Error: "must be at least 1"},
+		{Field: "inner.kind", Error: "must be one of a, b"},
+	}
+	if !reflect.DeepEqual(fieldErrs, want) {
+		t.Errorf("Validate = %v, want %v", fieldErrs, want)
+	}
+
+	type badTag struct {
+		Count int `validate:"min=x"`
+	}
+	_, err = Validate(badTag{Count: 1}, "json")
+	if err == nil {
+		t.Errorf("Validate with a bad tag succeeded, want error")
+	}
+	if _, ok := err.(HTTPError); ok {
+		t.Errorf("Bad tag reported as %v, want an internal error", err)
+	}
+}
+
+func TestDecodeFormCSRFField(t *testing.T) {
+	a := InitCmd("gop_test", "decode")
+	type form struct {
+		Name string `schema:"name"`
+	}
+	decode := func(body string) (form, error) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		g := &Req{common: a.common, app: a, R: r}
+		var f form
+		err := g.DecodeForm(&f)
+		return f, err
+	}
+
+	// The token from {{csrfField}} isn't an unknown field
+	f, err := decode("name=bob&csrf_token=abc")
+	if err != nil || f.Name != "bob" {
+		t.Errorf("DecodeForm with the CSRF token = %+v, %v", f, err)
+	}
+	_, err = decode("name=bob&colour=red")
+	if err == nil {
+		t.Errorf("DecodeForm with an unknown field succeeded, want error")
+	}
+
+	a.Cfg.TransientOverride("gop", "csrf_field", "_token")
+	f, err = decode("name=bob&_token=abc")
+	if err != nil || f.Name != "bob" {
+		t.Errorf("DecodeForm with csrf_field _token = %+v, %v", f, err)
+	}
+	_, err = decode("name=bob&csrf_token=abc")
+	if err == nil {
+		t.Errorf("DecodeForm kept ignoring csrf_token after csrf_field changed")
+	}
+}
+
+func TestDecodeFormSource(t *testing.T) {
+	a := InitCmd("gop_test", "decode")
+	type form struct {
+		Name string `schema:"name"`
+	}
+	multipartBody := "--XX\r\nContent-Disposition: form-data; name=\"name\"\r\n\r\nbob\r\n--XX--\r\n"
+	tests := []struct {
+		method      string
+		target      string
+		contentType string
+		body        string
+		ok          bool
+	}{
+		// A cache buster on a form post isn't an unknown field
+		{"POST", "/?_=123", "application/x-www-form-urlencoded", "name=bob", true},
+		{"POST", "/?_=123", "multipart/form-data; boundary=XX", multipartBody, true},
+		{"POST", "/", "multipart/form-data; boundary=XX", multipartBody, true},
+		// Nor is it decoded as part of the form
+		{"POST", "/?name=eve", "application/x-www-form-urlencoded", "", true},
+		{"POST", "/", "application/x-www-form-urlencoded", "name=bob&colour=red", false},
+		// Without a body form, the query string is the form
+		{"GET", "/?name=bob", "", "", true},
+		{"GET", "/?name=bob", "application/x-www-form-urlencoded", "", true},
+		{"GET", "/?name=bob&colour=red", "", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		g := &Req{common: a.common, app: a, R: r}
+		var f form
+		err := g.DecodeForm(&f)
+		if test.ok && err != nil {
+			t.Errorf("%s %s (%s): %s", test.method, test.target, test.contentType, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s %s (%s) with an unknown field succeeded, want error", test.method, test.target, test.contentType)
+		}
+		if test.ok && test.body != "" && f.Name != "bob" {
+			t.Errorf("%s %s (%s): Name = %q, want bob", test.method, test.target, test.contentType, f.Name)
+		}
+		if test.ok && test.body == "" && test.method == "POST" && f.Name != "" {
+			t.Errorf("%s %s: query string decoded into a body form", test.method, test.target)
+		}
+	}
+}
+
+type decodeTestTime struct{}
+
+func (decodeTestTime) UnmarshalJSON([]byte) error { return nil }
+
+func TestUnknownJSONField(t *testing.T) {
+	type Base struct {
+		ID int `json:"id"`
+	}
+	type address struct {
+		Zip string `json:"zip"`
+	}
+	type request struct {
+		Base
+		Name      string             `json:"name"`
+		Secret    string             `json:"-"`
+		Plain     int                // Matched case-insensitively, as encoding/json does
+		Address   *address           `json:"address,omitempty"`
+		Addresses []address          `json:"addresses"`
+		ByName    map[string]address `json:"by_name"`
+		When      decodeTestTime     `json:"when"`
+		Any       interface{}        `json:"any"`
+		hidden    int
+	}
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"id": 1, "name": "bob", "plain": 2, "PLAIN": 3}`, ""},
+		{`{"address": {"zip": "N1"}, "addresses": [{"zip": "N1"}], "by_name": {"home": {"zip": "N1"}}}`, ""},
+		{`{"when": {"anything": 1}, "any": {"anything": 1}, "address": null}`, ""},
+		{`{"colour": "red"}`, "colour"},
+		{`{"Secret": "x"}`, "Secret"},
+		{`{"hidden": 1}`, "hidden"},
+		{`{"Base": {"id": 1}}`, "Base"},
+		{`{"address": {"zip": "N1", "street": "x"}}`, "address.street"},
+		{`{"addresses": [{"zip": "N1"}, {"city": "x"}]}`, "addresses.1.city"},
+		{`{"by_name": {"home": {"city": "x"}}}`, "by_name.home.city"},
+	}
+	for _, test := range tests {
+		if got := unknownJSONField([]byte(test.body), reflect.TypeOf(&request{})); got != test.want {
+			t.Errorf("unknownJSONField(%s) = %q, want %q", test.body, got, test.want)
+		}
+	}
+}
+
+func TestDecodeJSONUnknownField(t *testing.T) {
+	a := InitCmd("gop_test", "decode")
+	type request struct {
+		Name string `json:"name"`
+	}
+	decode := func(body string) error {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		g := &Req{common: a.common, app: a, R: r}
+		var req request
+		return g.DecodeJSON(&req)
+	}
+
+	err := decode(`{"name": "bob", "colour": "red"}`)
+	httpErr, ok := err.(HTTPError)
+	if !ok || httpErr.Code != http.StatusBadRequest {
+		t.Fatalf("DecodeJSON with an unknown field = %v, want a 400", err)
+	}
+	want := []FieldError{{Field: "colour", Error: "unknown field"}}
+	if !reflect.DeepEqual(httpErr.Details, want) {
+		t.Errorf("Details = %v, want %v", httpErr.Details, want)
+	}
+	if err := decode(`{"name": "bob"} {}`); err == nil {
+		t.Errorf("DecodeJSON with trailing data succeeded, want error")
+	}
+
+	a.Cfg.TransientOverride("gop", "decode_strict", "false")
+	if err := decode(`{"name": "bob", "colour": "red"}`); err != nil {
+		t.Errorf("DecodeJSON with decode_strict false: %s", err)
+	}
+}
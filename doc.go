@@ -90,6 +90,9 @@ GOP provides a few HTTP handlers, all beginning with "/gop", that you can enable
 true in the [gop] section of your configuration file. Otherwise, GOP will respond with "not enabled" when you
 will try to access those handlers.
 
+Except for the health checks, these handlers are only served to clients which pass the admin_auth_* checks
+(by default, clients on the local machine if trusted_proxies is set, otherwise none).
+
 The following handlers are available:
 
   /gop/config/:section/:key
@@ -100,9 +103,22 @@ The following handlers are available:
     When the HTTP verb is not PUT, :section and :key are ignored and the method returns the complete config,
     including any overrides. In fact, you can omit :section and :key altogether, i.e. "/gop/config" will suffice.
 
+ /gop/health/live
+
+    Liveness probe. Always returns 200 if the app is able to serve requests. Unlike the other /gop
+    handlers, the health handlers are enabled by default (set enable_health_urls to false to disable).
+
+ /gop/health/ready
+
+    Readiness probe. Runs the checks registered with app.RegisterHealthCheck() and returns 503 if any
+    critical check fails, or if the app is draining requests during a graceful restart. Results of all
+    checks are returned as JSON.
+
  /gop/status
 
-    TODO
+    Returns a JSON snapshot of the app: open requests, request totals and per-status counts, recent
+    slow requests, recent graceful restart reasons, watchdog limits and current values, build info
+    and Go version. If the Accept header asks for text/html, an HTML dashboard is returned instead.
 
  /gop/stack
 
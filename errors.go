@@ -0,0 +1,153 @@
+package gop
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Turns an application error into the HTTPError to send. Return false if
+// the error isn't one you handle.
+type ErrorMapper func(err error) (HTTPError, bool)
+
+// Errors can implement this to set HTTPError.ErrorCode when mapped
+type ErrorCoder interface {
+	ErrorCode() string
+}
+
+// Add a mapper for errors returned by handlers. Mappers are tried in the
+// order registered, after checking for an HTTPError.
+func (a *App) RegisterErrorMapper(m ErrorMapper) {
+	a.errorMappers = append(a.errorMappers, m)
+}
+
+// Send errors of the same type as example (found with errors.As) with the
+// given status code. The error message is sent as the body, so it should be
+// fit for clients to see. Panics if example is nil, which has no type.
+//
+//	app.RegisterErrorType(&NoSuchAccountError{}, http.StatusNotFound)
+func (a *App) RegisterErrorType(example error, code int) {
+	if example == nil {
+		panic("RegisterErrorType needs an example error, not nil")
+	}
+	errType := reflect.TypeOf(example)
+	a.RegisterErrorMapper(func(err error) (HTTPError, bool) {
+		target := reflect.New(errType)
+		if !errors.As(err, target.Interface()) {
+			return HTTPError{}, false
+		}
+		return mappedHTTPError(target.Elem().Interface().(error), code), true
+	})
+}
+
+// Send errors matching target (with errors.Is) with the given status code.
+//
+//	app.RegisterErrorValue(sql.ErrNoRows, http.StatusNotFound)
+func (a *App) RegisterErrorValue(target error, code int) {
+	a.RegisterErrorMapper(func(err error) (HTTPError, bool) {
+		if !errors.Is(err, target) {
+			return HTTPError{}, false
+		}
+		return mappedHTTPError(err, code), true
+	})
+}
+
+func mappedHTTPError(err error, code int) HTTPError {
+	httpErr := HTTPError{Code: code, Body: err.Error()}
+	var coder ErrorCoder
+	if errors.As(err, &coder) {
+		httpErr.ErrorCode = coder.ErrorCode()
+	}
+	return httpErr
+}
+
+// Work out what to send for an error returned by a handler. Unrecognised
+// errors become a 500 which doesn't reveal the error, unless
+// error_show_internal is set.
+func (a *App) toHTTPError(err error) HTTPError {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+	var validationErr ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.HTTPError()
+	}
+	for _, m := range a.errorMappers {
+		if httpErr, ok := m(err); ok {
+			return httpErr
+		}
+	}
+
+	httpErr = HTTPError{
+		Code:      http.StatusInternalServerError,
+		Body:      "Internal error",
+		ErrorCode: "internal_error",
+	}
+	if showInternal, _ := a.Cfg.GetBool("gop", "error_show_internal", false); showInternal {
+		httpErr.Body += ": " + err.Error()
+	}
+	return httpErr
+}
+
+// RFC 7807 problem details
+type problemDetails struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   string      `json:"detail,omitempty"`
+	Instance string      `json:"instance,omitempty"`
+	Code     string      `json:"code,omitempty"`
+	Details  interface{} `json:"details,omitempty"`
+}
+
+// True if the Accept header explicitly asks for some kind of JSON
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
+
+// Should h be sent as problem+json rather than plain text?
+func (h HTTPError) wantsProblemJSON(r *http.Request) bool {
+	if h.ContentType != "" {
+		// The body is already in the format the handler wants
+		return false
+	}
+	// Details can't be shown as text, so use JSON anyway
+	return h.Details != nil || (r != nil && acceptsJSON(r))
+}
+
+func (h HTTPError) problemJSON(r *http.Request, typeBaseURL string) []byte {
+	problem := problemDetails{
+		Type:    "about:blank",
+		Title:   http.StatusText(h.Code),
+		Status:  h.Code,
+		Detail:  h.Body,
+		Code:    h.ErrorCode,
+		Details: h.Details,
+	}
+	if h.ErrorCode != "" && typeBaseURL != "" {
+		problem.Type = typeBaseURL + h.ErrorCode
+	}
+	if r != nil {
+		problem.Instance = r.URL.Path
+	}
+	body, err := json.Marshal(problem)
+	if err != nil {
+		// Must be the details. Send the rest.
+		problem.Details = nil
+		body, _ = json.Marshal(problem)
+	}
+	return body
+}
@@ -0,0 +1,141 @@
+package gop
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type noSuchAccountError struct {
+	id int
+}
+
+func (e *noSuchAccountError) Error() string     { return fmt.Sprintf("No account %d", e.id) }
+func (e *noSuchAccountError) ErrorCode() string { return "no_such_account" }
+
+var errTestConflict = errors.New("Conflict")
+
+func TestToHTTPError(t *testing.T) {
+	a := InitCmd("gop_test", "errors")
+	a.RegisterErrorType(&noSuchAccountError{}, http.StatusNotFound)
+	a.RegisterErrorValue(errTestConflict, http.StatusConflict)
+	// Never reached for errTestConflict, as mappers are tried in order
+	a.RegisterErrorMapper(func(err error) (HTTPError, bool) {
+		return HTTPError{Code: http.StatusTeapot}, errors.Is(err, errTestConflict)
+	})
+
+	tests := []struct {
+		err       error
+		code      int
+		body      string
+		errorCode string
+	}{
+		{HTTPError{Code: http.StatusForbidden, Body: "No"}, http.StatusForbidden, "No", ""},
+		{fmt.Errorf("wrapped: %w", HTTPError{Code: http.StatusGone}), http.StatusGone, "", ""},
+		{ValidationError{Message: "Bad"}, http.StatusBadRequest, "Bad", "invalid_request"},
+		{&noSuchAccountError{id: 3}, http.StatusNotFound, "No account 3", "no_such_account"},
+		{fmt.Errorf("loading: %w", &noSuchAccountError{id: 4}), http.StatusNotFound, "No account 4", "no_such_account"},
+		{fmt.Errorf("saving: %w", errTestConflict), http.StatusConflict, "saving: Conflict", ""},
+		{errors.New("secret"), http.StatusInternalServerError, "Internal error", "internal_error"},
+	}
+	for _, test := range tests {
+		httpErr := a.toHTTPError(test.err)
+		if httpErr.Code != test.code || httpErr.Body != test.body || httpErr.ErrorCode != test.errorCode {
+			t.Errorf("toHTTPError(%v) = %d %q %q, want %d %q %q", test.err,
+				httpErr.Code, httpErr.Body, httpErr.ErrorCode, test.code, test.body, test.errorCode)
+		}
+	}
+
+	a.Cfg.TransientOverride("gop", "error_show_internal", "true")
+	if httpErr := a.toHTTPError(errors.New("secret")); httpErr.Body != "Internal error: secret" {
+		t.Errorf("With error_show_internal, body = %q", httpErr.Body)
+	}
+}
+
+func TestRegisterErrorTypeNil(t *testing.T) {
+	a := InitCmd("gop_test", "errors")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("RegisterErrorType(nil) didn't panic")
+		}
+	}()
+	a.RegisterErrorType(nil, http.StatusNotFound)
+}
+
+func TestProblemJSON(t *testing.T) {
+	a, srv := newTestApp(t, "errors")
+	a.Cfg.TransientOverride("gop", "error_type_base_url", "https://example.com/errors/")
+	a.HandleFunc("/plain", func(g *Req) error {
+		return HTTPError{Code: http.StatusNotFound, Body: "No thing", ErrorCode: "no_thing"}
+	})
+	a.HandleFunc("/details", func(g *Req) error {
+		return ValidationError{Message: "Invalid", Fields: []FieldError{{Field: "name", Error: "is required"}}}
+	})
+	a.HandleFunc("/html", func(g *Req) error {
+		return HTTPError{Code: http.StatusNotFound, Body: "<p>No thing</p>", ContentType: "text/html"}
+	})
+
+	tests := []struct {
+		path        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"/plain", "", "text/plain", "No thing"},
+		{"/plain", "text/html, */*", "text/plain", "No thing"},
+		{"/plain", "application/json", "application/problem+json", ""},
+		{"/plain", "text/html, application/vnd.api+json", "application/problem+json", ""},
+		{"/plain", "application/json;q=0, text/plain", "text/plain", "No thing"},
+		// Details can only be sent as JSON
+		{"/details", "text/html", "application/problem+json", ""},
+		// The handler chose its format
+		{"/html", "application/json", "text/html", "<p>No thing</p>"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, test.contentType) {
+			t.Errorf("%s with Accept %q: Content-Type %q, want %q", test.path, test.accept, ct, test.contentType)
+			continue
+		}
+		if test.contentType != "application/problem+json" {
+			if got := strings.TrimSpace(string(body)); got != test.body {
+				t.Errorf("%s with Accept %q: body %q, want %q", test.path, test.accept, got, test.body)
+			}
+			continue
+		}
+
+		var problem map[string]interface{}
+		if err := json.Unmarshal(body, &problem); err != nil {
+			t.Errorf("%s: bad problem+json %q: %s", test.path, body, err)
+			continue
+		}
+		if problem["instance"] != test.path || problem["status"] != float64(resp.StatusCode) {
+			t.Errorf("%s: unexpected problem %v", test.path, problem)
+		}
+		switch test.path {
+		case "/plain":
+			if problem["type"] != "https://example.com/errors/no_thing" || problem["title"] != "Not Found" || problem["detail"] != "No thing" {
+				t.Errorf("%s: unexpected problem %v", test.path, problem)
+			}
+		case "/details":
+			details, _ := problem["details"].([]interface{})
+			if len(details) != 1 {
+				t.Errorf("%s: details %v, want the field error", test.path, problem["details"])
+			}
+		}
+	}
+}
@@ -66,11 +66,10 @@ func main() {
 		if err != nil {
 			return gop.BadRequest("Need to supply a duration as 'secs'")
 		}
-		cn := g.W.CloseNotify()
 		g.Error("About to sleep")
 		select {
-		case <-cn:
-			g.Error("Caller closed connection")
+		case <-g.Context().Done():
+			g.Error("Caller closed connection: %s", g.Context().Err())
 		case <-time.After(sleepDuration):
 			g.Error("Received timeout")
 		}
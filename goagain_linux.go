@@ -1,8 +1,10 @@
 package gop
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"strings"
 	"syscall"
 	"time"
 
@@ -10,13 +12,14 @@ import (
 )
 
 func (a *App) StartGracefulRestart(reason string) {
-	if a.doingGraceful {
+	if a.doingGraceful.Load() {
 		a.Debug("Ignoring graceful [%s] - already in graceful", reason)
 		return
 	}
 
 	// Caller should ERROR the reason
 	a.Info("Starting triggered graceful restart: %s", reason)
+	a.recordRestartReason(reason)
 	myPid := os.Getpid()
 	me, err := os.FindProcess(myPid)
 	if err != nil {
@@ -24,13 +27,14 @@ func (a *App) StartGracefulRestart(reason string) {
 		return
 	}
 	a.Info("Sending SIGUSR2 to %d", myPid)
-	a.doingGraceful = true
+	a.doingGraceful.Store(true)
 	me.Signal(syscall.SIGUSR2)
 }
 
 func (a *App) goAgainSetup() {
 	goagain.OnSIGUSR1 = func(l net.Listener) error {
 		a.Info("SIGUSR1 received")
+		a.reloadTLSCerts()
 		return nil
 	}
 }
@@ -38,6 +42,18 @@ func (a *App) goAgainSetup() {
 func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 	l, ppid, err := goagain.GetEnvs()
 
+	var inherited map[string]inheritedListener
+	if err == nil {
+		// goagain only hands down the main listener, so fetch the others
+		// before our parent goes away
+		var inheritErr error
+		inherited, inheritErr = a.inheritListeners(ppid)
+		if inheritErr != nil {
+			a.Error("Failed to take over listeners from graceful parent: %s", inheritErr.Error())
+		}
+	}
+	a.startSecondaryListeners(inherited)
+
 	if err != nil {
 		a.Info("No parent - starting listener on %s:%s", listenNet, listenAddr)
 		// No parent, start our own listener
@@ -54,8 +70,9 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 		}
 	}
 	go func() {
-		a.Serve(l)
+		a.serveMain(l)
 	}()
+	go a.serveListenerHandoff()
 
 	// Block the main goroutine awaiting signals.
 	if err := goagain.AwaitSignals(l); nil != err {
@@ -63,10 +80,13 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 	}
 
 	a.Error("Signal received - starting exit or restart")
+	// Fail readiness checks while we drain
+	a.doingGraceful.Store(true)
 
 	// We're the parent. Our child has taken over the listening duties. We can close
 	// off our listener and drain pending requests.
 	l.Close()
+	a.closeSecondaryListeners()
 	waitSecs, _ := a.Cfg.GetInt("gop", "graceful_wait_secs", 60)
 	timeoutChan := time.After(time.Second * time.Duration(waitSecs))
 
@@ -79,6 +99,8 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 		case <-timeoutChan:
 			{
 				a.Error("Graceful restart timed out after %d seconds - being less graceful and exiting", waitSecs)
+				// Let any remaining handlers know they're out of time
+				a.shutdownCancel()
 				waiting = false
 			}
 		case <-tickChan:
@@ -97,3 +119,149 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 	appStats := a.GetStats()
 	a.Info("Graceful restart/exit - with %d pending reqs", appStats.currentReqs)
 }
+
+// Where a graceful parent hands its secondary listeners to its child
+func listenerHandoffAddr(pid int) *net.UnixAddr {
+	// Abstract, so there's no file to clean up
+	return &net.UnixAddr{Name: fmt.Sprintf("@gop-listeners-%d", pid), Net: "unix"}
+}
+
+// Most listeners handed over at once
+const maxHandoffListeners = 64
+
+// Pass our secondary listeners' sockets to any graceful child which asks
+func (a *App) serveListenerHandoff() {
+	ul, err := net.ListenUnix("unix", listenerHandoffAddr(os.Getpid()))
+	if err != nil {
+		a.Error("Can't listen for graceful child - secondary listeners won't be handed over: %s", err.Error())
+		return
+	}
+	defer ul.Close()
+	for {
+		conn, err := ul.AcceptUnix()
+		if err != nil {
+			return
+		}
+		err = a.handOffListeners(conn)
+		if err != nil {
+			a.Error("Failed to hand over listeners: %s", err.Error())
+		}
+		conn.Close()
+	}
+}
+
+func (a *App) handOffListeners(conn *net.UnixConn) error {
+	// Anyone on the box can connect to an abstract socket
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return err
+	}
+	if int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf("Refusing to hand listeners to pid %d, uid %d", cred.Pid, cred.Uid)
+	}
+
+	a.secondaryListenersMu.Lock()
+	var lines []string
+	var files []*os.File
+	for _, spec := range a.secondaryListeners {
+		fl, ok := spec.l.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			a.Error("Can't hand over listener [%s]: %s", spec.name, err.Error())
+			continue
+		}
+		lines = append(lines, spec.name+" "+spec.addr)
+		files = append(files, f)
+	}
+	a.secondaryListenersMu.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if len(files) > maxHandoffListeners {
+		return fmt.Errorf("Too many listeners to hand over (%d)", len(files))
+	}
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	// The header line ensures there's always something to read
+	msg := strings.Join(append([]string{"gop-listeners"}, lines...), "\n")
+	_, _, err = conn.WriteMsgUnix([]byte(msg), oob, nil)
+	return err
+}
+
+// Fetch our graceful parent's secondary listeners, by name
+func (a *App) inheritListeners(ppid int) (map[string]inheritedListener, error) {
+	conn, err := net.DialUnix("unix", nil, listenerHandoffAddr(ppid))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(secondaryListenTimeout))
+
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, syscall.CmsgSpace(4*maxHandoffListeners))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	if lines[0] != "gop-listeners" || len(lines)-1 != len(fds) {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("Bad listener handoff message")
+	}
+	inherited := make(map[string]inheritedListener)
+	for i, fd := range fds {
+		parts := strings.SplitN(lines[i+1], " ", 2)
+		f := os.NewFile(uintptr(fd), parts[0])
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			a.Error("Can't take over listener [%s]: %s", parts[0], err.Error())
+			continue
+		}
+		if len(parts) != 2 {
+			a.Error("Can't take over listener [%s]: no address given", parts[0])
+			l.Close()
+			continue
+		}
+		inherited[parts[0]] = inheritedListener{addr: parts[1], l: l}
+	}
+	return inherited, nil
+}
@@ -0,0 +1,116 @@
+package gop
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// Stands in for our graceful parent's pid, so tests don't take the real
+// handoff address
+const testHandoffPid = 1 << 30
+
+// Serve one handoff request with f, as a graceful parent would. Close
+// the returned listener to free the address.
+func serveTestHandoff(t *testing.T, f func(conn *net.UnixConn)) *net.UnixListener {
+	ul, err := net.ListenUnix("unix", listenerHandoffAddr(testHandoffPid))
+	if err != nil {
+		t.Fatalf("Can't listen for handoff: %s", err)
+	}
+	t.Cleanup(func() { ul.Close() })
+	go func() {
+		conn, err := ul.AcceptUnix()
+		if err != nil {
+			return
+		}
+		f(conn)
+		conn.Close()
+	}()
+	return ul
+}
+
+func TestListenerHandoff(t *testing.T) {
+	parent := InitCmd("gop_test", "handoff")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	parent.addSecondaryListener(&secondaryListener{name: "internal", net: "tcp", addr: "127.0.0.1:9999", l: l})
+	serveTestHandoff(t, func(conn *net.UnixConn) {
+		if err := parent.handOffListeners(conn); err != nil {
+			t.Errorf("handOffListeners: %s", err)
+		}
+	})
+
+	child := InitCmd("gop_test", "handoff")
+	inherited, err := child.inheritListeners(testHandoffPid)
+	if err != nil {
+		t.Fatalf("inheritListeners: %s", err)
+	}
+	il, ok := inherited["internal"]
+	if len(inherited) != 1 || !ok || il.addr != "127.0.0.1:9999" {
+		t.Fatalf("Inherited %v", inherited)
+	}
+	defer il.l.Close()
+	// The same socket, so connections to the parent's address reach it
+	if il.l.Addr().String() != l.Addr().String() {
+		t.Errorf("Inherited listener on %s, want %s", il.l.Addr(), l.Addr())
+	}
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	conn.Close()
+	if c, err := il.l.Accept(); err != nil {
+		t.Errorf("Accept on inherited listener: %s", err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestListenerHandoffMalformed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File: %s", err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	tests := []struct {
+		msg  string
+		fds  int
+		want int // Listeners taken over, or -1 for an error
+	}{
+		{"gop-listeners\ngood 127.0.0.1:1\nbad", 2, 1},
+		{"gop-listeners\ngood 127.0.0.1:1", 2, -1},
+		{"something else\ngood 127.0.0.1:1", 1, -1},
+	}
+	for _, test := range tests {
+		ul := serveTestHandoff(t, func(conn *net.UnixConn) {
+			fds := make([]int, test.fds)
+			for i := range fds {
+				fds[i] = fd
+			}
+			conn.WriteMsgUnix([]byte(test.msg), syscall.UnixRights(fds...), nil)
+		})
+		inherited, err := InitCmd("gop_test", "handoff").inheritListeners(testHandoffPid)
+		switch {
+		case test.want < 0 && err == nil:
+			t.Errorf("%q: no error", test.msg)
+		case test.want >= 0 && err != nil:
+			t.Errorf("%q: %s", test.msg, err)
+		case len(inherited) != test.want && test.want >= 0:
+			t.Errorf("%q: inherited %v, want %d", test.msg, inherited, test.want)
+		}
+		for _, il := range inherited {
+			il.l.Close()
+		}
+		ul.Close()
+	}
+}
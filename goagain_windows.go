@@ -15,5 +15,6 @@ func (a *App) goAgainListenAndServe(listenNet, listenAddr string) {
 	if err != nil {
 		a.Fatalln(err)
 	}
-	a.Serve(l)
+	a.startSecondaryListeners(nil)
+	a.serveMain(l)
 }
@@ -13,10 +13,12 @@
 package gop
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"os"
 
-	"github.com/gorilla/context"
+	gorillacontext "github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"github.com/gorilla/websocket"
@@ -27,6 +29,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -45,8 +49,40 @@ type AppStats struct {
 	currentReqs   int
 	currentWSReqs int
 	totalReqs     int
+	totalSlowReqs int
+	statusCounts  map[int]int
+	slowReqs      []slowReqInfo // Most recent last
 }
 
+type slowReqInfo struct {
+	Id           int
+	Method       string
+	Url          string
+	Code         int
+	StartTime    time.Time
+	DurationSecs float64
+}
+
+// Deep copy, so the snapshot can be handed out of requestMaker
+func (s AppStats) copy() AppStats {
+	statusCounts := make(map[int]int, len(s.statusCounts))
+	for code, n := range s.statusCounts {
+		statusCounts[code] = n
+	}
+	s.statusCounts = statusCounts
+	s.slowReqs = append([]slowReqInfo(nil), s.slowReqs...)
+	return s
+}
+
+type restartEvent struct {
+	Time   time.Time
+	Pid    int
+	Reason string
+}
+
+// Restart history is handed down to our graceful child in the environment
+const restartHistoryEnvName = "GOP_RESTART_HISTORY"
+
 // Represents a gop application. Create with gop.Init(projectName, applicationName)
 type App struct {
 	common
@@ -55,15 +91,61 @@ type App struct {
 	ProjectName   string
 	GorillaRouter *mux.Router
 	listener      net.Listener
-	wantReq       chan *wantReq
-	doneReq       chan *Req
-	getReqs       chan chan *Req
-	getStats      chan chan AppStats
 
-	doingGraceful            bool
+	secondaryListeners   map[string]*secondaryListener
+	secondaryListenersMu sync.Mutex
+	listenerRouters      map[string]*mux.Router
+	connStateHooks       []func(net.Conn, http.ConnState)
+	connStateHooksMu     sync.Mutex
+	csrfSecretOnce       sync.Once
+	randomCSRFSecret     []byte
+	sessionStore         SessionStore
+	sessionStoreKey      string // The config it was built from
+	sessionStoreSet      bool   // By the app, so config doesn't override
+	sessionStoreMu       sync.Mutex
+	sessionKeyOnce       sync.Once
+	randomSessionKey     []byte
+	proxyTrustMu         sync.Mutex
+	proxyTrust           *proxyTrust
+	tlsMu                sync.Mutex
+	tlsConfig            *tls.Config
+	tlsCerts             *certReloader
+	wantReq              chan *wantReq
+	doneReq              chan *Req
+	getReqs              chan chan *Req
+	getStats             chan chan AppStats
+
+	doingGraceful            atomic.Bool // Set from the signal handling goroutine, read by requests
 	accessLog                *os.File
+	accessLogMu              sync.Mutex
 	suppressedAccessLogLines int
 	logDir                   string
+	metricsBackends          []MetricsBackend
+	tracer                   *tracer
+	coreMiddleware           []Middleware
+	shutdownCtx              context.Context // Cancelled when graceful restart gives up waiting
+	shutdownCancel           context.CancelFunc
+	middleware               []Middleware
+	middlewareMu             sync.Mutex    // Guards middleware, coreMiddleware and Router middleware
+	middlewareGen            atomic.Uint64 // Bumped on every change to the middleware
+	errorMappers             []ErrorMapper
+	compressors              map[string]CompressorFunc
+	compressorsMu            sync.Mutex
+	rateLimiters             map[string]*rateLimiter
+	configuredRateLimits     map[string]RateLimit // rate_limit_* config, by key
+	rateLimitersMu           sync.Mutex           // Guards rateLimiters and configuredRateLimits
+	concurrencyLimiters      map[string]*concurrencyLimiter
+	concurrencyConfig        *concurrencyConfig
+	concurrencyLimitersMu    sync.Mutex // Guards concurrencyLimiters and concurrencyConfig
+	authenticators           []Authenticator
+	adminAuthenticators      []Authenticator
+	authenticatorsSet        bool // By the app, so config doesn't override
+	adminAuthenticatorsSet   bool
+	authMu                   sync.RWMutex
+	restartHistory           []restartEvent // Most recent last
+	restartHistoryMu         sync.Mutex
+	healthChecks             map[string]*healthCheck
+	healthChecksMu           sync.Mutex
 }
 
 // The function signature your http handlers need.
@@ -77,20 +159,37 @@ type Req struct {
 	id           int
 	startTime    time.Time
 	app          *App
+	ctx          context.Context
+	cancel       context.CancelFunc
+	timeout      *reqTimeout
+	user         *User
+	csrfToken    string
+	session      *Session
+	group        *groupSettings // Of the Router the route was registered on, if any
 	R            *http.Request
+	origR        *http.Request // As handed to us, before the gop context was set
 	RealRemoteIP string
 	IsHTTPS      bool
+	Host         string // As the client asked for it, which may differ from R.Host behind a proxy
 	// Only one of these is valid to use...
 	W         *responseWriter
 	WS        *websocket.Conn
-	CanBeSlow bool //set this to true to suppress the "Slow Request" warning
+	CanBeSlow bool  //set this to true to suppress the "Slow Request" warning
+	Span      *Span // nil unless tracing_enable is set. Safe to use either way.
 }
 
 // Return one of these from a handler to control the error response
 // Returning nil if you have sent your own response (as is typical on success)
+//
+// Clients which accept JSON are sent an RFC 7807 problem+json document,
+// otherwise the Body as text.
 type HTTPError struct {
-	Code int
-	Body string
+	Code        int
+	Body        string
+	ContentType string      // Optional. If set, Body is sent as-is with this type.
+	ErrorCode   string      // Optional application error code, e.g. "no_such_account"
+	Details     interface{} // Optional, JSON-encodable. Always sent as JSON.
+	Headers     http.Header // Optional extra response headers
 }
 
 // To satisfy the interface only
@@ -98,6 +197,27 @@ func (h HTTPError) Error() string {
 	return fmt.Sprintf("HTTP Error [%d] - %s", h.Code, h.Body)
 }
 func (h HTTPError) Write(w *responseWriter) {
+	for k, v := range h.Headers {
+		w.Header()[k] = v
+	}
+
+	var r *http.Request
+	typeBaseURL := ""
+	if w.req != nil {
+		r = w.req.R
+		typeBaseURL, _ = w.req.Cfg.Get("gop", "error_type_base_url", "")
+	}
+	if h.wantsProblemJSON(r) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(h.Code)
+		w.Write(h.problemJSON(r, typeBaseURL))
+		w.Write([]byte("\n"))
+		return
+	}
+
+	if h.ContentType != "" {
+		w.Header().Set("Content-Type", h.ContentType)
+	}
 	w.WriteHeader(h.Code)
 	w.Write([]byte(h.Body))
 	w.Write([]byte("\r\n"))
@@ -159,9 +279,12 @@ func doInit(projectName, appName string, requireConfig bool) *App {
 		getReqs:       make(chan chan *Req),
 		getStats:      make(chan chan AppStats),
 	}
+	app.shutdownCtx, app.shutdownCancel = context.WithCancel(context.Background())
 
 	app.loadAppConfigFile(requireConfig)
 
+	app.loadRestartHistory()
+
 	// Linux setuid() doesn't work with threaded procs :-O
 	// and the go runtime threads before we can get going.
 	//
@@ -176,11 +299,22 @@ func doInit(projectName, appName string, requireConfig bool) *App {
 
 	app.initStatsd()
 
+	app.initTracing()
+
+	app.initAuth()
+	app.initProxies()
+	app.initRateLimits()
+	app.initConcurrencyLimits()
+
+	app.coreMiddleware = app.DefaultCoreMiddleware()
+
 	return app
 }
 
 // Shut down the app cleanly. (Needed to flush logs)
 func (a *App) Finish() {
+	// Flush any pending trace spans while we can still log errors
+	a.closeTracing()
 	// Start a log flush
 	a.closeLogging()
 }
@@ -224,28 +358,15 @@ func (a *App) setProcessGroupForNelly() {
 func (a *App) requestMaker() {
 	nextReqId := 0
 	openReqs := make(map[int]*Req)
-	appStats := AppStats{startTime: time.Now()}
+	appStats := AppStats{
+		startTime:    time.Now(),
+		statusCounts: make(map[int]int),
+	}
 
 	for {
 		select {
 		case wantReq := <-a.wantReq:
-			realRemoteIP := wantReq.r.RemoteAddr
-			isHTTPS := false
-			useXF, _ := a.Cfg.GetBool("gop", "use_xf_headers", false)
-			if useXF {
-				xff := wantReq.r.Header.Get("X-Forwarded-For")
-				if xff != "" {
-					ips := strings.Split(xff, ",")
-					for i, ip := range ips {
-						ips[i] = strings.TrimSpace(ip)
-					}
-					// The only trustworthy component is the *last* (and only if we
-					// are behind nginx or other proxy which is stripping x-f-f from incoming requests)
-					realRemoteIP = ips[len(ips)-1]
-				}
-				xfp := wantReq.r.Header.Get("X-Forwarded-Proto")
-				isHTTPS = strings.ToLower(xfp) == "https"
-			}
+			client := a.resolveClient(wantReq.r)
 			req := Req{
 				common: common{
 					Logger:  a.Logger,
@@ -258,8 +379,10 @@ func (a *App) requestMaker() {
 				app:          a,
 				startTime:    time.Now(),
 				R:            wantReq.r,
-				RealRemoteIP: realRemoteIP,
-				IsHTTPS:      isHTTPS,
+				origR:        wantReq.r,
+				RealRemoteIP: client.remoteIP,
+				IsHTTPS:      client.isHTTPS,
+				Host:         client.host,
 			}
 			openReqs[req.id] = &req
 			nextReqId++
@@ -277,7 +400,7 @@ func (a *App) requestMaker() {
 			if !found {
 				a.Error("BUG! Unknown request id [%d] being retired")
 			} else {
-				doneReq.finished(appStats)
+				doneReq.finished(&appStats)
 				appStats.currentReqs--
 				a.Stats.Gauge("current_http_reqs", int64(appStats.currentReqs))
 				if doneReq.WS != nil {
@@ -294,14 +417,56 @@ func (a *App) requestMaker() {
 				close(reply)
 			}()
 		case statsReplyChan := <-a.getStats:
+			snapshot := appStats.copy()
 			go func() {
-				statsReplyChan <- appStats
+				statsReplyChan <- snapshot
 				close(statsReplyChan)
 			}()
 		}
 	}
 }
 
+// Remember why we restarted, for /gop/status
+func (a *App) recordRestartReason(reason string) {
+	a.restartHistoryMu.Lock()
+	defer a.restartHistoryMu.Unlock()
+
+	a.restartHistory = append(a.restartHistory, restartEvent{
+		Time:   time.Now(),
+		Pid:    os.Getpid(),
+		Reason: reason,
+	})
+	keep, _ := a.Cfg.GetInt("gop", "status_restart_history", 10)
+	if keep < 0 {
+		keep = 0
+	}
+	if len(a.restartHistory) > keep {
+		a.restartHistory = a.restartHistory[len(a.restartHistory)-keep:]
+	}
+
+	historyJson, err := json.Marshal(a.restartHistory)
+	if err != nil {
+		a.Error("Failed to encode restart history: %s", err.Error())
+		return
+	}
+	os.Setenv(restartHistoryEnvName, string(historyJson))
+}
+
+func (a *App) loadRestartHistory() {
+	historyJson := os.Getenv(restartHistoryEnvName)
+	if historyJson == "" {
+		return
+	}
+	// No logging yet, and a garbled history isn't worth failing over
+	_ = json.Unmarshal([]byte(historyJson), &a.restartHistory)
+}
+
+func (a *App) getRestartHistory() []restartEvent {
+	a.restartHistoryMu.Lock()
+	defer a.restartHistoryMu.Unlock()
+	return append([]restartEvent(nil), a.restartHistory...)
+}
+
 func (a *App) GetStats() AppStats {
 	reqStats := make(chan AppStats)
 	a.getStats <- reqStats
@@ -316,26 +481,41 @@ func (a *App) getReq(r *http.Request, websocket bool) *Req {
 	return <-reply
 }
 
-func (g *Req) finished(appStats AppStats) {
-	context.Clear(g.R) // Cleanup  gorilla stash
+// Access logging, statsd and slow request logging are done in the core
+// middleware. Here we just keep AppStats and act on it.
+func (g *Req) finished(appStats *AppStats) {
+	gorillacontext.Clear(g.R) // Cleanup  gorilla stash
+	if g.origR != g.R {
+		// initContext replaced g.R, so stashes may hang off either
+		gorillacontext.Clear(g.origR)
+	}
 
 	reqDuration := time.Since(g.startTime)
 
-	g.app.WriteAccessLog(g, reqDuration)
-
 	// Don't run time-based code for websockets
 	if g.WS != nil {
 		return
 	}
 
-	codeStatsKey := fmt.Sprintf("http_status.%d", g.W.code)
-	g.app.Stats.Inc(codeStatsKey, 1)
-
-	slowReqSecs, _ := g.Cfg.GetFloat32("gop", "slow_req_secs", 10)
-	if reqDuration.Seconds() > float64(slowReqSecs) && !g.CanBeSlow {
-		g.Error("Slow request [%s] took %s", g.R.URL, reqDuration)
-	} else {
-		g.Debug("Request took %s", reqDuration)
+	appStats.statusCounts[g.W.code]++
+
+	if g.isSlow(reqDuration) {
+		appStats.totalSlowReqs++
+		appStats.slowReqs = append(appStats.slowReqs, slowReqInfo{
+			Id:           g.id,
+			Method:       g.R.Method,
+			Url:          g.R.URL.String(),
+			Code:         g.W.code,
+			StartTime:    g.startTime,
+			DurationSecs: reqDuration.Seconds(),
+		})
+		keepSlow, _ := g.Cfg.GetInt("gop", "status_slow_history", 20)
+		if keepSlow < 0 {
+			keepSlow = 0
+		}
+		if len(appStats.slowReqs) > keepSlow {
+			appStats.slowReqs = appStats.slowReqs[len(appStats.slowReqs)-keepSlow:]
+		}
 	}
 
 	// Tidy up request finalistion (requestMaker, req.finish() method, app.requestFinished())
@@ -352,6 +532,11 @@ func (g *Req) finished(appStats AppStats) {
 	}
 }
 
+func (g *Req) isSlow(reqDuration time.Duration) bool {
+	slowReqSecs, _ := g.Cfg.GetFloat32("gop", "slow_req_secs", 10)
+	return reqDuration.Seconds() > float64(slowReqSecs) && !g.CanBeSlow
+}
+
 // send is the internal sends the given []byte with the specified MIME
 // type to the specified ResponseWriter.
 func (g *Req) send(mimetype string, v []byte) error {
@@ -434,6 +619,44 @@ func (g *Req) ParamBool(key string) (bool, error) {
 	return (s == "1" || s == "true" || s == "yes"), nil
 }
 
+// A variable from the route's path, e.g. "id" for "/users/{id}". Asking
+// for one the route doesn't have is a bug, so an internal error.
+func (g *Req) PathParam(key string) (string, error) {
+	s, ok := mux.Vars(g.R)[key]
+	if !ok {
+		return "", fmt.Errorf("No path variable [%s] in route [%s]", key, g.routeTemplate())
+	}
+	return s, nil
+}
+
+// A path variable as an int. Values which don't parse are a 404, as the
+// path names nothing.
+func (g *Req) PathInt(key string) (int, error) {
+	s, err := g.PathParam(key)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, NotFound("Bad " + key + " [" + s + "]")
+	}
+	return i, nil
+}
+
+// A path variable as an int64, e.g. for database IDs. Values which don't
+// parse are a 404, as for PathInt.
+func (g *Req) PathInt64(key string) (int64, error) {
+	s, err := g.PathParam(key)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, NotFound("Bad " + key + " [" + s + "]")
+	}
+	return i, nil
+}
+
 func (a *App) watchdog() {
 	repeat, _ := a.Cfg.GetInt("gop", "watchdog_secs", 300)
 	ticker := time.Tick(time.Second * time.Duration(repeat))
@@ -460,10 +683,15 @@ func (a *App) watchdog() {
 			appStats.currentReqs,
 			appStats.totalReqs,
 			numGoros)
-		a.Stats.Gauge("mem.sys", sysMemBytes)
-		a.Stats.Gauge("mem.alloc", allocMemBytes)
-		a.Stats.Gauge("numfds", numFDs)
-		a.Stats.Gauge("numgoro", numGoros)
+		// The runtime collector publishes these (and more) when it runs
+		if metricsSecs, _ := a.Cfg.GetInt("gop", "runtime_metrics_secs", 60); metricsSecs <= 0 {
+			a.publishGauge("mem.sys", sysMemBytes)
+			a.publishGauge("mem.alloc", allocMemBytes)
+			if err == nil {
+				a.publishGauge("numfds", numFDs)
+			}
+			a.publishGauge("numgoro", numGoros)
+		}
 
 		if sysMemBytesLimit > 0 && sysMemBytes >= sysMemBytesLimit {
 			a.Error("SYS MEM LIMIT REACHED [%d >= %d] - starting graceful restart", sysMemBytes, sysMemBytesLimit)
@@ -495,30 +723,180 @@ func (a *App) watchdog() {
 // Keep track of the status code and #bytes we write, so we can log and statsd on them
 type responseWriter struct {
 	http.ResponseWriter
-	size int
-	code int
+	size     int // As written by the handler
+	wireSize int // As sent to the client, after any compression
+	code     int
+	req      *Req
+	compress *compressor // Set by the compression middleware
+
+	held         *bufferedResponse // If set, the whole response is held here (see AutoETag)
+	notModified  bool              // Sending a 304 in place of the handler's response
+	cacheControl string            // Default Cache-Control for successful responses
+
+	// A request timeout can write the response from another goro,
+	// so writes are locked and dropped once timed out
+	mu          sync.Mutex
+	header      http.Header // If set, headers are held here until the first write
+	wroteHeader bool
+	timedOut    bool
+	onHeader    []func() // Run just before the headers are sent
 }
 
 // Satisfy the interface
 func (w *responseWriter) Header() http.Header {
+	if w.header != nil {
+		return w.header
+	}
 	return w.ResponseWriter.Header()
 }
 
+// Hold headers privately until the first write, so they can't race with
+// anything writing the response from another goro
+func (w *responseWriter) bufferHeaders() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.wroteHeader || w.header != nil {
+		return
+	}
+	w.header = make(http.Header)
+	for k, v := range w.ResponseWriter.Header() {
+		w.header[k] = v
+	}
+}
+
+// Must hold w.mu
+func (w *responseWriter) commitHeader() {
+	if w.header != nil && !w.wroteHeader {
+		h := w.ResponseWriter.Header()
+		for k := range h {
+			if _, ok := w.header[k]; !ok {
+				delete(h, k)
+			}
+		}
+		for k, v := range w.header {
+			h[k] = v
+		}
+	}
+	w.wroteHeader = true
+}
+
 func (w *responseWriter) Write(buf []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
 	w.size += len(buf)
-	return w.ResponseWriter.Write(buf)
+	if w.held != nil {
+		return w.held.Write(buf)
+	}
+	return w.write(buf)
+}
+
+// Must hold w.mu
+func (w *responseWriter) write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.writeHeader(w.code)
+	}
+	if w.notModified {
+		// A 304 has no body
+		return len(buf), nil
+	}
+	if w.compress != nil {
+		return w.compress.write(w, buf)
+	}
+	return wireWriter{w}.Write(buf)
 }
 
+// Deprecated: use g.Context().Done(), which this is now built on. Fires
+// on timeouts and graceful restart as well as the client going away.
 func (w *responseWriter) CloseNotify() <-chan bool {
-	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+	done := w.req.Context().Done()
+	ch := make(chan bool, 1)
+	go func() {
+		<-done
+		ch <- true
+	}()
+	return ch
 }
 
 func (w *responseWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return
+	}
+	if w.held != nil {
+		w.held.code = code
+		return
+	}
+	w.writeHeader(code)
+}
+
+// Whether the status line and headers have gone to the client. Compression
+// holds them back after writeHeader until it knows how to encode the body.
+// Must hold w.mu.
+func (w *responseWriter) headerSent() bool {
+	return w.wroteHeader && (w.compress == nil || w.compress.started)
+}
+
+// Register f to run just before the headers are sent, e.g. to add a cookie
+func (w *responseWriter) beforeHeader(f func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onHeader = append(w.onHeader, f)
+}
+
+// Send the headers now if nothing has been written yet
+func (w *responseWriter) sendHeader() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.wroteHeader || w.timedOut || w.held != nil {
+		return
+	}
+	w.writeHeader(w.code)
+}
+
+// Must hold w.mu
+func (w *responseWriter) writeHeader(code int) {
+	if !w.wroteHeader {
+		hooks := w.onHeader
+		w.onHeader = nil
+		for _, f := range hooks {
+			f()
+		}
+		code = w.applyCaching(code)
+	}
+	w.commitHeader()
 	w.code = code
+	if w.compress != nil && !w.compress.started {
+		// Sent once we know whether we're compressing
+		return
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Send anything buffered to the client now
+func (w *responseWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.held != nil {
+		return
+	}
+	if !w.wroteHeader {
+		w.writeHeader(w.code)
+	}
+	if w.compress != nil {
+		w.compress.flush(w)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (w *responseWriter) HasWritten() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	return w.size > 0
 }
 
@@ -572,6 +950,8 @@ func dealWithPanic(g *Req, showInResponse, showInLog, showAllInBacktrace bool, p
 		g.Error("PANIC: " + string(getBackTrace(showAllInBacktrace)))
 	}
 
+	g.Span.SetError(httpErr)
+
 	if g.W.HasWritten() {
 		g.Error("PANIC after handler had written data: %s", httpErr.Body)
 	} else {
@@ -593,7 +973,7 @@ func getBackTrace(showAllGoros bool) []byte {
 }
 
 func (a *App) WrapHandler(h HandlerFunc, requiredParams ...string) http.HandlerFunc {
-	return a.wrapHandlerInternal(h, false, requiredParams...)
+	return a.wrapHandlerInternal(h, false, nil, requiredParams...)
 }
 
 var wsUpgrader = websocket.Upgrader{
@@ -601,16 +981,19 @@ var wsUpgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-func (a *App) wrapHandlerInternal(h HandlerFunc, websocket bool, requiredParams ...string) http.HandlerFunc {
-	panicHTTPMessage, _ := a.Cfg.Get("gop", "panic_http_message", "")
-	showInLog, _ := a.Cfg.GetBool("gop", "panic_backtrace_to_log", false)
-	showInResponse, _ := a.Cfg.GetBool("gop", "panic_backtrace_in_response", false)
-	showAllInBacktrace, _ := a.Cfg.GetBool("gop", "panic_backtrace_all_goros", true)
+// group is that of the Router the handler was registered on, if any
+func (a *App) wrapHandlerInternal(h HandlerFunc, websocket bool, group *groupSettings, requiredParams ...string) http.HandlerFunc {
+	chain := &middlewareChain{app: a, group: group, h: Chain(h, RequireParams(requiredParams...))}
 
 	// Wrap the handler, so we can do before/after logic
 	f := func(w http.ResponseWriter, r *http.Request) {
 		gopRequest := a.getReq(r, websocket)
+		gopRequest.group = group
+		gopRequest.initContext()
+		gopRequest.Span = a.startRequestSpan(gopRequest)
 		defer func() {
+			gopRequest.cancel()
+			gopRequest.finishSpan()
 			a.doneReq <- gopRequest
 		}()
 		if websocket {
@@ -623,44 +1006,23 @@ func (a *App) wrapHandlerInternal(h HandlerFunc, websocket bool, requiredParams
 				return
 			}
 		} else {
-			gopWriter := responseWriter{code: 200, ResponseWriter: w}
+			gopWriter := responseWriter{code: 200, ResponseWriter: w, req: gopRequest}
 			gopRequest.W = &gopWriter
 		}
 
 		// TODO: remove this. We call in Params() on demand. Need to move current code
 		// over .Params() before we can remove this though.
-		err := r.ParseForm()
+		err := gopRequest.R.ParseForm()
 		if err != nil {
 			a.Error("Failed to parse form: " + err.Error() + " (continuing)")
 			//            http.Error(&gopWriter, "Failed to parse form: " + err.Error(), http.StatusInternalServerError)
 			//          return
 		}
 
-		// Panic handler
-		defer dealWithPanic(gopRequest, showInResponse, showInLog, showAllInBacktrace, panicHTTPMessage)
-
-		err = gopRequest.checkRequiredParams(requiredParams)
-		// Only run handler if required args ok
-		if err == nil {
-			// Pass in the gop, for logging, cfg etc
-			err = h(gopRequest)
-		}
-
+		// Panics, errors, logging and stats are all handled by the core middleware
+		err = chain.handler()(gopRequest)
 		if err != nil {
-			httpErr, ok := err.(HTTPError)
-			if !ok {
-				httpErr = HTTPError{
-					Code: http.StatusInternalServerError,
-					Body: "Internal error: " + err.Error(),
-				}
-			}
-			if gopRequest.W.HasWritten() {
-				// Ah. We have an error we'd like to send. But it's too late.
-				// Bad handler, no biscuit.
-				a.Error("Handler returned http error after writing data [%s] - discarding error", httpErr)
-			} else {
-				httpErr.Write(gopRequest.W)
-			}
+			a.Error("Unhandled error from handler chain: %s", err.Error())
 		}
 	}
 
@@ -669,7 +1031,13 @@ func (a *App) wrapHandlerInternal(h HandlerFunc, websocket bool, requiredParams
 
 func (a *App) HTTPHandler(u string, h http.Handler) {
 	f := func(g *Req) error {
-		h.ServeHTTP(g.W, g.R)
+		r := g.R
+		if ctx := g.Context(); ctx != r.Context() {
+			// Timeouts and values set since the request started
+			r = r.WithContext(ctx)
+			defer gorillacontext.Clear(r)
+		}
+		h.ServeHTTP(g.W, r)
 		return nil
 	}
 	a.HandleFunc(u, f)
@@ -715,9 +1083,15 @@ func (a *App) Run() {
 
 	go a.watchdog()
 
+	go a.runtimeCollector()
+
 	go a.requestMaker()
 
-	listenAddr, _ := a.Cfg.Get("gop", "listen_addr", ":http")
+	defaultAddr := ":http"
+	if a.initTLS() {
+		defaultAddr = ":https"
+	}
+	listenAddr, _ := a.Cfg.Get("gop", "listen_addr", defaultAddr)
 	listenNet, _ := a.Cfg.Get("gop", "listen_net", "tcp")
 	gracefulRestart, _ := a.Cfg.GetBool("gop", "graceful_restart", true)
 	if gracefulRestart {
@@ -727,12 +1101,29 @@ func (a *App) Run() {
 		if err != nil {
 			a.Fatalf("Can't listen on [%s:%s]: %s", listenNet, listenAddr, err.Error())
 		}
-		a.Serve(listener)
+		a.startSecondaryListeners(nil)
+		a.serveMain(listener)
 	}
 }
 
 func (a *App) Serve(l net.Listener) {
-	http.Serve(l, a.GorillaRouter)
+	a.newHTTPServer(a.GorillaRouter).Serve(l)
+}
+
+// Serve the main listener, over TLS and behind the PROXY protocol if
+// configured. l stays a plain listener, so it can be handed on in a
+// graceful restart.
+func (a *App) serveMain(l net.Listener) {
+	if proxyProtocol, _ := a.Cfg.GetBool("gop", "proxy_protocol", false); proxyProtocol {
+		l = a.proxyProtocolListener(l)
+	}
+	a.tlsMu.Lock()
+	useTLS := a.tlsConfig != nil
+	a.tlsMu.Unlock()
+	if useTLS {
+		l = a.tlsListener(l)
+	}
+	a.Serve(l)
 }
 
 func getMemInfo() (int64, int64) {
@@ -749,7 +1140,7 @@ func (a *App) HandleWebSocketFunc(u string, h HandlerFunc, requiredParams ...str
 }
 
 func (a *App) WrapWebSocketHandler(h HandlerFunc, requiredParams ...string) http.HandlerFunc {
-	return a.wrapHandlerInternal(h, true, requiredParams...)
+	return a.wrapHandlerInternal(h, true, nil, requiredParams...)
 }
 
 func (g *Req) WebSocketWriteText(buf []byte) error {
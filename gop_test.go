@@ -0,0 +1,60 @@
+package gop
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// An app serving its routes from a test server. Config can be set with
+// a.Cfg.TransientOverride before the first request.
+func newTestApp(t *testing.T, appName string) (*App, *httptest.Server) {
+	a := InitCmd("gop_test", appName)
+	go a.requestMaker()
+	srv := httptest.NewServer(a.GorillaRouter)
+	t.Cleanup(srv.Close)
+	return a, srv
+}
+
+func TestPathInt(t *testing.T) {
+	a, srv := newTestApp(t, "pathint")
+	a.HandleFunc("/int/{id}", func(g *Req) error {
+		id, err := g.PathInt("id")
+		if err != nil {
+			return err
+		}
+		return g.SendText([]byte(fmt.Sprint(id)))
+	})
+	a.HandleFunc("/int64/{id}", func(g *Req) error {
+		id, err := g.PathInt64("id")
+		if err != nil {
+			return err
+		}
+		return g.SendText([]byte(fmt.Sprint(id)))
+	})
+	a.HandleFunc("/typo/{id}", func(g *Req) error {
+		_, err := g.PathInt("ID")
+		return err
+	})
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/int/42", http.StatusOK, "42"},
+		{"/int/-1", http.StatusOK, "-1"},
+		{"/int/bob", http.StatusNotFound, ""},
+		{"/int64/9007199254740993", http.StatusOK, "9007199254740993"},
+		{"/int64/99999999999999999999", http.StatusNotFound, ""},
+		// Asking for a variable the route lacks is our bug, not a missing page
+		{"/typo/42", http.StatusInternalServerError, ""},
+	}
+	for _, test := range tests {
+		code, body := getBody(t, srv.URL+test.path)
+		if code != test.code || (test.body != "" && body != test.body) {
+			t.Errorf("%s: got %d %q, want %d %q", test.path, code, body, test.code, test.body)
+		}
+	}
+}
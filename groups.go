@@ -0,0 +1,100 @@
+package gop
+
+import "time"
+
+// How a group's routes are authenticated
+type AuthPolicy int
+
+const (
+	AuthDefault  AuthPolicy = iota // As for the rest of the app (see auth_required)
+	AuthRequired                   // Anonymous requests are refused
+	AuthOptional                   // Anonymous requests are let through, even with auth_required
+	AuthAdmin                      // Only the admin authenticators are accepted, as for gop's URLs
+)
+
+// Settings for a route group. Zero values inherit from the enclosing
+// group, or the app.
+type GroupOptions struct {
+	Middleware     []Middleware
+	RequiredParams []string // Required on every route, on top of each route's own
+	Auth           AuthPolicy
+	Authenticators []Authenticator // In place of the app's (or the enclosing group's)
+	Timeout        time.Duration   // In place of request_timeout. Negative for none.
+	StatsPrefix    string          // Count status codes and time requests under this prefix too
+}
+
+// Create a group of routes under prefix, handled like the app's other
+// routes but with their own middleware, required params, auth, timeout
+// and stats.
+//
+//	api := app.Group("/api/v1", gop.GroupOptions{
+//		Auth:        gop.AuthRequired,
+//		Timeout:     5 * time.Second,
+//		StatsPrefix: "api.v1",
+//	})
+//	api.HandleFunc("/users/{id}", handleUser)
+func (a *App) Group(prefix string, opts GroupOptions) *Router {
+	r := a.Subrouter(prefix)
+	r.Use(opts.Middleware...)
+	r.opts = opts
+	return r
+}
+
+// Create a group within this one. Middleware and required params add to
+// ours, and stats prefixes are appended to ours.
+func (r *Router) Group(prefix string, opts GroupOptions) *Router {
+	g := &Router{
+		app:    r.app,
+		mux:    r.mux.PathPrefix(prefix).Subrouter(),
+		parent: r,
+		opts:   opts,
+	}
+	g.Use(opts.Middleware...)
+	return g
+}
+
+// A group's settings, resolved against those of the groups enclosing it
+// as each route is registered, so requests needn't walk up the groups
+type groupSettings struct {
+	routers        []*Router // This group and those enclosing it, outermost first
+	auth           AuthPolicy
+	authenticators []Authenticator
+	timeout        time.Duration
+	statsPrefix    string
+}
+
+// Resolve our settings. The options are fixed when a group is created,
+// but middleware can still be added, so the Routers are kept for that.
+func (r *Router) settings() *groupSettings {
+	s := &groupSettings{}
+	for p := r; p != nil; p = p.parent {
+		s.routers = append([]*Router{p}, s.routers...)
+		if s.auth == AuthDefault {
+			s.auth = p.opts.Auth
+		}
+		if s.authenticators == nil {
+			s.authenticators = p.opts.Authenticators
+		}
+		if s.timeout == 0 {
+			s.timeout = p.opts.Timeout
+		}
+		if p.opts.StatsPrefix == "" {
+			continue
+		}
+		if s.statsPrefix == "" {
+			s.statsPrefix = p.opts.StatsPrefix
+		} else {
+			s.statsPrefix = p.opts.StatsPrefix + "." + s.statsPrefix
+		}
+	}
+	return s
+}
+
+// The required params of this group and those enclosing it
+func (r *Router) requiredParams() []string {
+	var params []string
+	for p := r; p != nil; p = p.parent {
+		params = append(append([]string(nil), p.opts.RequiredParams...), params...)
+	}
+	return params
+}
@@ -0,0 +1,198 @@
+package gop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cactus/go-statsd-client/statsd"
+	"github.com/cactus/go-statsd-client/statsd/statsdtest"
+)
+
+// Accepts requests whose X-User header is its name
+type headerAuthenticator string
+
+func (h headerAuthenticator) Authenticate(g *Req) (*User, error) {
+	if g.R.Header.Get("X-User") != string(h) {
+		return nil, nil
+	}
+	return &User{Name: string(h), Method: "header"}, nil
+}
+
+func (h headerAuthenticator) Challenge() string {
+	return `Header realm="` + string(h) + `"`
+}
+
+func TestGroupSettings(t *testing.T) {
+	a := InitCmd("gop_test", "groups")
+	api := a.Group("/api", GroupOptions{
+		RequiredParams: []string{"key"},
+		Auth:           AuthRequired,
+		Authenticators: []Authenticator{headerAuthenticator("api")},
+		Timeout:        5 * time.Second,
+		StatsPrefix:    "api",
+	})
+	v1 := api.Group("/v1", GroupOptions{
+		RequiredParams: []string{"version"},
+		Timeout:        -1,
+		StatsPrefix:    "v1",
+	})
+	public := v1.Group("/public", GroupOptions{
+		Auth:           AuthOptional,
+		Authenticators: []Authenticator{headerAuthenticator("public")},
+	})
+
+	tests := []struct {
+		name           string
+		r              *Router
+		auth           AuthPolicy
+		authenticators string
+		timeout        time.Duration
+		statsPrefix    string
+		requiredParams string
+		routers        int
+	}{
+		{"subrouter", a.Subrouter("/sub"), AuthDefault, "", 0, "", "", 1},
+		{"group", api, AuthRequired, "api", 5 * time.Second, "api", "key", 1},
+		// Unset options are inherited, the rest add to the enclosing group's
+		{"nested", v1, AuthRequired, "api", -1, "api.v1", "key version", 2},
+		{"overridden", public, AuthOptional, "public", -1, "api.v1", "key version", 3},
+	}
+	for _, test := range tests {
+		s := test.r.settings()
+		var auths []string
+		for _, auth := range s.authenticators {
+			auths = append(auths, string(auth.(headerAuthenticator)))
+		}
+		if s.auth != test.auth || strings.Join(auths, " ") != test.authenticators || s.timeout != test.timeout ||
+			s.statsPrefix != test.statsPrefix || len(s.routers) != test.routers {
+			t.Errorf("%s: got %+v", test.name, *s)
+		}
+		if s.routers[len(s.routers)-1] != test.r {
+			t.Errorf("%s: own Router isn't innermost", test.name)
+		}
+		if got := strings.Join(test.r.requiredParams(), " "); got != test.requiredParams {
+			t.Errorf("%s: required params %q, want %q", test.name, got, test.requiredParams)
+		}
+	}
+}
+
+func TestGroupRoutes(t *testing.T) {
+	a, srv := newTestApp(t, "groups")
+	sender := statsdtest.NewRecordingSender()
+	a.Stats.client, _ = statsd.NewClientWithSender(sender, "test")
+	a.SetAuthenticators(headerAuthenticator("user"))
+	a.SetAdminAuthenticators(headerAuthenticator("admin"))
+	var mu sync.Mutex
+	var calls []string
+	mw := func(name string) Middleware { return recordingMiddleware(name, &mu, &calls) }
+	handler := func(g *Req) error {
+		return g.SendText([]byte("ok"))
+	}
+
+	a.Use(mw("app"))
+	api := a.Group("/api", GroupOptions{
+		Middleware:     []Middleware{mw("api")},
+		RequiredParams: []string{"key"},
+		Auth:           AuthRequired,
+		StatsPrefix:    "api",
+	})
+	api.HandleFunc("/x", handler)
+	v1 := api.Group("/v1", GroupOptions{
+		Middleware:  []Middleware{mw("v1")},
+		StatsPrefix: "v1",
+	})
+	v1.HandleFunc("/x", Chain(handler, mw("route")), "id")
+	v1.Group("/public", GroupOptions{Auth: AuthOptional}).HandleFunc("/x", handler)
+	a.Group("/admin", GroupOptions{Auth: AuthAdmin}).HandleFunc("/x", handler)
+	// Middleware added to an enclosing group reaches routes already registered
+	api.Use(mw("late"))
+
+	tests := []struct {
+		path  string
+		user  string
+		code  int
+		calls string
+		stat  string
+	}{
+		{"/api/x?key=1", "user", http.StatusOK, "app api late /late /api /app", "test.api.http_status.200"},
+		{"/api/v1/x?key=1&id=2", "user", http.StatusOK, "app api late v1 route /route /v1 /late /api /app",
+			"test.api.v1.http_status.200"},
+		// Required params are the enclosing group's as well as our own
+		{"/api/v1/x?id=2", "user", http.StatusBadRequest, "app api late v1 /v1 /late /api /app",
+			"test.api.v1.http_status.400"},
+		{"/api/v1/x?key=1", "user", http.StatusBadRequest, "app api late v1 /v1 /late /api /app", ""},
+		// Auth is checked before any app or group middleware runs
+		{"/api/x?key=1", "", http.StatusUnauthorized, "", "test.api.http_status.401"},
+		{"/api/v1/x?key=1&id=2", "", http.StatusUnauthorized, "", ""},
+		{"/api/v1/public/x?key=1", "", http.StatusOK, "app api late v1 /v1 /late /api /app", "test.api.v1.http_status.200"},
+		{"/admin/x", "user", http.StatusUnauthorized, "", ""},
+		{"/admin/x", "admin", http.StatusOK, "app /app", ""},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		calls = nil
+		mu.Unlock()
+		sender.ClearSent()
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		if test.user != "" {
+			req.Header.Set("X-User", test.user)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s as %q: got %d, want %d", test.path, test.user, resp.StatusCode, test.code)
+		}
+		mu.Lock()
+		got := strings.Join(calls, " ")
+		mu.Unlock()
+		if got != test.calls {
+			t.Errorf("%s as %q: got calls %q, want %q", test.path, test.user, got, test.calls)
+		}
+		if test.stat == "" {
+			continue
+		}
+		found := false
+		for _, stat := range sender.GetSent() {
+			found = found || stat.Stat == test.stat
+		}
+		if !found {
+			t.Errorf("%s as %q: no %s in %v", test.path, test.user, test.stat, sender.GetSent())
+		}
+	}
+}
+
+func TestGroupTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		global       string
+		groupTimeout time.Duration
+		noGroup      bool
+		want         time.Duration
+	}{
+		{"no group", "30s", 0, true, 30 * time.Second},
+		{"unset", "30s", 0, false, 30 * time.Second},
+		{"set", "30s", 5 * time.Second, false, 5 * time.Second},
+		{"set without global", "", 5 * time.Second, false, 5 * time.Second},
+		{"none", "30s", -1, false, -1},
+	}
+	for _, test := range tests {
+		a := InitCmd("gop_test", "groups")
+		if test.global != "" {
+			a.Cfg.TransientOverride("gop", "request_timeout", test.global)
+		}
+		g := &Req{common: a.common, app: a, R: httptest.NewRequest("GET", "/x", nil)}
+		if !test.noGroup {
+			g.group = a.Group("/", GroupOptions{Timeout: test.groupTimeout}).settings()
+		}
+		if got := g.configuredTimeout(); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -7,9 +7,9 @@ import (
 	"os"
 	"runtime"
 	"runtime/debug"
+	"strings"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 )
 
@@ -20,8 +20,8 @@ func gopHandler(g *Req) error {
 	if !enabled {
 		return NotFound("Not enabled")
 	}
-	vars := mux.Vars(g.R)
-	switch vars["action"] {
+	action, _ := g.PathParam("action")
+	switch action {
 	case "status":
 		{
 			return handleStatus(g)
@@ -51,9 +51,8 @@ func gopHandler(g *Req) error {
 
 func handleConfig(g *Req) error {
 	// We can be called with and without section+key
-	vars := mux.Vars(g.R)
-	section := vars["section"]
-	key := vars["key"]
+	section, _ := g.PathParam("section")
+	key, _ := g.PathParam("key")
 	if g.R.Method == "PUT" {
 		if section == "" {
 			return BadRequest("No section in url")
@@ -148,6 +147,62 @@ func handleStack(g *Req) error {
 	return nil
 }
 
+type statusLimits struct {
+	SysMemBytesLimit   int64
+	SysMemBytes        int64
+	AllocMemBytesLimit int64
+	AllocMemBytes      int64
+	NumFDsLimit        int64
+	NumFDs             int64
+	NumGorosLimit      int64
+	NumGoros           int64
+	RestartAfterSecs   float32
+	MaxRequests        int
+}
+
+type statusBuildInfo struct {
+	Path     string
+	Version  string
+	Sum      string
+	Settings map[string]string
+}
+
+func getStatusLimits(cfg Config) statusLimits {
+	sysMemBytes, allocMemBytes := getMemInfo()
+	// Zero on error, which is good enough for display
+	numFDs, _ := fdsInUse()
+	limits := statusLimits{
+		SysMemBytes:   sysMemBytes,
+		AllocMemBytes: allocMemBytes,
+		NumFDs:        numFDs,
+		NumGoros:      int64(runtime.NumGoroutine()),
+	}
+	limits.SysMemBytesLimit, _ = cfg.GetInt64("gop", "sysmem_bytes_limit", 0)
+	limits.AllocMemBytesLimit, _ = cfg.GetInt64("gop", "allocmem_bytes_limit", 0)
+	limits.NumFDsLimit, _ = cfg.GetInt64("gop", "numfds_limit", 0)
+	limits.NumGorosLimit, _ = cfg.GetInt64("gop", "numgoros_limit", 0)
+	limits.RestartAfterSecs, _ = cfg.GetFloat32("gop", "restart_after_secs", 0)
+	limits.MaxRequests, _ = cfg.GetInt("gop", "max_requests", 0)
+	return limits
+}
+
+func getStatusBuildInfo() *statusBuildInfo {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+	info := statusBuildInfo{
+		Path:     bi.Path,
+		Version:  bi.Main.Version,
+		Sum:      bi.Main.Sum,
+		Settings: make(map[string]string),
+	}
+	for _, setting := range bi.Settings {
+		info.Settings[setting.Key] = setting.Value
+	}
+	return &info
+}
+
 func handleStatus(g *Req) error {
 	type requestInfo struct {
 		Id       int
@@ -157,24 +212,63 @@ func handleStatus(g *Req) error {
 		RemoteIP string
 		IsHTTPS  bool
 	}
+	type configInfo struct {
+		Profile      string
+		File         string
+		OverrideFile string
+	}
 	type requestStatus struct {
-		ProjectName   string
-		AppName       string
-		Pid           int
-		StartTime     time.Time
-		UptimeSeconds float64
-		NumGoros      int
-		RequestInfo   []requestInfo
+		ProjectName    string
+		AppName        string
+		Pid            int
+		StartTime      time.Time
+		UptimeSeconds  float64
+		NumGoros       int
+		GoVersion      string
+		Build          *statusBuildInfo
+		Config         configInfo
+		Limits         statusLimits
+		TotalReqs      int
+		CurrentReqs    int
+		CurrentWSReqs  int
+		TotalSlowReqs  int
+		StatusCounts   map[int]int
+		SlowRequests   []slowReqInfo
+		RestartHistory []restartEvent
+		TLS            *tlsStatus `json:",omitempty"`
+		Listeners      []listenerStatus
+		RateLimiters   []rateLimiterStatus
+		Concurrency    []concurrencyLimiterStatus
+		RequestInfo    []requestInfo
 	}
 	appStats := g.app.GetStats()
 	appDuration := time.Since(appStats.startTime).Seconds()
 	status := requestStatus{
-		ProjectName:   g.app.ProjectName,
-		AppName:       g.app.AppName,
-		Pid:           os.Getpid(),
-		StartTime:     appStats.startTime,
-		UptimeSeconds: appDuration,
-		NumGoros:      runtime.NumGoroutine(),
+		ProjectName:    g.app.ProjectName,
+		AppName:        g.app.AppName,
+		Pid:            os.Getpid(),
+		StartTime:      appStats.startTime,
+		UptimeSeconds:  appDuration,
+		NumGoros:       runtime.NumGoroutine(),
+		GoVersion:      runtime.Version(),
+		Build:          getStatusBuildInfo(),
+		Limits:         getStatusLimits(g.Cfg),
+		TotalReqs:      appStats.totalReqs,
+		CurrentReqs:    appStats.currentReqs,
+		CurrentWSReqs:  appStats.currentWSReqs,
+		TotalSlowReqs:  appStats.totalSlowReqs,
+		StatusCounts:   appStats.statusCounts,
+		SlowRequests:   appStats.slowReqs,
+		RestartHistory: g.app.getRestartHistory(),
+		TLS:            g.app.getTLSStatus(),
+		Listeners:      g.app.getListenerStatus(),
+		RateLimiters:   g.app.getRateLimiterStatus(),
+		Concurrency:    g.app.getConcurrencyStatus(),
+	}
+	status.Config.Profile, _ = g.Cfg.Get("gop", "config_profile", "")
+	if g.Cfg.overrideFname != "" {
+		status.Config.OverrideFile = g.Cfg.overrideFname
+		status.Config.File = strings.TrimSuffix(g.Cfg.overrideFname, ".override")
 	}
 	reqChan := make(chan *Req)
 	g.app.getReqs <- reqChan
@@ -190,14 +284,10 @@ func handleStatus(g *Req) error {
 		}
 		status.RequestInfo = append(status.RequestInfo, info)
 	}
+	if strings.Contains(g.R.Header.Get("Accept"), "text/html") {
+		return g.renderTemplate(statusTemplate, status)
+	}
 	return g.SendJson("status", status)
-	/*
-	   fmt.Fprintf(w, "%s - %s PID %d up for %.3fs (%s)\n\n", g.app.ProjectName, g.app.AppName, os.Getpid(), appDuration, g.app.startTime)
-	   for req := range reqChan {
-	       reqDuration := time.Since(req.startTime).Seconds()
-	       fmt.Fprintf(w, "%d: %.3f\t%s\t%s\n", req.id, reqDuration, req.r.Method, req.r.URL.String())
-	   }
-	*/
 }
 
 func handleTest(g *Req) error {
@@ -222,36 +312,61 @@ func handleTest(g *Req) error {
 }
 
 func (a *App) registerGopHandlers() {
-	a.HandleFunc("/gop/{action}", gopHandler)
-	a.HandleFunc("/gop/config/{section}", handleConfig)
-	a.HandleFunc("/gop/config/{section}/{key}", handleConfig)
+	// Load balancers need the health checks, so only they are unprotected
+	// (and they stay on the main listener)
+	admin := a.AdminAuth()
+	r := a.adminRouter()
+	r.handleGopFunc("/gop/{action}", Chain(gopHandler, admin))
+	r.handleGopFunc("/gop/config/{section}", Chain(handleConfig, admin))
+	r.handleGopFunc("/gop/config/{section}/{key}", Chain(handleConfig, admin))
+	mainRouter := &Router{app: a, mux: a.GorillaRouter}
+	mainRouter.handleGopFunc("/gop/health/{probe}", handleHealth)
+	if r.mux != a.GorillaRouter {
+		r.handleGopFunc("/gop/health/{probe}", handleHealth)
+	}
 
 	a.maybeRegisterPProfHandlers()
 	a.Cfg.AddOnChangeCallback(func(cfg *Config) { a.maybeRegisterPProfHandlers() })
 }
 
+// Where to register the admin URLs: the admin_listener's Router if there
+// is one, otherwise the main routes
+func (a *App) adminRouter() *Router {
+	if name := a.adminListenerName(); name != "" {
+		return a.ListenerRouter(name)
+	}
+	return &Router{app: a, mux: a.GorillaRouter}
+}
+
+// Register one of gop's own handlers, which do their own auth
+func (r *Router) handleGopFunc(u string, h HandlerFunc) {
+	r.mux.Handle(u, gopRoute(r.app.wrapHandlerInternal(h, false, r.settings())))
+}
+
 func (a *App) maybeRegisterPProfHandlers() {
 	if enableProfiling, _ := a.Cfg.GetBool("gop", "enable_profiling_urls", false); enableProfiling {
-		a.HandleFunc("/debug/pprof/cmdline", func(g *Req) error {
+		admin := a.AdminAuth()
+		r := a.adminRouter()
+		r.handleGopFunc("/debug/pprof/cmdline", Chain(func(g *Req) error {
 			pprof.Cmdline(g.W, g.R)
 			return nil
-		})
+		}, admin))
 
-		a.HandleFunc("/debug/pprof/symbol", func(g *Req) error {
+		r.handleGopFunc("/debug/pprof/symbol", Chain(func(g *Req) error {
 			pprof.Symbol(g.W, g.R)
 			return nil
-		})
+		}, admin))
 
-		a.HandleFunc("/debug/pprof/profile", func(g *Req) error {
+		r.handleGopFunc("/debug/pprof/profile", Chain(func(g *Req) error {
 			pprof.Profile(g.W, g.R)
 			return nil
-		})
+		}, admin))
 
-		a.HandleFunc("/debug/pprof/{profile_name}", func(g *Req) error {
-			vars := mux.Vars(g.R)
-			h := pprof.Handler(vars["profile_name"])
+		r.handleGopFunc("/debug/pprof/{profile_name}", Chain(func(g *Req) error {
+			profileName, _ := g.PathParam("profile_name")
+			h := pprof.Handler(profileName)
 			h.ServeHTTP(g.W, g.R)
 			return nil
-		})
+		}, admin))
 	}
 }
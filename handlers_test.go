@@ -0,0 +1,133 @@
+package gop
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// An app with /gop/status open to the test client
+func newStatusTestApp(t *testing.T, overrides ...string) (*App, string) {
+	// recordRestartReason hands the history on in our environment
+	t.Setenv(restartHistoryEnvName, "")
+	a, srv := newTestApp(t, "status")
+	a.Cfg.TransientOverride("gop", "enable_gop_urls", "true")
+	a.Cfg.TransientOverride("gop", "admin_auth_allow_ips", "127.0.0.1")
+	for i := 0; i+1 < len(overrides); i += 2 {
+		a.Cfg.TransientOverride("gop", overrides[i], overrides[i+1])
+	}
+	a.registerGopHandlers()
+	a.HandleFunc("/hello", func(g *Req) error {
+		g.SendText([]byte("hello"))
+		return nil
+	})
+	return a, srv.URL
+}
+
+func getStatus(t *testing.T, url, accept string) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", url+"/gop/status", nil)
+	req.Header.Set("Accept", accept)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /gop/status: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /gop/status: got %d: %s", resp.StatusCode, body)
+	}
+	return resp, string(body)
+}
+
+func TestStatusJSON(t *testing.T) {
+	// Every request is slow, but none are kept
+	a, url := newStatusTestApp(t, "slow_req_secs", "0", "status_slow_history", "-1")
+	a.recordRestartReason("Testing")
+	resp, err := http.Get(url + "/hello")
+	if err != nil {
+		t.Fatalf("GET /hello: %s", err)
+	}
+	resp.Body.Close()
+
+	resp, body := getStatus(t, url, "application/json")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type %q, want JSON", ct)
+	}
+	var status struct {
+		ProjectName    string
+		AppName        string
+		Pid            int
+		TotalReqs      int
+		TotalSlowReqs  int
+		SlowRequests   []slowReqInfo
+		RestartHistory []restartEvent
+	}
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("Bad status JSON: %s", err)
+	}
+	if status.ProjectName != "gop_test" || status.AppName != "status" || status.Pid != os.Getpid() {
+		t.Errorf("Unexpected app details in %s", body)
+	}
+	if status.TotalReqs < 1 || status.TotalSlowReqs < 1 {
+		t.Errorf("Got %d requests, %d slow, want at least 1 of each", status.TotalReqs, status.TotalSlowReqs)
+	}
+	if len(status.SlowRequests) != 0 {
+		t.Errorf("Got %d slow requests with status_slow_history -1, want none", len(status.SlowRequests))
+	}
+	if len(status.RestartHistory) != 1 || status.RestartHistory[0].Reason != "Testing" {
+		t.Errorf("RestartHistory = %+v", status.RestartHistory)
+	}
+}
+
+func TestStatusHTML(t *testing.T) {
+	a, url := newStatusTestApp(t)
+	a.recordRestartReason("<script>")
+
+	resp, body := getStatus(t, url, "text/html")
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type %q, want HTML", ct)
+	}
+	for _, want := range []string{"<h1>gop_test - status</h1>", "<h2>Recent graceful restarts</h2>", "&lt;script&gt;"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Status page doesn't contain %q", want)
+		}
+	}
+	if strings.Contains(body, "<script>") {
+		t.Errorf("Restart reason wasn't escaped")
+	}
+}
+
+func TestRestartHistory(t *testing.T) {
+	t.Setenv(restartHistoryEnvName, "")
+	a := InitCmd("gop_test", "restart")
+	a.Cfg.TransientOverride("gop", "status_restart_history", "2")
+	for _, reason := range []string{"one", "two", "three"} {
+		a.recordRestartReason(reason)
+	}
+	history := a.getRestartHistory()
+	if len(history) != 2 || history[0].Reason != "two" || history[1].Reason != "three" {
+		t.Errorf("History = %+v, want the last two", history)
+	}
+
+	// Our graceful child picks it up from the environment
+	child := InitCmd("gop_test", "restart")
+	history = child.getRestartHistory()
+	if len(history) != 2 || history[1].Reason != "three" || history[1].Pid != os.Getpid() {
+		t.Errorf("Child history = %+v", history)
+	}
+
+	// A garbled history is ignored
+	os.Setenv(restartHistoryEnvName, "[not json")
+	if history := InitCmd("gop_test", "restart").getRestartHistory(); len(history) != 0 {
+		t.Errorf("History from garbled env = %+v", history)
+	}
+
+	a.Cfg.TransientOverride("gop", "status_restart_history", "-1")
+	a.recordRestartReason("four")
+	if history := a.getRestartHistory(); len(history) != 0 {
+		t.Errorf("History with status_restart_history -1 = %+v, want none", history)
+	}
+}
@@ -0,0 +1,166 @@
+package gop
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Options for a health check. Zero values take defaults from config.
+type HealthCheckOpts struct {
+	// A failing critical check fails readiness. Non-critical failures are
+	// reported but the app stays ready.
+	Critical bool
+	// Reuse the last result for this long rather than re-running the check
+	CacheFor time.Duration
+	// Treat the check as failed if it takes longer than this
+	Timeout time.Duration
+}
+
+type healthCheck struct {
+	name string
+	f    func() error
+	opts HealthCheckOpts
+
+	mu        sync.Mutex
+	lastErr   error
+	checkedAt time.Time
+	duration  time.Duration
+}
+
+type healthCheckResult struct {
+	Ok           bool
+	Critical     bool
+	Error        string `json:",omitempty"`
+	CheckedAt    time.Time
+	DurationSecs float64
+}
+
+type healthStatus struct {
+	Status string
+	Checks map[string]healthCheckResult `json:",omitempty"`
+}
+
+// Register a check to be run by the /gop/health/ready endpoint. f should
+// return nil if healthy.
+func (a *App) RegisterHealthCheck(name string, f func() error, opts HealthCheckOpts) {
+	if opts.Timeout == 0 {
+		opts.Timeout, _ = a.Cfg.GetDuration("gop", "health_check_timeout", 5*time.Second)
+	}
+	if opts.CacheFor == 0 {
+		opts.CacheFor, _ = a.Cfg.GetDuration("gop", "health_check_cache", 0)
+	}
+	a.healthChecksMu.Lock()
+	defer a.healthChecksMu.Unlock()
+	if a.healthChecks == nil {
+		a.healthChecks = make(map[string]*healthCheck)
+	}
+	a.healthChecks[name] = &healthCheck{name: name, f: f, opts: opts}
+}
+
+func (hc *healthCheck) run() (time.Time, time.Duration, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if !hc.checkedAt.IsZero() && time.Since(hc.checkedAt) < hc.opts.CacheFor {
+		return hc.checkedAt, hc.duration, hc.lastErr
+	}
+
+	start := time.Now()
+	// Buffered, so a timed-out check can still finish and exit
+	errChan := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errChan <- fmt.Errorf("PANIC: %v", r)
+			}
+		}()
+		errChan <- hc.f()
+	}()
+	var err error
+	select {
+	case err = <-errChan:
+	case <-time.After(hc.opts.Timeout):
+		err = fmt.Errorf("Timed out after %s", hc.opts.Timeout)
+	}
+
+	hc.lastErr = err
+	hc.checkedAt = start
+	hc.duration = time.Since(start)
+	return hc.checkedAt, hc.duration, hc.lastErr
+}
+
+// Run all registered checks concurrently
+func (a *App) runHealthChecks() map[string]healthCheckResult {
+	a.healthChecksMu.Lock()
+	checks := make([]*healthCheck, 0, len(a.healthChecks))
+	for _, hc := range a.healthChecks {
+		checks = append(checks, hc)
+	}
+	a.healthChecksMu.Unlock()
+
+	results := make(map[string]healthCheckResult)
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, hc := range checks {
+		wg.Add(1)
+		go func(hc *healthCheck) {
+			defer wg.Done()
+			checkedAt, duration, err := hc.run()
+			result := healthCheckResult{
+				Ok:           err == nil,
+				Critical:     hc.opts.Critical,
+				CheckedAt:    checkedAt,
+				DurationSecs: duration.Seconds(),
+			}
+			if err != nil {
+				result.Error = err.Error()
+				a.Stats.Inc("health_check_failed."+hc.name, 1)
+			}
+			resultsMu.Lock()
+			results[hc.name] = result
+			resultsMu.Unlock()
+		}(hc)
+	}
+	wg.Wait()
+	return results
+}
+
+func handleHealth(g *Req) error {
+	enabled, _ := g.Cfg.GetBool("gop", "enable_health_urls", true)
+	if !enabled {
+		return NotFound("Not enabled")
+	}
+	probe, _ := g.PathParam("probe")
+	switch probe {
+	case "live":
+		// If we can answer, we're alive
+		return g.SendJson("health", healthStatus{Status: "ok"})
+	case "ready":
+		return handleReady(g)
+	default:
+		return ErrNotFound
+	}
+}
+
+func handleReady(g *Req) error {
+	status := healthStatus{
+		Status: "ok",
+		Checks: g.app.runHealthChecks(),
+	}
+	for _, result := range status.Checks {
+		if result.Critical && !result.Ok {
+			status.Status = "fail"
+		}
+	}
+	// Tell the load balancer to go elsewhere while we drain
+	if g.app.doingGraceful.Load() {
+		status.Status = "draining"
+	}
+
+	if status.Status != "ok" {
+		g.W.Header().Set("Content-Type", "application/json")
+		g.W.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return g.SendJson("health", status)
+}
@@ -0,0 +1,72 @@
+package gop
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestHealthReady(t *testing.T) {
+	failing := func() error { return errors.New("down") }
+	passing := func() error { return nil }
+	tests := []struct {
+		name     string
+		checks   map[string]func() error
+		critical bool
+		draining bool
+		code     int
+		status   string
+	}{
+		{"no checks", nil, false, false, http.StatusOK, "ok"},
+		{"passing", map[string]func() error{"db": passing}, true, false, http.StatusOK, "ok"},
+		{"critical failure", map[string]func() error{"db": passing, "cache": failing}, true, false, http.StatusServiceUnavailable, "fail"},
+		{"non-critical failure", map[string]func() error{"cache": failing}, false, false, http.StatusOK, "ok"},
+		{"draining", map[string]func() error{"db": passing}, true, true, http.StatusServiceUnavailable, "draining"},
+	}
+	for _, test := range tests {
+		a, srv := newTestApp(t, "health")
+		a.registerGopHandlers()
+		for name, f := range test.checks {
+			a.RegisterHealthCheck(name, f, HealthCheckOpts{Critical: test.critical})
+		}
+		a.doingGraceful.Store(test.draining)
+
+		resp, err := http.Get(srv.URL + "/gop/health/ready")
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		var status healthStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: bad JSON: %s", test.name, err)
+		}
+		if resp.StatusCode != test.code || status.Status != test.status {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, resp.StatusCode, status.Status, test.code, test.status)
+		}
+		if len(status.Checks) != len(test.checks) {
+			t.Errorf("%s: got %d check results, want %d", test.name, len(status.Checks), len(test.checks))
+		}
+		for name, result := range status.Checks {
+			if result.Ok != (name != "cache") {
+				t.Errorf("%s: check %s Ok = %v", test.name, name, result.Ok)
+			}
+		}
+	}
+}
+
+func TestHealthLiveWhileDraining(t *testing.T) {
+	a, srv := newTestApp(t, "health")
+	a.registerGopHandlers()
+	a.doingGraceful.Store(true)
+
+	resp, err := http.Get(srv.URL + "/gop/health/live")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,223 @@
+package gop
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A listener other than the main listen_addr one
+type secondaryListener struct {
+	name      string
+	net       string
+	addr      string
+	tls       bool
+	proxy     bool // Connections start with a PROXY protocol header
+	handler   http.Handler
+	l         net.Listener
+	inherited bool
+}
+
+// A listener handed down by our graceful parent
+type inheritedListener struct {
+	addr string // As configured in the parent
+	l    net.Listener
+}
+
+// How long to wait for a graceful parent to release secondary listeners
+const secondaryListenTimeout = 10 * time.Second
+
+// Get a Router for routes served only on the named listener (see the
+// listeners config). Call before Run. Listeners without their own Router
+// serve the app's main routes.
+//
+//	internal := app.ListenerRouter("internal")
+//	internal.HandleFunc("/reindex", handleReindex)
+func (a *App) ListenerRouter(name string) *Router {
+	a.secondaryListenersMu.Lock()
+	defer a.secondaryListenersMu.Unlock()
+	if a.listenerRouters == nil {
+		a.listenerRouters = make(map[string]*mux.Router)
+	}
+	m, ok := a.listenerRouters[name]
+	if !ok {
+		m = mux.NewRouter()
+		a.listenerRouters[name] = m
+	}
+	return &Router{app: a, mux: m}
+}
+
+// The listener which serves the gop admin URLs, or "" for the main one
+func (a *App) adminListenerName() string {
+	name, _ := a.Cfg.Get("gop", "admin_listener", "admin")
+	for _, declared := range a.declaredListeners() {
+		if declared == name {
+			return name
+		}
+	}
+	return ""
+}
+
+func (a *App) declaredListeners() []string {
+	names, _ := a.Cfg.Get("gop", "listeners", "")
+	return splitList(names)
+}
+
+// The secondary listeners wanted by config
+func (a *App) secondaryListenerSpecs() []*secondaryListener {
+	var specs []*secondaryListener
+	for _, name := range a.declaredListeners() {
+		addr, _ := a.Cfg.Get("gop", "listener_"+name+"_addr", "")
+		if addr == "" {
+			a.Error("No listener_%s_addr - not starting listener [%s]", name, name)
+			continue
+		}
+		defaultNet := "tcp"
+		if strings.HasPrefix(addr, "/") {
+			defaultNet = "unix"
+		}
+		listenNet, _ := a.Cfg.Get("gop", "listener_"+name+"_net", defaultNet)
+		useTLS, _ := a.Cfg.GetBool("gop", "listener_"+name+"_tls", false)
+		proxyProtocol, _ := a.Cfg.GetBool("gop", "listener_"+name+"_proxy_protocol", false)
+
+		var handler http.Handler = a.GorillaRouter
+		a.secondaryListenersMu.Lock()
+		if m, ok := a.listenerRouters[name]; ok {
+			handler = m
+		}
+		a.secondaryListenersMu.Unlock()
+		specs = append(specs, &secondaryListener{
+			name:    name,
+			net:     listenNet,
+			addr:    addr,
+			tls:     useTLS,
+			proxy:   proxyProtocol,
+			handler: handler,
+		})
+	}
+	if addr, _ := a.Cfg.Get("gop", "tls_redirect_addr", ""); addr != "" && a.tlsEnabled() {
+		listenNet, _ := a.Cfg.Get("gop", "listen_net", "tcp")
+		specs = append(specs, &secondaryListener{
+			name:    "tls_redirect",
+			net:     listenNet,
+			addr:    addr,
+			handler: http.HandlerFunc(a.redirectToHTTPS),
+		})
+	}
+	return specs
+}
+
+// Start serving the secondary listeners, taking over those our graceful
+// parent handed down. Listeners which need a new socket are opened in
+// the background, as our parent may still hold the address.
+func (a *App) startSecondaryListeners(inherited map[string]inheritedListener) {
+	specs := a.secondaryListenerSpecs()
+	for _, spec := range specs {
+		if spec.tls && !a.tlsEnabled() {
+			a.Fatalf("Listener [%s] wants TLS, but tls_cert_file and tls_key_file aren't set", spec.name)
+		}
+		if il, ok := inherited[spec.name]; ok && il.addr == spec.addr {
+			spec.l = il.l
+			spec.inherited = true
+			delete(inherited, spec.name)
+			a.Info("Took over listener [%s] on %s:%s from graceful parent", spec.name, spec.net, spec.addr)
+			a.addSecondaryListener(spec)
+			go a.serveSecondary(spec)
+			continue
+		}
+		go func(spec *secondaryListener) {
+			spec.l = a.listenSecondary(spec.net, spec.addr)
+			a.Info("Listening on %s:%s for [%s]", spec.net, spec.addr, spec.name)
+			a.addSecondaryListener(spec)
+			a.serveSecondary(spec)
+		}(spec)
+	}
+	// No longer wanted
+	for name, il := range inherited {
+		a.Info("Closing inherited listener [%s] - no longer configured", name)
+		il.l.Close()
+	}
+}
+
+func (a *App) addSecondaryListener(spec *secondaryListener) {
+	a.secondaryListenersMu.Lock()
+	defer a.secondaryListenersMu.Unlock()
+	if a.secondaryListeners == nil {
+		a.secondaryListeners = make(map[string]*secondaryListener)
+	}
+	a.secondaryListeners[spec.name] = spec
+}
+
+func (a *App) serveSecondary(spec *secondaryListener) {
+	l := spec.l
+	if spec.proxy {
+		l = a.proxyProtocolListener(l)
+	}
+	if spec.tls {
+		l = a.tlsListener(l)
+	}
+	a.newHTTPServer(spec.handler).Serve(l)
+}
+
+// Listen on an address other than the main one, retrying in case our
+// graceful parent hasn't yet let go of it
+func (a *App) listenSecondary(listenNet, addr string) net.Listener {
+	if listenNet == "unix" {
+		// Left over from an earlier run. A live socket would have been inherited.
+		os.Remove(addr)
+	}
+	deadline := time.Now().Add(secondaryListenTimeout)
+	for {
+		l, err := net.Listen(listenNet, addr)
+		if err == nil {
+			return l
+		}
+		if time.Now().After(deadline) {
+			a.Fatalf("Can't listen on [%s:%s]: %s", listenNet, addr, err.Error())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (a *App) closeSecondaryListeners() {
+	a.secondaryListenersMu.Lock()
+	defer a.secondaryListenersMu.Unlock()
+	for _, spec := range a.secondaryListeners {
+		if ul, ok := spec.l.(*net.UnixListener); ok {
+			// Our child has its own copy of the socket, so leave the file for it
+			ul.SetUnlinkOnClose(false)
+		}
+		spec.l.Close()
+	}
+	a.secondaryListeners = nil
+}
+
+type listenerStatus struct {
+	Name      string
+	Net       string
+	Addr      string
+	TLS       bool
+	Inherited bool // Handed down by our graceful parent
+}
+
+func (a *App) getListenerStatus() []listenerStatus {
+	a.secondaryListenersMu.Lock()
+	defer a.secondaryListenersMu.Unlock()
+	statuses := make([]listenerStatus, 0, len(a.secondaryListeners))
+	for _, spec := range a.secondaryListeners {
+		statuses = append(statuses, listenerStatus{
+			Name:      spec.name,
+			Net:       spec.net,
+			Addr:      spec.addr,
+			TLS:       spec.tls,
+			Inherited: spec.inherited,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,91 @@
+package gop
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSecondaryListenerSpecs(t *testing.T) {
+	a := InitCmd("gop_test", "listeners")
+	for _, kv := range [][2]string{
+		{"listeners", "internal, admin, missing"},
+		{"listener_internal_addr", "127.0.0.1:8081"},
+		{"listener_internal_proxy_protocol", "true"},
+		{"listener_admin_addr", "/run/app/admin.sock"},
+		{"listener_admin_tls", "true"},
+		{"tls_cert_file", "cert.pem"},
+		{"tls_key_file", "key.pem"},
+		{"tls_redirect_addr", ":80"},
+	} {
+		a.Cfg.TransientOverride("gop", kv[0], kv[1])
+	}
+	adminRouter := a.ListenerRouter("admin")
+
+	specs := a.secondaryListenerSpecs()
+	want := []secondaryListener{
+		{name: "internal", net: "tcp", addr: "127.0.0.1:8081", proxy: true},
+		{name: "admin", net: "unix", addr: "/run/app/admin.sock", tls: true},
+		{name: "tls_redirect", net: "tcp", addr: ":80"},
+	}
+	if len(specs) != len(want) {
+		t.Fatalf("Got %d specs, want %d", len(specs), len(want))
+	}
+	for i, spec := range specs {
+		w := want[i]
+		if spec.name != w.name || spec.net != w.net || spec.addr != w.addr || spec.tls != w.tls || spec.proxy != w.proxy {
+			t.Errorf("Got %+v, want %+v", *spec, w)
+		}
+	}
+	if specs[0].handler != a.GorillaRouter {
+		t.Errorf("Listener without its own Router doesn't serve the main routes")
+	}
+	if specs[1].handler != adminRouter.mux {
+		t.Errorf("Listener with its own Router doesn't serve it")
+	}
+}
+
+func TestAdminRouterPlacement(t *testing.T) {
+	routed := func(m *mux.Router, path string) bool {
+		return m.Match(httptest.NewRequest("GET", path, nil), &mux.RouteMatch{})
+	}
+	tests := []struct {
+		name          string
+		listeners     string
+		adminListener string
+		separate      bool
+	}{
+		{"no listeners", "", "", false},
+		{"admin listener", "admin", "", true},
+		{"named admin listener", "internal", "internal", true},
+		// admin_listener must also be declared
+		{"undeclared admin listener", "internal", "other", false},
+	}
+	for _, test := range tests {
+		a := InitCmd("gop_test", "listeners")
+		a.Cfg.TransientOverride("gop", "listeners", test.listeners)
+		if test.adminListener != "" {
+			a.Cfg.TransientOverride("gop", "admin_listener", test.adminListener)
+		}
+		a.registerGopHandlers()
+
+		main := a.GorillaRouter
+		if got := routed(main, "/gop/status"); got == test.separate {
+			t.Errorf("%s: /gop/status on the main listener = %v", test.name, got)
+		}
+		// Load balancers check health on the main listener
+		if !routed(main, "/gop/health/ready") {
+			t.Errorf("%s: no health check on the main listener", test.name)
+		}
+		if !test.separate {
+			continue
+		}
+		admin := a.ListenerRouter(a.adminListenerName()).mux
+		for _, path := range []string{"/gop/status", "/gop/config/gop", "/gop/health/live"} {
+			if !routed(admin, path) {
+				t.Errorf("%s: %s not on the admin listener", test.name, path)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/jbert/timber"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -115,6 +116,10 @@ func (a *App) WriteAccessLog(req *Req, dur time.Duration) {
 	if a.accessLog == nil {
 		return
 	}
+	// Called from handler goros, so serialise
+	a.accessLogMu.Lock()
+	defer a.accessLogMu.Unlock()
+
 	logEvery, _ := a.Cfg.GetInt("gop", "access_log_every", 0)
 	if logEvery > 0 {
 		a.suppressedAccessLogLines++
@@ -129,13 +134,6 @@ func (a *App) WriteAccessLog(req *Req, dur time.Duration) {
 	/* ---
 	   gaiadev.leedsdev.net 0.022 192.168.111.1 - - [05/Feb/2014:13:39:22 +0000] "GET /bby/sso/login?next_url=https%3A%2F%2Fgaiadev.leedsdev.net%2F HTTP/1.1" 302 0 "-" "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:26.0) Gecko/20100101 Firefox/26.0"
 	   --- */
-	trimPort := func(s string) string {
-		colonOffset := strings.IndexByte(s, ':')
-		if colonOffset >= 0 {
-			s = s[:colonOffset]
-		}
-		return s
-	}
 	quote := func(s string) string {
 		return string(strconv.AppendQuote([]byte{}, s))
 	}
@@ -149,18 +147,26 @@ func (a *App) WriteAccessLog(req *Req, dur time.Duration) {
 	if uaLine == "" {
 		uaLine = "-"
 	}
+	code, size := http.StatusSwitchingProtocols, 0
+	if req.W != nil {
+		code, size = req.W.code, req.W.wireSize
+	}
+	user := "-"
+	if req.user != nil {
+		user = req.user.Name
+	}
 	hostname, _ := os.Hostname()
 	logLine := fmt.Sprintf("%s %.3f %s %s %s %s %s %d %d %s %s\n",
 		hostname,
 		dur.Seconds(),
 		trimPort(req.RealRemoteIP),
 		"-", // Ident <giggle>
-		"-", // user
+		user,
 		//		req.startTime.Format("[02/Jan/2006:15:04:05 -0700]"),
 		req.startTime.Format("["+time.RFC3339+"]"),
 		quote(reqFirstLine),
-		req.W.code,
-		req.W.size,
+		code,
+		size,
 		quote(referrerLine),
 		quote(uaLine))
 	_, err := req.app.accessLog.WriteString(logLine)
@@ -0,0 +1,251 @@
+package gop
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Wraps a handler to add before/after logic. Call next to continue down
+// the chain, or return without calling it to stop here.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Wrap h in the given middleware. The first middleware is the outermost,
+// so runs first.
+func Chain(h HandlerFunc, mw ...Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Add middleware to be run on every gop handler, inside gop's core
+// middleware. Applies to handlers registered before and after the call.
+// Call it before Run: it's safe later, but every handler then has to
+// rebuild its chain.
+func (a *App) Use(mw ...Middleware) {
+	a.middlewareMu.Lock()
+	defer a.middlewareMu.Unlock()
+	a.middleware = append(a.middleware, mw...)
+	a.middlewareGen.Add(1)
+}
+
+// The outermost middleware run on every gop handler. You only need this to
+// reorder, replace or drop gop's own behaviours - see DefaultCoreMiddleware.
+func (a *App) SetCoreMiddleware(mw ...Middleware) {
+	a.middlewareMu.Lock()
+	defer a.middlewareMu.Unlock()
+	a.coreMiddleware = mw
+	a.middlewareGen.Add(1)
+}
+
+// gop's own per-request behaviour, outermost first:
+// access logging, stats, security headers, CORS, rate limiting,
+// concurrency limiting, compression, cache control, panic handling,
+// timeouts, error responses, sessions, CSRF checks, authentication.
+func (a *App) DefaultCoreMiddleware() []Middleware {
+	return []Middleware{
+		a.AccessLogMiddleware(),
+		a.StatsMiddleware(),
+		a.SecurityHeadersMiddleware(),
+		a.CORSMiddleware(),
+		a.RateLimitMiddleware(),
+		a.ConcurrencyLimitMiddleware(),
+		a.CompressionMiddleware(),
+		a.CacheControlMiddleware(),
+		a.PanicMiddleware(),
+		a.TimeoutMiddleware(),
+		a.ErrorMiddleware(),
+		a.SessionMiddleware(),
+		a.CSRFMiddleware(),
+		a.AuthMiddleware(),
+	}
+}
+
+// A handler wrapped in its full chain: core, app-wide, then Router
+// middleware (route middleware is already wrapped into h). The chain is
+// built on first use, and only rebuilt once Use has changed the middleware.
+type middlewareChain struct {
+	app   *App
+	group *groupSettings // nil outside groups
+	h     HandlerFunc
+	built atomic.Pointer[builtChain]
+}
+
+type builtChain struct {
+	gen uint64 // App.middlewareGen when built
+	h   HandlerFunc
+}
+
+func (c *middlewareChain) handler() HandlerFunc {
+	if b := c.built.Load(); b != nil && b.gen == c.app.middlewareGen.Load() {
+		return b.h
+	}
+
+	a := c.app
+	a.middlewareMu.Lock()
+	mw := make([]Middleware, 0, len(a.coreMiddleware)+len(a.middleware))
+	mw = append(mw, a.coreMiddleware...)
+	mw = append(mw, a.middleware...)
+	if c.group != nil {
+		for _, r := range c.group.routers {
+			mw = append(mw, r.middleware...)
+		}
+	}
+	b := &builtChain{gen: a.middlewareGen.Load(), h: Chain(c.h, mw...)}
+	a.middlewareMu.Unlock()
+
+	c.built.Store(b)
+	return b.h
+}
+
+// Write an access log line once the response is complete
+func (a *App) AccessLogMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			err := next(g)
+			a.WriteAccessLog(g, time.Since(g.startTime))
+			return err
+		}
+	}
+}
+
+// Count response codes and log slow requests
+func (a *App) StatsMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			err := next(g)
+
+			// Don't run time-based code for websockets
+			if g.WS != nil {
+				return err
+			}
+
+			codeStatsKey := fmt.Sprintf("http_status.%d", g.W.code)
+			a.Stats.Inc(codeStatsKey, 1)
+
+			reqDuration := time.Since(g.startTime)
+			if g.group != nil && g.group.statsPrefix != "" {
+				prefix := g.group.statsPrefix
+				a.Stats.Inc(prefix+"."+codeStatsKey, 1)
+				a.Stats.TimingDuration(prefix+".duration", reqDuration)
+			}
+			if g.isSlow(reqDuration) {
+				g.Error("Slow request [%s] took %s", g.R.URL, reqDuration)
+			} else {
+				g.Debug("Request took %s", reqDuration)
+			}
+			return err
+		}
+	}
+}
+
+// Recover panics in the handler and send an error response instead
+func (a *App) PanicMiddleware() Middleware {
+	panicHTTPMessage, _ := a.Cfg.Get("gop", "panic_http_message", "")
+	showInLog, _ := a.Cfg.GetBool("gop", "panic_backtrace_to_log", false)
+	showInResponse, _ := a.Cfg.GetBool("gop", "panic_backtrace_in_response", false)
+	showAllInBacktrace, _ := a.Cfg.GetBool("gop", "panic_backtrace_all_goros", true)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			defer dealWithPanic(g, showInResponse, showInLog, showAllInBacktrace, panicHTTPMessage)
+			return next(g)
+		}
+	}
+}
+
+// Turn an error returned by the handler into an HTTP error response
+func (a *App) ErrorMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			err := next(g)
+			if err == nil {
+				return nil
+			}
+
+			httpErr := a.toHTTPError(err)
+			// Client errors aren't failures of the handler (or its span)
+			if httpErr.Code >= 500 {
+				// The real error may not be in the response, so make sure it's seen
+				g.Error("Handler error: %s", err.Error())
+				g.Span.SetError(err)
+			}
+			if g.W == nil {
+				a.Error("Websocket handler returned error [%s]", httpErr)
+			} else if g.W.HasWritten() {
+				// Ah. We have an error we'd like to send. But it's too late.
+				// Bad handler, no biscuit.
+				a.Error("Handler returned http error after writing data [%s] - discarding error", httpErr)
+			} else {
+				httpErr.Write(g.W)
+			}
+			return nil
+		}
+	}
+}
+
+// Respond with 400 unless all the params are present
+func RequireParams(requiredParams ...string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			err := g.checkRequiredParams(requiredParams)
+			if err != nil {
+				return err
+			}
+			return next(g)
+		}
+	}
+}
+
+// A set of gop routes under a common path prefix, sharing middleware
+// and, for groups, the settings in GroupOptions
+type Router struct {
+	app        *App
+	mux        *mux.Router
+	middleware []Middleware
+	parent     *Router // For groups within groups
+	opts       GroupOptions
+}
+
+// Create a Router for routes under prefix
+func (a *App) Subrouter(prefix string) *Router {
+	return &Router{
+		app: a,
+		mux: a.GorillaRouter.PathPrefix(prefix).Subrouter(),
+	}
+}
+
+// Add middleware to be run on every handler in this Router, after the
+// app-wide middleware (and that of any enclosing group). As with App.Use,
+// best called before Run.
+func (r *Router) Use(mw ...Middleware) {
+	r.app.middlewareMu.Lock()
+	defer r.app.middlewareMu.Unlock()
+	r.middleware = append(r.middleware, mw...)
+	r.app.middlewareGen.Add(1)
+}
+
+// Register a handler under the Router's prefix
+func (r *Router) HandleFunc(u string, h HandlerFunc, requiredParams ...string) *mux.Route {
+	// Check params after our middleware, as App.HandleFunc does after app-wide middleware
+	requiredParams = append(r.requiredParams(), requiredParams...)
+	gopHandler := r.app.wrapHandlerInternal(h, false, r.settings(), requiredParams...)
+
+	return r.mux.HandleFunc(u, gopHandler)
+}
+
+func (r *Router) HandleWebSocketFunc(u string, h HandlerFunc, requiredParams ...string) *mux.Route {
+	requiredParams = append(r.requiredParams(), requiredParams...)
+	gopHandler := r.app.wrapHandlerInternal(h, true, r.settings(), requiredParams...)
+
+	return r.mux.HandleFunc(u, gopHandler)
+}
+
+func (r *Router) HandleMap(hm map[string]func(g *Req) error) {
+	for k, v := range hm {
+		r.HandleFunc(k, v)
+	}
+}
@@ -0,0 +1,134 @@
+package gop
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Middleware which records its name on the way in and out
+func recordingMiddleware(name string, mu *sync.Mutex, calls *[]string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			mu.Lock()
+			*calls = append(*calls, name)
+			mu.Unlock()
+			err := next(g)
+			mu.Lock()
+			*calls = append(*calls, "/"+name)
+			mu.Unlock()
+			return err
+		}
+	}
+}
+
+func getBody(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, string(body)
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	a, srv := newTestApp(t, "middleware")
+	var mu sync.Mutex
+	var calls []string
+	mw := func(name string) Middleware { return recordingMiddleware(name, &mu, &calls) }
+
+	a.Use(mw("app1"), mw("app2"))
+	r := a.Subrouter("/sub")
+	r.Use(mw("router"))
+	r.HandleFunc("/x", Chain(func(g *Req) error {
+		mu.Lock()
+		calls = append(calls, "handler")
+		mu.Unlock()
+		return nil
+	}, mw("route")))
+	// Applies to routes registered before it
+	a.Use(mw("app3"))
+
+	getBody(t, srv.URL+"/sub/x")
+	want := "app1 app2 app3 router route handler /route /router /app3 /app2 /app1"
+	if got := strings.Join(calls, " "); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	// And after the chain has been built
+	calls = nil
+	r.Use(mw("late"))
+	getBody(t, srv.URL+"/sub/x")
+	want = "app1 app2 app3 router late route handler /route /late /router /app3 /app2 /app1"
+	if got := strings.Join(calls, " "); got != want {
+		t.Errorf("After Use: got %q, want %q", got, want)
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	a, srv := newTestApp(t, "middleware")
+	var mu sync.Mutex
+	var calls []string
+
+	a.Use(recordingMiddleware("outer", &mu, &calls))
+	a.Use(func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.R.URL.Query().Get("deny") != "" {
+				return HTTPError{Code: http.StatusForbidden, Body: "Denied"}
+			}
+			return next(g)
+		}
+	})
+	a.Use(recordingMiddleware("inner", &mu, &calls))
+	a.HandleFunc("/x", func(g *Req) error {
+		g.SendText([]byte("hello"))
+		return nil
+	})
+
+	code, body := getBody(t, srv.URL+"/x?deny=1")
+	if code != http.StatusForbidden || strings.Contains(body, "hello") {
+		t.Errorf("Got %d %q, want 403 without the handler's output", code, body)
+	}
+	if got := strings.Join(calls, " "); got != "outer /outer" {
+		t.Errorf("Got calls %q, want only the outer middleware", got)
+	}
+
+	calls = nil
+	code, body = getBody(t, srv.URL+"/x")
+	if code != http.StatusOK || body != "hello" {
+		t.Errorf("Got %d %q, want 200 hello", code, body)
+	}
+	if got := strings.Join(calls, " "); got != "outer inner /inner /outer" {
+		t.Errorf("Got calls %q", got)
+	}
+}
+
+func TestMiddlewareUseWhileServing(t *testing.T) {
+	a, srv := newTestApp(t, "middleware")
+	r := a.Subrouter("/sub")
+	r.HandleFunc("/x", func(g *Req) error {
+		g.SendText([]byte("hello"))
+		return nil
+	})
+	noop := func(next HandlerFunc) HandlerFunc { return next }
+
+	// Run with -race: Use mustn't race with requests building their chains
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				getBody(t, srv.URL+"/sub/x")
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		a.Use(noop)
+		r.Use(noop)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,350 @@
+package gop
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal MessagePack encoder, enough for g.Send(). Structs are encoded
+// as maps keyed by their json tag names, honouring "-", omitempty, string
+// and embedded structs, so clients see the same shape as the JSON encoding.
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeMsgpack(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func encodeMsgpack(buf *bytes.Buffer, rv reflect.Value) error {
+	if !rv.IsValid() {
+		buf.WriteByte(0xc0)
+		return nil
+	}
+	if rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if rv.Kind() == reflect.Interface || !rv.Type().Implements(textMarshalerType) {
+			return encodeMsgpack(buf, rv.Elem())
+		}
+	}
+	// As encoding/json does
+	if rv.Type() == timeType {
+		writeMsgpackString(buf, rv.Interface().(time.Time).Format(time.RFC3339Nano))
+		return nil
+	}
+	if rv.Type().Implements(textMarshalerType) {
+		text, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		writeMsgpackString(buf, string(text))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgpackInt(buf, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeMsgpackUint(buf, rv.Uint())
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(rv.Float())))
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(rv.Float()))
+	case reflect.String:
+		writeMsgpackString(buf, rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// Element by element, as the type may be a named byte type
+			b := make([]byte, rv.Len())
+			for i := range b {
+				b[i] = byte(rv.Index(i).Uint())
+			}
+			writeMsgpackLen(buf, len(b), 0, 0xc4, 0xc5, 0xc6)
+			buf.Write(b)
+			return nil
+		}
+		writeMsgpackLen(buf, rv.Len(), 0x90, 0, 0xdc, 0xdd)
+		for i := 0; i < rv.Len(); i++ {
+			err := encodeMsgpack(buf, rv.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if rv.IsNil() {
+			buf.WriteByte(0xc0)
+			return nil
+		}
+		// Sorted, for a stable encoding
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		writeMsgpackLen(buf, len(keys), 0x80, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			err := encodeMsgpack(buf, k)
+			if err != nil {
+				return err
+			}
+			err = encodeMsgpack(buf, rv.MapIndex(k))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return encodeMsgpackStruct(buf, rv)
+	default:
+		return fmt.Errorf("msgpack: can't encode %s", rv.Type())
+	}
+	return nil
+}
+
+func encodeMsgpackStruct(buf *bytes.Buffer, rv reflect.Value) error {
+	type field struct {
+		msgpackField
+		value reflect.Value
+	}
+	var fields []field
+	for _, f := range msgpackFields(rv.Type()) {
+		fv, ok := msgpackFieldValue(rv, f.index)
+		if !ok || (f.omitEmpty && fv.IsZero()) {
+			continue
+		}
+		fields = append(fields, field{f, fv})
+	}
+	writeMsgpackLen(buf, len(fields), 0x80, 0, 0xde, 0xdf)
+	for _, f := range fields {
+		writeMsgpackString(buf, f.name)
+		if f.quoted && !(f.value.Kind() == reflect.Ptr && f.value.IsNil()) {
+			// As encoding/json's string option: the JSON encoding, as a string
+			text, err := json.Marshal(f.value.Interface())
+			if err != nil {
+				return err
+			}
+			writeMsgpackString(buf, string(text))
+			continue
+		}
+		err := encodeMsgpack(buf, f.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A struct field to encode, found as encoding/json would
+type msgpackField struct {
+	name      string
+	index     []int // For promoted fields, the path through embedded structs
+	tagged    bool
+	omitEmpty bool
+	quoted    bool
+}
+
+// Field layouts are fixed per type, so each is worked out once
+var msgpackFieldsCache sync.Map // reflect.Type -> []msgpackField
+
+func msgpackFields(t reflect.Type) []msgpackField {
+	if fields, ok := msgpackFieldsCache.Load(t); ok {
+		return fields.([]msgpackField)
+	}
+	var all []msgpackField
+	collectMsgpackFields(t, nil, map[reflect.Type]bool{}, &all)
+
+	// Where names clash, the shallowest field wins, then a tagged one. If
+	// that doesn't settle it, none is encoded.
+	byName := make(map[string][]msgpackField)
+	for _, f := range all {
+		byName[f.name] = append(byName[f.name], f)
+	}
+	var fields []msgpackField
+	for _, f := range all {
+		if dominant, ok := dominantMsgpackField(byName[f.name]); ok && reflect.DeepEqual(dominant.index, f.index) {
+			fields = append(fields, f)
+		}
+	}
+	msgpackFieldsCache.Store(t, fields)
+	return fields
+}
+
+func collectMsgpackFields(t reflect.Type, index []int, visiting map[reflect.Type]bool, fields *[]msgpackField) {
+	if visiting[t] {
+		return
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		fieldIndex := append(append([]int(nil), index...), i)
+		ft := sf.Type
+		if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			// Promote its fields, even if it's unexported
+			collectMsgpackFields(ft, fieldIndex, visiting, fields)
+			continue
+		}
+		if sf.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		f := msgpackField{name: name, index: fieldIndex, tagged: name != ""}
+		if name == "" {
+			f.name = sf.Name
+		}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				f.omitEmpty = true
+			case "string":
+				switch ft.Kind() {
+				case reflect.Bool, reflect.String,
+					reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+					reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+					reflect.Float32, reflect.Float64:
+					f.quoted = true
+				}
+			}
+		}
+		*fields = append(*fields, f)
+	}
+}
+
+func dominantMsgpackField(fields []msgpackField) (msgpackField, bool) {
+	depth := len(fields[0].index)
+	for _, f := range fields {
+		if len(f.index) < depth {
+			depth = len(f.index)
+		}
+	}
+	var shallowest, tagged []msgpackField
+	for _, f := range fields {
+		if len(f.index) == depth {
+			shallowest = append(shallowest, f)
+			if f.tagged {
+				tagged = append(tagged, f)
+			}
+		}
+	}
+	if len(shallowest) == 1 {
+		return shallowest[0], true
+	}
+	if len(tagged) == 1 {
+		return tagged[0], true
+	}
+	return msgpackField{}, false
+}
+
+// The field at index, or false if it's in a nil embedded struct pointer
+func msgpackFieldValue(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return reflect.Value{}, false
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0:
+		writeMsgpackUint(buf, uint64(n))
+	case n >= -32:
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(n)})
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n < 128:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, s string) {
+	if len(s) < 32 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else {
+		writeMsgpackLen(buf, len(s), 0, 0xd9, 0xda, 0xdb)
+	}
+	buf.WriteString(s)
+}
+
+// Write a length header. fix is the fixed-size prefix (for lengths < 16),
+// or 0 if there is none; len8 likewise for the 1-byte length form.
+func writeMsgpackLen(buf *bytes.Buffer, n int, fix, len8, len16, len32 byte) {
+	switch {
+	case fix != 0 && n < 16:
+		buf.WriteByte(fix | byte(n))
+	case len8 != 0 && n <= math.MaxUint8:
+		buf.Write([]byte{len8, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(len16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(len32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
@@ -0,0 +1,43 @@
+package gop
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kernel USER_HZ. We can't sysconf(_SC_CLK_TCK) without cgo, but this is 100
+// on every linux we run on.
+const clockTicksPerSec = 100
+
+func readProcStat() (procStat, error) {
+	// See proc(5)
+	buf, err := ioutil.ReadFile("/proc/self/stat")
+	if err != nil {
+		return procStat{}, err
+	}
+	return parseProcStat(string(buf), os.Getpagesize())
+}
+
+func parseProcStat(s string, pageSize int) (procStat, error) {
+	// The command name can contain spaces, so start after its closing paren.
+	// fields[0] is then the 3rd field (state).
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 22 {
+		return procStat{}, fmt.Errorf("Too few fields in /proc/self/stat: %d", len(fields))
+	}
+	field := func(n int) int64 {
+		v, _ := strconv.ParseInt(fields[n-3], 10, 64)
+		return v
+	}
+	tick := time.Second / clockTicksPerSec
+	return procStat{
+		numThreads: field(20),
+		userTime:   time.Duration(field(14)) * tick,
+		systemTime: time.Duration(field(15)) * tick,
+		rssBytes:   field(24) * int64(pageSize),
+	}, nil
+}
@@ -0,0 +1,29 @@
+package gop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	// pid (comm) state ppid ... as in proc(5), with a command name containing ") "
+	stat := "1234 (my (odd) app) S 1 1234 1234 0 -1 4194560 500 0 0 0 " +
+		"250 75 0 0 20 0 12 0 100 123456789 300 18446744073709551615"
+	ps, err := parseProcStat(stat, 4096)
+	if err != nil {
+		t.Fatalf("parseProcStat: %s", err)
+	}
+	want := procStat{
+		numThreads: 12,
+		userTime:   2500 * time.Millisecond,
+		systemTime: 750 * time.Millisecond,
+		rssBytes:   300 * 4096,
+	}
+	if ps != want {
+		t.Errorf("got %+v, want %+v", ps, want)
+	}
+
+	if _, err := parseProcStat("1234 (app) S 1 2 3", 4096); err == nil {
+		t.Errorf("expected an error for a truncated stat line")
+	}
+}
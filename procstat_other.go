@@ -0,0 +1,7 @@
+//go:build !linux
+
+package gop
+
+func readProcStat() (procStat, error) {
+	return procStat{}, errNoProcStat
+}
@@ -0,0 +1,440 @@
+package gop
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The host part of an address, which may or may not have a port
+func trimPort(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.Trim(addr, "[]")
+	}
+	return host
+}
+
+// Parse IPs and CIDR ranges. Plain IPs match just themselves.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The proxies whose headers we believe
+type proxyTrust struct {
+	nets   []*net.IPNet
+	header string // Which header they set: forwarded, x-forwarded-for or x-real-ip
+	legacy bool   // use_xf_headers without trusted_proxies: trust the peer, whoever it is
+}
+
+func (t *proxyTrust) trusted(ip net.IP) bool {
+	return ip != nil && ipInNets(ip, t.nets)
+}
+
+// Load trusted_proxies and proxy_header, now and whenever config changes
+func (a *App) initProxies() {
+	a.loadProxyConfig()
+	a.Cfg.AddOnChangeCallback(func(cfg *Config) { a.loadProxyConfig() })
+}
+
+func (a *App) loadProxyConfig() {
+	trust := &proxyTrust{}
+	cidrs, _ := a.Cfg.Get("gop", "trusted_proxies", "")
+	nets, err := parseCIDRs(splitList(cidrs))
+	if err != nil {
+		a.Error("Bad trusted_proxies - trusting none: %s", err.Error())
+		nets = nil
+	}
+	trust.nets = nets
+	useXF, _ := a.Cfg.GetBool("gop", "use_xf_headers", false)
+	trust.legacy = useXF && cidrs == ""
+
+	header, _ := a.Cfg.Get("gop", "proxy_header", "x-forwarded-for")
+	trust.header = strings.ToLower(header)
+	switch trust.header {
+	case "forwarded", "x-forwarded-for", "x-real-ip":
+	default:
+		a.Error("Bad proxy_header [%s] - using x-forwarded-for", header)
+		trust.header = "x-forwarded-for"
+	}
+
+	a.proxyTrustMu.Lock()
+	a.proxyTrust = trust
+	a.proxyTrustMu.Unlock()
+}
+
+// Who the client really is, and what they asked for, according to any
+// trusted proxies between us and them
+type clientInfo struct {
+	remoteIP string // IP, or ip:port if taken from the connection
+	isHTTPS  bool
+	host     string
+}
+
+func (a *App) resolveClient(r *http.Request) clientInfo {
+	info := clientInfo{remoteIP: r.RemoteAddr, isHTTPS: r.TLS != nil, host: r.Host}
+
+	a.proxyTrustMu.Lock()
+	trust := a.proxyTrust
+	a.proxyTrustMu.Unlock()
+	if trust == nil {
+		return info
+	}
+	peer := net.ParseIP(trimPort(r.RemoteAddr))
+	if !trust.legacy && !trust.trusted(peer) {
+		// Anyone can send the headers
+		return info
+	}
+
+	var hops []forwardedHop
+	switch trust.header {
+	case "forwarded":
+		hops = parseForwarded(r.Header.Values("Forwarded"))
+	case "x-forwarded-for":
+		hops = parseXForwarded(r.Header)
+	case "x-real-ip":
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			hops = []forwardedHop{{forIP: ip, proto: r.Header.Get("X-Forwarded-Proto")}}
+		}
+	}
+	if len(hops) == 0 {
+		return info
+	}
+
+	// Walk back from the nearest proxy until we find a hop we don't trust.
+	// Everything to the left of it could have been made up by the client.
+	client := -1
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(trimPort(hops[i].forIP))
+		if ip == nil {
+			// Garbled (or "unknown"), so the last good hop is as far as we can go
+			break
+		}
+		client = i
+		if !trust.trusted(ip) {
+			break
+		}
+	}
+	if client < 0 {
+		return info
+	}
+	hop := hops[client]
+	info.remoteIP = trimPort(hop.forIP)
+	if hop.proto != "" {
+		info.isHTTPS = strings.EqualFold(hop.proto, "https")
+	}
+	if hop.host != "" {
+		info.host = hop.host
+	}
+	return info
+}
+
+// What one proxy said about the client it was talking to
+type forwardedHop struct {
+	forIP string
+	proto string
+	host  string
+}
+
+// Parse RFC 7239 Forwarded headers, e.g.
+// `for=192.0.2.60;proto=https;host=example.com, for="[2001:db8::1]:4711"`
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				v := strings.Trim(kv[1], `"`)
+				switch strings.ToLower(kv[0]) {
+				case "for":
+					hop.forIP = v
+				case "proto":
+					hop.proto = v
+				case "host":
+					hop.host = v
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// Parse X-Forwarded-For, with X-Forwarded-Proto and X-Forwarded-Host.
+// Where those are lists matching X-Forwarded-For they are taken per hop,
+// otherwise the nearest proxy's value applies to every hop.
+func parseXForwarded(h http.Header) []forwardedHop {
+	fors := splitHeaderList(h.Values("X-Forwarded-For"))
+	protos := splitHeaderList(h.Values("X-Forwarded-Proto"))
+	hosts := splitHeaderList(h.Values("X-Forwarded-Host"))
+	pick := func(list []string, i int) string {
+		if len(list) == len(fors) {
+			return list[i]
+		}
+		if len(list) > 0 {
+			return list[len(list)-1]
+		}
+		return ""
+	}
+	hops := make([]forwardedHop, len(fors))
+	for i, ip := range fors {
+		hops[i] = forwardedHop{forIP: ip, proto: pick(protos, i), host: pick(hosts, i)}
+	}
+	return hops
+}
+
+func splitHeaderList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+	return items
+}
+
+// How long a new connection has to send its PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// Wraps a listener whose connections start with a HAProxy PROXY protocol
+// (v1 or v2) header, so RemoteAddr is the client rather than the proxy.
+// Headers from peers outside trusted_proxies are read but ignored.
+type proxyProtocolListener struct {
+	net.Listener
+	app *App
+}
+
+func (a *App) proxyProtocolListener(l net.Listener) net.Listener {
+	if proxies, _ := a.Cfg.Get("gop", "trusted_proxies", ""); proxies == "" {
+		a.Fatalf("PROXY protocol needs trusted_proxies, or any client could claim any address")
+	}
+	return &proxyProtocolListener{Listener: l, app: a}
+}
+
+func (pl *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The header is read by the connection's own goro, on first use, so a
+	// slow client can't hold up Accept
+	return &proxyConn{Conn: c, app: pl.app, br: bufio.NewReader(c)}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	app *App
+	br  *bufio.Reader
+
+	once sync.Once
+	err  error
+
+	mu         sync.Mutex
+	remoteAddr net.Addr // From the header, once read
+	localAddr  net.Addr
+}
+
+// Only called from Read, so only ever blocks the connection's own goro
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		peer := c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		src, dst, err := readProxyHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = err
+			c.app.Error("Bad PROXY protocol header from [%s]: %s", peer, err.Error())
+			c.Conn.Close()
+			return
+		}
+		if src == nil {
+			// LOCAL or UNKNOWN, e.g. the proxy's health checks
+			return
+		}
+		c.app.proxyTrustMu.Lock()
+		trust := c.app.proxyTrust
+		c.app.proxyTrustMu.Unlock()
+		if trust == nil || !trust.trusted(net.ParseIP(trimPort(peer.String()))) {
+			c.app.Error("Ignoring PROXY protocol header from untrusted [%s]", peer)
+			return
+		}
+		c.mu.Lock()
+		c.remoteAddr, c.localAddr = src, dst
+		c.mu.Unlock()
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// The client, once the header has been read. Until then (e.g. in
+// ConnState hooks for new connections) the proxy.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+type connContextKey struct{}
+
+// net/http takes the connection's RemoteAddr before reading anything from
+// it, so before any PROXY header. By the time a request has been read,
+// the header has too, so take it again.
+func proxyRemoteAddr(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Context().Value(connContextKey{}).(net.Conn)
+		if tlsConn, ok := c.(*tls.Conn); ok {
+			c = tlsConn.NetConn()
+		}
+		if pc, ok := c.(*proxyConn); ok {
+			r.RemoteAddr = pc.RemoteAddr().String()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Read a PROXY header, returning the original source and destination
+// (nil if the proxy didn't give them)
+func readProxyHeader(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	start, err := br.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyV2Sig) {
+		return readProxyHeaderV2(br)
+	}
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyHeaderV1(br)
+	}
+	return nil, nil, fmt.Errorf("No PROXY header")
+}
+
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("v1 header too long or unterminated")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("Bad v1 header [%s]", strings.TrimSpace(string(line)))
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("Bad v1 header [%s]", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(br, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("Unsupported v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0xf
+	family := header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(br, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if command == 0 {
+		// LOCAL
+		return nil, nil, nil
+	}
+	if command != 1 {
+		return nil, nil, fmt.Errorf("Unknown v2 command %d", command)
+	}
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNIX or unspecified
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("Short v2 address block")
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:]))}
+	// Any TLVs after the addresses are ignored
+	return src, dst, nil
+}
@@ -0,0 +1,222 @@
+package gop
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   []forwardedHop
+	}{
+		{nil, nil},
+		{
+			[]string{`for=192.0.2.60;proto=https;host=example.com`},
+			[]forwardedHop{{forIP: "192.0.2.60", proto: "https", host: "example.com"}},
+		},
+		{
+			[]string{`for=192.0.2.43, For="[2001:db8:cafe::17]:4711"`},
+			[]forwardedHop{{forIP: "192.0.2.43"}, {forIP: "[2001:db8:cafe::17]:4711"}},
+		},
+		// Several headers make one list
+		{
+			[]string{`for=unknown`, ` for=198.51.100.17 ; proto=http`},
+			[]forwardedHop{{forIP: "unknown"}, {forIP: "198.51.100.17", proto: "http"}},
+		},
+		{
+			[]string{`by=203.0.113.43;secret`},
+			[]forwardedHop{{}},
+		},
+	}
+	for _, test := range tests {
+		got := parseForwarded(test.values)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseForwarded(%q) = %+v, want %+v", test.values, got, test.want)
+		}
+	}
+}
+
+func TestParseXForwarded(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   []forwardedHop
+	}{
+		{http.Header{}, []forwardedHop{}},
+		{
+			http.Header{"X-Forwarded-For": {"192.0.2.1"}},
+			[]forwardedHop{{forIP: "192.0.2.1"}},
+		},
+		// Lists matching X-Forwarded-For go per hop
+		{
+			http.Header{
+				"X-Forwarded-For":   {"192.0.2.1, 198.51.100.2"},
+				"X-Forwarded-Proto": {"https, http"},
+				"X-Forwarded-Host":  {"a.example", "b.example"},
+			},
+			[]forwardedHop{
+				{forIP: "192.0.2.1", proto: "https", host: "a.example"},
+				{forIP: "198.51.100.2", proto: "http", host: "b.example"},
+			},
+		},
+		// Otherwise the nearest proxy's applies to all
+		{
+			http.Header{
+				"X-Forwarded-For":   {"192.0.2.1", "198.51.100.2"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			[]forwardedHop{
+				{forIP: "192.0.2.1", proto: "https"},
+				{forIP: "198.51.100.2", proto: "https"},
+			},
+		},
+	}
+	for _, test := range tests {
+		got := parseXForwarded(test.header)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseXForwarded(%v) = %+v, want %+v", test.header, got, test.want)
+		}
+	}
+}
+
+// A v2 header for a TCP connection from src to dst
+func proxyHeaderV2(command byte, src, dst *net.TCPAddr) []byte {
+	var family byte
+	var body []byte
+	if src != nil {
+		family = 0x11
+		ipLen := net.IPv4len
+		if src.IP.To4() == nil {
+			family, ipLen = 0x21, net.IPv6len
+		}
+		body = append(body, src.IP.To16()[16-ipLen:]...)
+		body = append(body, dst.IP.To16()[16-ipLen:]...)
+		body = binary.BigEndian.AppendUint16(body, uint16(src.Port))
+		body = binary.BigEndian.AppendUint16(body, uint16(dst.Port))
+	}
+	header := append([]byte(nil), proxyV2Sig...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.2").To4(), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	tests := []struct {
+		name   string
+		header []byte
+		src    string // "" for none
+		dst    string
+		ok     bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "192.0.2.1:56324", "192.0.2.2:443", true},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", true},
+		{"v1 bad ip", []byte("PROXY TCP4 192.0.2.x 192.0.2.2 56324 443\r\n"), "", "", false},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n"), "", "", false},
+		{"v1 bad proto", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "", "", false},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n"), "", "", false},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", "", false},
+		{"v2 tcp4", proxyHeaderV2(1, src4, dst4), "192.0.2.1:56324", "192.0.2.2:443", true},
+		{"v2 tcp6", proxyHeaderV2(1, src6, dst6), "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"v2 local", proxyHeaderV2(0, nil, nil), "", "", true},
+		{"v2 bad command", proxyHeaderV2(2, src4, dst4), "", "", false},
+		{"v2 short", proxyHeaderV2(1, src4, dst4)[:20], "", "", false},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"), "", "", false},
+	}
+	for _, test := range tests {
+		br := bufio.NewReader(io.MultiReader(bytes.NewReader(test.header), strings.NewReader("GET /")))
+		src, dst, err := readProxyHeader(br)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err = %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		gotSrc, gotDst := "", ""
+		if src != nil {
+			gotSrc, gotDst = src.String(), dst.String()
+		}
+		if gotSrc != test.src || gotDst != test.dst {
+			t.Errorf("%s: got %s -> %s, want %s -> %s", test.name, gotSrc, gotDst, test.src, test.dst)
+		}
+		// The request must be left unread
+		rest, _ := io.ReadAll(br)
+		if string(rest) != "GET /" {
+			t.Errorf("%s: left %q after the header", test.name, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		trustedProxies string
+		want           string
+	}{
+		{"127.0.0.1", "192.0.2.1"},
+		{"10.0.0.0/8", "127.0.0.1"},
+	}
+	for _, test := range tests {
+		a := InitCmd("gop_test", "proxy")
+		go a.requestMaker()
+		a.Cfg.TransientOverride("gop", "trusted_proxies", test.trustedProxies)
+		a.HandleFunc("/ip", func(g *Req) error {
+			g.SendText([]byte(g.RealRemoteIP))
+			return nil
+		})
+		newConnAddrs := make(chan string, 1)
+		a.OnConnState(func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConnAddrs <- c.RemoteAddr().String()
+			}
+		})
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %s", err)
+		}
+		srv := a.newHTTPServer(a.GorillaRouter)
+		go srv.Serve(a.proxyProtocolListener(l))
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %s", err)
+		}
+		// The hook mustn't wait for a header we haven't sent
+		select {
+		case addr := <-newConnAddrs:
+			if addr != conn.LocalAddr().String() {
+				t.Errorf("ConnState hook saw %s, want the socket address %s", addr, conn.LocalAddr())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("ConnState hook blocked waiting for the PROXY header")
+		}
+
+		fmt.Fprintf(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 80\r\nGET /ip HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse: %s", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		srv.Close()
+		// RealRemoteIP keeps the port when it comes from the connection
+		if got := trimPort(strings.TrimSpace(string(body))); got != test.want {
+			t.Errorf("With trusted_proxies %q: client %q, want %q", test.trustedProxies, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package gop
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A token bucket limit: up to Burst requests at once, refilled at Count
+// requests per Per.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+	Burst int // Defaults to Count
+}
+
+// Parse a limit such as "10/s", "600/m burst=50" or "5/10s".
+func ParseRateLimit(s string) (RateLimit, error) {
+	var limit RateLimit
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return limit, fmt.Errorf("Bad rate limit [%s]", s)
+	}
+	parts := strings.SplitN(fields[0], "/", 2)
+	if len(parts) != 2 {
+		return limit, fmt.Errorf("Bad rate limit [%s] - want count/period", s)
+	}
+	count, err := strconv.Atoi(parts[0])
+	if err != nil || count <= 0 {
+		return limit, fmt.Errorf("Bad rate limit count [%s]", parts[0])
+	}
+	limit.Count = count
+	switch parts[1] {
+	case "s":
+		limit.Per = time.Second
+	case "m":
+		limit.Per = time.Minute
+	case "h":
+		limit.Per = time.Hour
+	default:
+		limit.Per, err = time.ParseDuration(parts[1])
+		if err != nil || limit.Per <= 0 {
+			return limit, fmt.Errorf("Bad rate limit period [%s]", parts[1])
+		}
+	}
+	if len(fields) == 2 {
+		if !strings.HasPrefix(fields[1], "burst=") {
+			return limit, fmt.Errorf("Bad rate limit option [%s]", fields[1])
+		}
+		limit.Burst, err = strconv.Atoi(strings.TrimPrefix(fields[1], "burst="))
+		if err != nil || limit.Burst <= 0 {
+			return limit, fmt.Errorf("Bad rate limit burst [%s]", fields[1])
+		}
+	}
+	return limit, nil
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%d/%s burst=%d", l.Count, l.Per, l.burst())
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Count
+}
+
+func (l RateLimit) perSecond() float64 {
+	return float64(l.Count) / l.Per.Seconds()
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A set of token buckets sharing a limit, one per key
+type rateLimiter struct {
+	name string
+
+	mu        sync.Mutex
+	limit     RateLimit
+	buckets   map[string]*tokenBucket
+	rejected  int64
+	lastSweep time.Time
+}
+
+// Take a token for key. If none are left, returns false and how long
+// until there will be one.
+func (rl *rateLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.sweep(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(rl.limit.burst()), last: now}
+		rl.buckets[key] = b
+	}
+	rl.refill(b, now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	rl.rejected++
+	wait := time.Duration((1 - b.tokens) / rl.limit.perSecond() * float64(time.Second))
+	return false, wait
+}
+
+// Must hold rl.mu
+func (rl *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * rl.limit.perSecond()
+	if burst := float64(rl.limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// Forget full buckets, which are the same as new ones. Must hold rl.mu.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+	for key, b := range rl.buckets {
+		rl.refill(b, now)
+		if b.tokens >= float64(rl.limit.burst()) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Get (or create) the named limiter, updating its limit if changed
+func (a *App) getRateLimiter(name string, limit RateLimit) *rateLimiter {
+	a.rateLimitersMu.Lock()
+	defer a.rateLimitersMu.Unlock()
+	if a.rateLimiters == nil {
+		a.rateLimiters = make(map[string]*rateLimiter)
+	}
+	rl, ok := a.rateLimiters[name]
+	if !ok {
+		rl = &rateLimiter{name: name, limit: limit, buckets: make(map[string]*tokenBucket)}
+		a.rateLimiters[name] = rl
+		return rl
+	}
+	rl.mu.Lock()
+	rl.limit = limit
+	rl.mu.Unlock()
+	return rl
+}
+
+// Check key against the named limiter. Returns a 429 error if over.
+func (a *App) checkRateLimit(g *Req, name, statName string, limit RateLimit, key string) error {
+	ok, wait := a.getRateLimiter(name, limit).take(key, time.Now())
+	if ok {
+		return nil
+	}
+	a.Stats.Inc("rate_limited", 1)
+	a.Stats.Inc("rate_limited."+statName, 1)
+	g.Debug("Rate limited [%s] by %s (%s)", key, name, limit)
+	return HTTPError{
+		Code:      http.StatusTooManyRequests,
+		Body:      "Rate limit exceeded",
+		ErrorCode: "rate_limited",
+		Headers:   http.Header{"Retry-After": {strconv.Itoa(int(math.Ceil(wait.Seconds())))}},
+	}
+}
+
+// Key requests by client IP
+func RateLimitByIP(g *Req) string {
+	return g.remoteIP()
+}
+
+// The client's IP, without port
+func (g *Req) remoteIP() string {
+	return trimPort(g.RealRemoteIP)
+}
+
+// Key requests by route, so the limit is shared by all clients
+func RateLimitByRoute(g *Req) string {
+	if tmpl := g.routeTemplate(); tmpl != "" {
+		return tmpl
+	}
+	return g.R.URL.Path
+}
+
+// Middleware to limit requests per key, e.g. per API token. Limiters with
+// the same name share buckets, so use one name per policy.
+//
+//	limit, _ := gop.ParseRateLimit("100/m")
+//	app.HandleFunc("/api/x", gop.Chain(h, app.RateLimit("api", limit, apiKey)))
+func (a *App) RateLimit(name string, limit RateLimit, key func(g *Req) string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			err := a.checkRateLimit(g, name, name, limit, key(g))
+			if err != nil {
+				return err
+			}
+			return next(g)
+		}
+	}
+}
+
+// Apply the rate limits from config: rate_limit_ip (per client IP),
+// rate_limit_ip:<route> (per client IP on a route) and
+// rate_limit_route:<route> (all clients on a route).
+func (a *App) RateLimitMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			err := a.checkConfiguredRateLimits(g)
+			if err != nil {
+				if g.W != nil {
+					// We're outside the error middleware
+					err.(HTTPError).Write(g.W)
+				}
+				return nil
+			}
+			return next(g)
+		}
+	}
+}
+
+// Parse the rate_limit_* config, now and whenever it changes, so a bad
+// limit is logged once rather than on every request
+func (a *App) initRateLimits() {
+	a.loadRateLimitConfig()
+	a.Cfg.AddOnChangeCallback(func(cfg *Config) { a.loadRateLimitConfig() })
+}
+
+func (a *App) loadRateLimitConfig() {
+	limits := make(map[string]RateLimit)
+	for _, key := range a.Cfg.SectionKeys("gop") {
+		if key != "rate_limit_ip" && !strings.HasPrefix(key, "rate_limit_ip:") &&
+			!strings.HasPrefix(key, "rate_limit_route:") {
+			continue
+		}
+		limitStr, _ := a.Cfg.Get("gop", key, "")
+		if limitStr == "" {
+			continue
+		}
+		limit, err := ParseRateLimit(limitStr)
+		if err != nil {
+			a.Error("Ignoring %s: %s", key, err.Error())
+			continue
+		}
+		limits[key] = limit
+	}
+
+	a.rateLimitersMu.Lock()
+	a.configuredRateLimits = limits
+	a.rateLimitersMu.Unlock()
+}
+
+func (a *App) checkConfiguredRateLimits(g *Req) error {
+	tmpl := g.routeTemplate()
+	type check struct {
+		name, statName, cfgKey string
+		key                    func(g *Req) string
+	}
+	checks := []check{{"ip", "ip", "rate_limit_ip", RateLimitByIP}}
+	if tmpl != "" {
+		checks = append(checks,
+			check{"ip:" + tmpl, "ip_route", "rate_limit_ip:" + tmpl, RateLimitByIP},
+			check{"route:" + tmpl, "route", "rate_limit_route:" + tmpl, RateLimitByRoute})
+	}
+	a.rateLimitersMu.Lock()
+	limits := a.configuredRateLimits
+	a.rateLimitersMu.Unlock()
+	for _, c := range checks {
+		limit, ok := limits[c.cfgKey]
+		if !ok {
+			continue
+		}
+		err := a.checkRateLimit(g, c.name, c.statName, limit, c.key(g))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type rateLimiterStatus struct {
+	Name     string
+	Limit    string
+	Keys     int      // Clients (or other keys) with recent requests
+	Limited  []string `json:",omitempty"` // Keys currently out of tokens (up to 20)
+	Rejected int64
+}
+
+func (a *App) getRateLimiterStatus() []rateLimiterStatus {
+	a.rateLimitersMu.Lock()
+	limiters := make([]*rateLimiter, 0, len(a.rateLimiters))
+	for _, rl := range a.rateLimiters {
+		limiters = append(limiters, rl)
+	}
+	a.rateLimitersMu.Unlock()
+
+	now := time.Now()
+	statuses := make([]rateLimiterStatus, 0, len(limiters))
+	for _, rl := range limiters {
+		rl.mu.Lock()
+		status := rateLimiterStatus{
+			Name:     rl.name,
+			Limit:    rl.limit.String(),
+			Keys:     len(rl.buckets),
+			Rejected: rl.rejected,
+		}
+		for key, b := range rl.buckets {
+			rl.refill(b, now)
+			if b.tokens < 1 {
+				status.Limited = append(status.Limited, key)
+			}
+		}
+		rl.mu.Unlock()
+		sort.Strings(status.Limited)
+		if len(status.Limited) > 20 {
+			status.Limited = status.Limited[:20]
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
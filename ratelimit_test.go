@@ -0,0 +1,77 @@
+package gop
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		s     string
+		want  RateLimit
+		burst int
+	}{
+		{"10/s", RateLimit{Count: 10, Per: time.Second}, 10},
+		{"600/m", RateLimit{Count: 600, Per: time.Minute}, 600},
+		{"1000/h", RateLimit{Count: 1000, Per: time.Hour}, 1000},
+		{"5/10s", RateLimit{Count: 5, Per: 10 * time.Second}, 5},
+		{"600/m burst=50", RateLimit{Count: 600, Per: time.Minute, Burst: 50}, 50},
+		{"  3/500ms   burst=1 ", RateLimit{Count: 3, Per: 500 * time.Millisecond, Burst: 1}, 1},
+	}
+	for _, test := range tests {
+		got, err := ParseRateLimit(test.s)
+		if err != nil {
+			t.Errorf("ParseRateLimit(%q): %s", test.s, err)
+			continue
+		}
+		if got != test.want || got.burst() != test.burst {
+			t.Errorf("ParseRateLimit(%q) = %+v (burst %d), want %+v (burst %d)",
+				test.s, got, got.burst(), test.want, test.burst)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"10",
+		"10/",
+		"/s",
+		"0/s",
+		"-1/s",
+		"ten/s",
+		"10/fortnight",
+		"10/0s",
+		"10/-1s",
+		"10/s burst=0",
+		"10/s burst=x",
+		"10/s bust=5",
+		"10/s burst=5 extra",
+	} {
+		if got, err := ParseRateLimit(s); err == nil {
+			t.Errorf("ParseRateLimit(%q) = %+v, want error", s, got)
+		}
+	}
+}
+
+func TestConfiguredRateLimits(t *testing.T) {
+	a, srv := newTestApp(t, "ratelimit")
+	a.HandleFunc("/x", func(g *Req) error {
+		return g.SendText([]byte("hello"))
+	})
+	// Parsed on change, so the bad limit is logged once and ignored
+	a.Cfg.TransientOverride("gop", "rate_limit_ip", "lots")
+	a.Cfg.TransientOverride("gop", "rate_limit_route:/x", "1/h")
+	a.Cfg.TransientOverride("gop", "rate_limit_route:/x", "2/h")
+	if limits := a.configuredRateLimits; len(limits) != 1 || limits["rate_limit_route:/x"].Count != 2 {
+		t.Fatalf("Got limits %v", limits)
+	}
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		code, _ := getBody(t, srv.URL+"/x")
+		codes = append(codes, code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Got %v, want two 200s then a 429", codes)
+	}
+}
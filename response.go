@@ -0,0 +1,378 @@
+package gop
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Choose which of offers (media types, in order of our preference) best
+// suits the Accept header. Returns "" if none are acceptable.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	type acceptRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(qs, 64)
+			if err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		// The most specific matching range decides the offer's q
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			s := -1
+			switch {
+			case r.mediaType == offer:
+				s = 2
+			case strings.HasSuffix(r.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(r.mediaType, "*")):
+				s = 1
+			case r.mediaType == "*/*" || r.mediaType == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// Send v in the format the client asks for in its Accept header: JSON (the
+// default), XML, MessagePack, CSV or plain text. XML isn't offered for
+// maps, CSV only for [][]string and slices of structs, and text only for
+// strings, []byte and fmt.Stringers. Responds 406 if nothing is acceptable.
+func (g *Req) Send(v interface{}) error {
+	offers := []string{"application/json"}
+	if _, ok := textValue(v); ok {
+		offers = append(offers, "text/plain")
+	}
+	if xmlable(v) {
+		offers = append(offers, "application/xml", "text/xml")
+	}
+	offers = append(offers, "application/msgpack", "application/x-msgpack")
+	if csvRows(v) != nil {
+		offers = append(offers, "text/csv")
+	}
+	g.W.Header().Add("Vary", "Accept")
+
+	var body []byte
+	var err error
+	mimeType := negotiate(g.R.Header.Get("Accept"), offers)
+	switch mimeType {
+	case "application/json":
+		return g.SendJson(fmt.Sprintf("%T", v), v)
+	case "application/xml", "text/xml":
+		body, err = marshalXML(v)
+		body = append([]byte(xml.Header), body...)
+		mimeType += "; charset=utf-8"
+	case "application/msgpack", "application/x-msgpack":
+		body, err = marshalMsgpack(v)
+	case "text/csv":
+		var buf bytes.Buffer
+		err = csv.NewWriter(&buf).WriteAll(csvRows(v))
+		body = buf.Bytes()
+		mimeType += "; charset=utf-8"
+	case "text/plain":
+		s, _ := textValue(v)
+		return g.SendText([]byte(s))
+	default:
+		return HTTPError{
+			Code: http.StatusNotAcceptable,
+			Body: "Can respond with: " + strings.Join(offers, ", "),
+		}
+	}
+	if err != nil {
+		g.Error("Failed to encode %T as %s: %s", v, mimeType, err.Error())
+		return ServerError("Failed to encode response: " + err.Error())
+	}
+	return g.send(mimeType, body)
+}
+
+// Slices are wrapped in a <list> of <item>s, to give the document a root
+type xmlList struct {
+	XMLName xml.Name    `xml:"list"`
+	Items   interface{} `xml:"item"`
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	if kind := reflect.Indirect(reflect.ValueOf(v)).Kind(); kind == reflect.Slice || kind == reflect.Array {
+		v = xmlList{Items: v}
+	}
+	return xml.Marshal(v)
+}
+
+func xmlable(v interface{}) bool {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	return rv.IsValid() && rv.Kind() != reflect.Map
+}
+
+func textValue(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case []byte:
+		return string(t), true
+	case fmt.Stringer:
+		return t.String(), true
+	}
+	return "", false
+}
+
+// v as CSV rows, or nil if it can't be. Slices of structs get a header
+// row of field names (from `csv` tags if present).
+func csvRows(v interface{}) [][]string {
+	if rows, ok := v.([][]string); ok {
+		return rows
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+	elemType := rv.Type().Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var header []string
+	var fieldIndexes []int
+	for i := 0; i < elemType.NumField(); i++ {
+		sf := elemType.Field(i)
+		name := fieldName(sf, "csv")
+		if sf.PkgPath != "" || name == "-" {
+			continue
+		}
+		header = append(header, name)
+		fieldIndexes = append(fieldIndexes, i)
+	}
+	rows := [][]string{header}
+	for i := 0; i < rv.Len(); i++ {
+		elem := rv.Index(i)
+		row := make([]string, len(fieldIndexes))
+		if elem.Kind() == reflect.Ptr {
+			if elem.IsNil() {
+				rows = append(rows, row)
+				continue
+			}
+			elem = elem.Elem()
+		}
+		for j, fi := range fieldIndexes {
+			row[j] = fmt.Sprint(elem.Field(fi).Interface())
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Redirect the client to url, which may be relative to the request path.
+// code should be a 3xx status, e.g. http.StatusFound.
+func (g *Req) Redirect(url string, code int) error {
+	if code < 300 || code > 399 {
+		return ServerError(fmt.Sprintf("Bad redirect code %d", code))
+	}
+	http.Redirect(g.W, g.R, url, code)
+	return nil
+}
+
+// Stream a response of the given type, written by f. Each write is flushed
+// to the client straight away. Writes fail once the request context is
+// done, so f should return on error. Long streams may want g.AllowSlow().
+func (g *Req) Stream(contentType string, f func(w io.Writer) error) error {
+	g.W.Header().Set("Content-Type", contentType)
+	return f(&flushWriter{g: g})
+}
+
+type flushWriter struct {
+	g *Req
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	err := fw.g.Context().Err()
+	if err != nil {
+		return 0, err
+	}
+	n, err := fw.g.W.Write(p)
+	if err != nil {
+		return n, err
+	}
+	fw.g.W.Flush()
+	return n, nil
+}
+
+// Send the file at path, with support for Range requests and conditional
+// GETs via Last-Modified and ETag. The Content-Type is set from the file's
+// extension (or contents) unless already set. path must not come from the
+// client unchecked - paths containing ".." are refused.
+func (g *Req) ServeFile(path string) error {
+	for _, elem := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return BadRequest("Invalid path")
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return NotFound("File not found")
+		}
+		if os.IsPermission(err) {
+			return HTTPError{Code: http.StatusForbidden, Body: "Forbidden"}
+		}
+		return ServerError("Failed to open file: " + err.Error())
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return ServerError("Failed to stat file: " + err.Error())
+	}
+	if info.IsDir() {
+		return NotFound("File not found")
+	}
+
+	if g.W.Header().Get("Etag") == "" {
+		g.W.Header().Set("Etag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	}
+	http.ServeContent(g.W, g.R, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// Send content with support for Range requests and conditional GETs, as
+// ServeFile does. name is used to guess the Content-Type if unset, modTime
+// for Last-Modified (if non-zero). Set an Etag header first to enable
+// If-None-Match handling.
+func (g *Req) ServeContent(name string, modTime time.Time, content io.ReadSeeker) error {
+	http.ServeContent(g.W, g.R, name, modTime, content)
+	return nil
+}
+
+// Set a cookie on the response. Must be called before anything is written.
+func (g *Req) SetCookie(cookie *http.Cookie) {
+	http.SetCookie(g.W, cookie)
+}
+
+// Tell the client to delete the named cookie. path must match the one it
+// was set with.
+func (g *Req) ClearCookie(name, path string) {
+	http.SetCookie(g.W, &http.Cookie{
+		Name:    name,
+		Path:    path,
+		MaxAge:  -1,
+		Expires: time.Unix(0, 0),
+	})
+}
+
+// A Server-Sent Events message. Data is sent as-is if it is a string or
+// []byte, otherwise it is encoded as JSON.
+type Event struct {
+	ID    string
+	Event string
+	Data  interface{}
+	Retry time.Duration // If non-zero, ask the client to reconnect after this long
+}
+
+// A stream of Server-Sent Events, created by g.EventStream()
+type EventStream struct {
+	g *Req
+}
+
+// Start a text/event-stream response. The request is exempted from the
+// request timeout and slow request warnings, since streams are long-lived.
+// Send events until the client goes away (Send returns an error, and
+// g.Context() is done).
+func (g *Req) EventStream() *EventStream {
+	g.AllowSlow()
+	h := g.W.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// Stop nginx holding events back
+	h.Set("X-Accel-Buffering", "no")
+	g.W.WriteHeader(http.StatusOK)
+	g.W.Flush()
+	return &EventStream{g: g}
+}
+
+// Send an event and flush it to the client
+func (es *EventStream) Send(ev Event) error {
+	var data string
+	switch d := ev.Data.(type) {
+	case string:
+		data = d
+	case []byte:
+		data = string(d)
+	default:
+		buf, err := json.Marshal(d)
+		if err != nil {
+			return fmt.Errorf("Failed to encode event data as json: %s", err)
+		}
+		data = string(buf)
+	}
+
+	var msg strings.Builder
+	if ev.ID != "" {
+		fmt.Fprintf(&msg, "id: %s\n", stripNewlines(ev.ID))
+	}
+	if ev.Event != "" {
+		fmt.Fprintf(&msg, "event: %s\n", stripNewlines(ev.Event))
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&msg, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	for _, line := range strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n") {
+		fmt.Fprintf(&msg, "data: %s\n", line)
+	}
+	msg.WriteString("\n")
+	return es.write(msg.String())
+}
+
+// Send a comment line, which clients ignore. Useful as a keepalive.
+func (es *EventStream) Comment(text string) error {
+	return es.write(": " + stripNewlines(text) + "\n\n")
+}
+
+func (es *EventStream) write(s string) error {
+	err := es.g.Context().Err()
+	if err != nil {
+		return err
+	}
+	_, err = es.g.W.Write([]byte(s))
+	if err != nil {
+		return err
+	}
+	es.g.W.Flush()
+	return nil
+}
+
+func stripNewlines(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,175 @@
+package gop
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/plain", "application/msgpack"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"text/plain", "text/plain"},
+		{"text/*", "text/plain"},
+		{"application/msgpack, application/json;q=0.5", "application/msgpack"},
+		{"application/json;q=0.5, text/plain;q=0.9", "text/plain"},
+		// The most specific range decides, so this rules JSON out
+		{"*/*, application/json;q=0", "text/plain"},
+		{"image/png", ""},
+		{"application/json;q=nope, text/plain", "text/plain"},
+	}
+	for _, test := range tests {
+		if got := negotiate(test.accept, offers); got != test.want {
+			t.Errorf("negotiate(%q) = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
+
+type msgpackTestByte byte
+
+type MsgpackTestBase struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"` // Hidden by the outer Name
+}
+
+type msgpackTestStruct struct {
+	MsgpackTestBase
+	*msgpackTestExtra
+	Name  string `json:"name"`
+	Count int    `json:"count,string"`
+	Skip  string `json:"-"`
+	Empty string `json:"empty,omitempty"`
+	Plain bool
+}
+
+type msgpackTestExtra struct {
+	Extra string `json:"extra"`
+}
+
+func TestMarshalMsgpack(t *testing.T) {
+	str := func(s string) []byte { return append([]byte{0xa0 | byte(len(s))}, s...) }
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	tests := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{-1, []byte{0xff}},
+		{200, []byte{0xcc, 200}},
+		{-200, []byte{0xd1, 0xff, 0x38}},
+		{"hi", str("hi")},
+		{[]int{1, 2}, []byte{0x92, 1, 2}},
+		{[]byte{1, 2}, []byte{0xc4, 2, 1, 2}},
+		// Named byte types mustn't trip up the copy
+		{[]msgpackTestByte{1, 2}, []byte{0xc4, 2, 1, 2}},
+		{[2]msgpackTestByte{1, 2}, []byte{0xc4, 2, 1, 2}},
+		{map[string]int{"b": 2, "a": 1}, cat([]byte{0x82}, str("a"), []byte{1}, str("b"), []byte{2})},
+		// Embedded fields promoted (unless hidden, or in a nil pointer),
+		// the string option honoured
+		{msgpackTestStruct{MsgpackTestBase: MsgpackTestBase{ID: 1, Name: "hidden"}, Name: "bob", Count: 3, Skip: "x"},
+			cat([]byte{0x84}, str("id"), []byte{1}, str("name"), str("bob"), str("count"), str("3"), str("Plain"), []byte{0xc2})},
+		{msgpackTestStruct{msgpackTestExtra: &msgpackTestExtra{Extra: "e"}, Empty: "y"},
+			cat([]byte{0x86}, str("id"), []byte{0}, str("extra"), str("e"), str("name"), str(""), str("count"), str("0"),
+				str("empty"), str("y"), str("Plain"), []byte{0xc2})},
+	}
+	for _, test := range tests {
+		got, err := marshalMsgpack(test.v)
+		if err != nil {
+			t.Errorf("marshalMsgpack(%#v): %s", test.v, err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("marshalMsgpack(%#v) = % x, want % x", test.v, got, test.want)
+		}
+	}
+}
+
+func TestSendNegotiation(t *testing.T) {
+	a, srv := newTestApp(t, "response")
+	a.HandleFunc("/map", func(g *Req) error {
+		return g.Send(map[string]int{"a": 1})
+	})
+
+	tests := []struct {
+		accept      string
+		code        int
+		contentType string
+		body        string
+	}{
+		{"", http.StatusOK, "application/json", `{"a":1}`},
+		{"application/msgpack", http.StatusOK, "application/msgpack", "\x81\xa1a\x01"},
+		{"application/x-msgpack", http.StatusOK, "application/x-msgpack", "\x81\xa1a\x01"},
+		// Maps aren't offered as XML or CSV
+		{"application/xml", http.StatusNotAcceptable, "", ""},
+		{"text/csv", http.StatusNotAcceptable, "", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", srv.URL+"/map", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Accept %q: %s", test.accept, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("Accept %q: got %d, want %d", test.accept, resp.StatusCode, test.code)
+			continue
+		}
+		if resp.Header.Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: Vary %q", test.accept, resp.Header.Get("Vary"))
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, test.contentType) {
+			t.Errorf("Accept %q: Content-Type %q, want %q", test.accept, ct, test.contentType)
+		}
+		if got := strings.TrimSpace(string(body)); got != test.body {
+			t.Errorf("Accept %q: body %q, want %q", test.accept, got, test.body)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	a, srv := newTestApp(t, "response")
+	// Streams are exempt from the request timeout
+	a.Cfg.TransientOverride("gop", "request_timeout", "50ms")
+	a.HandleFunc("/events", func(g *Req) error {
+		es := g.EventStream()
+		es.Send(Event{ID: "1", Event: "greet\n", Data: "hello\r\nworld", Retry: 2 * time.Second})
+		time.Sleep(100 * time.Millisecond)
+		es.Comment("keepalive")
+		return es.Send(Event{Data: map[string]int{"n": 2}})
+	})
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("Cache-Control %q", resp.Header.Get("Cache-Control"))
+	}
+	want := "id: 1\nevent: greet\nretry: 2000\ndata: hello\ndata: world\n\n" +
+		": keepalive\n\n" +
+		"data: {\"n\":2}\n\n"
+	if string(body) != want {
+		t.Errorf("Got %q, want %q", body, want)
+	}
+}
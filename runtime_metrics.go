@@ -0,0 +1,131 @@
+package gop
+
+import (
+	"errors"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"time"
+)
+
+// Anything which can take a gauge value. The runtime collector publishes
+// to statsd and to every backend added with AddMetricsBackend.
+type MetricsBackend interface {
+	Gauge(stat string, value int64)
+}
+
+func (a *App) AddMetricsBackend(b MetricsBackend) {
+	a.metricsBackends = append(a.metricsBackends, b)
+}
+
+func (a *App) publishGauge(stat string, value int64) {
+	a.Stats.Gauge(stat, value)
+	for _, b := range a.metricsBackends {
+		b.Gauge(stat, value)
+	}
+}
+
+// Periodically publish go runtime and process metrics. This runs on its own
+// interval, separate from the watchdog limit checks.
+func (a *App) runtimeCollector() {
+	repeat, _ := a.Cfg.GetInt("gop", "runtime_metrics_secs", 60)
+	if repeat <= 0 {
+		a.Info("Runtime metrics collection disabled")
+		return
+	}
+	ticker := time.Tick(time.Second * time.Duration(repeat))
+
+	for {
+		a.collectRuntimeMetrics()
+		<-ticker
+	}
+}
+
+type procStat struct {
+	numThreads int64
+	userTime   time.Duration
+	systemTime time.Duration
+	rssBytes   int64
+}
+
+// Process stats come from /proc, so are linux only
+var errNoProcStat = errors.New("process stats not supported on this platform")
+
+var gcPauseQuantileNames = []string{"min", "p25", "p50", "p75", "max"}
+
+func (a *App) collectRuntimeMetrics() {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	a.publishGauge("mem.sys", int64(memStats.Sys))
+	a.publishGauge("mem.alloc", int64(memStats.Alloc))
+	a.publishGauge("mem.heap_objects", int64(memStats.HeapObjects))
+	a.publishGauge("mem.next_gc", int64(memStats.NextGC))
+
+	a.publishGauge("numgoro", int64(runtime.NumGoroutine()))
+	a.publishGauge("cgo_calls", runtime.NumCgoCall())
+
+	numFDs, err := fdsInUse()
+	if err == nil {
+		a.publishGauge("numfds", numFDs)
+	} else if !os.IsNotExist(err) {
+		// No /proc is expected off linux
+		a.Error("Failed to get number of fds in use: %s", err.Error())
+	}
+
+	gcStats := debug.GCStats{PauseQuantiles: make([]time.Duration, len(gcPauseQuantileNames))}
+	debug.ReadGCStats(&gcStats)
+	a.publishGauge("gc.num", gcStats.NumGC)
+	if gcStats.NumGC > 0 {
+		for i, pause := range gcStats.PauseQuantiles {
+			a.publishGauge("gc.pause_us."+gcPauseQuantileNames[i], int64(pause/time.Microsecond))
+		}
+	}
+
+	samples := []metrics.Sample{{Name: "/sched/latencies:seconds"}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() == metrics.KindFloat64Histogram {
+		h := samples[0].Value.Float64Histogram()
+		a.publishGauge("sched.latency_us.p50", int64(histogramQuantile(h, 0.5)*1e6))
+		a.publishGauge("sched.latency_us.p99", int64(histogramQuantile(h, 0.99)*1e6))
+	}
+
+	ps, err := readProcStat()
+	if err == errNoProcStat {
+		return
+	}
+	if err != nil {
+		a.Error("Failed to read process stats: %s", err.Error())
+		return
+	}
+	a.publishGauge("threads", ps.numThreads)
+	a.publishGauge("cpu.user_ms", ps.userTime.Nanoseconds()/int64(time.Millisecond))
+	a.publishGauge("cpu.system_ms", ps.systemTime.Nanoseconds()/int64(time.Millisecond))
+	a.publishGauge("mem.rss", ps.rssBytes)
+}
+
+// Approximate quantile q (0.0 -> 1.0) of the histogram, taking the upper
+// bound of the bucket in which it falls.
+func histogramQuantile(h *metrics.Float64Histogram, q float64) float64 {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen >= target {
+			upper := h.Buckets[i+1]
+			if math.IsInf(upper, 1) {
+				return h.Buckets[i]
+			}
+			return upper
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1]
+}
@@ -0,0 +1,224 @@
+package gop
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Add security headers to every response: HSTS (over HTTPS only), CSP,
+// X-Content-Type-Options, X-Frame-Options and Referrer-Policy, from config
+// (each can be overridden with <key>:<route>). Handlers can override them
+// by setting the header themselves.
+func (a *App) SecurityHeadersMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.W == nil {
+				return next(g)
+			}
+			h := g.W.Header()
+			if g.IsHTTPS {
+				maxAge, err := time.ParseDuration(g.routeSetting("hsts_max_age", "0s"))
+				if err == nil && maxAge > 0 {
+					hsts := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+					if sub, _ := strconv.ParseBool(g.routeSetting("hsts_include_subdomains", "false")); sub {
+						hsts += "; includeSubDomains"
+					}
+					if preload, _ := strconv.ParseBool(g.routeSetting("hsts_preload", "false")); preload {
+						hsts += "; preload"
+					}
+					h.Set("Strict-Transport-Security", hsts)
+				}
+			}
+			headers := []struct{ name, key, def string }{
+				{"Content-Security-Policy", "content_security_policy", ""},
+				{"Content-Security-Policy-Report-Only", "content_security_policy_report_only", ""},
+				{"X-Content-Type-Options", "content_type_options", "nosniff"},
+				{"X-Frame-Options", "frame_options", "SAMEORIGIN"},
+				{"Referrer-Policy", "referrer_policy", "strict-origin-when-cross-origin"},
+			}
+			for _, header := range headers {
+				if v := g.routeSetting(header.key, header.def); v != "" {
+					h.Set(header.name, v)
+				}
+			}
+			return next(g)
+		}
+	}
+}
+
+var ErrCSRF = HTTPError{Code: http.StatusForbidden, Body: "Missing or invalid CSRF token", ErrorCode: "csrf_failed"}
+
+const csrfHeader = "X-CSRF-Token"
+
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// Whether a cross-site page could send this Content-Type without a CORS
+// preflight, as an HTML form can
+func csrfSimpleContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Browsers don't check, so neither can we
+		return true
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return true
+	}
+	return false
+}
+
+// Refuse unsafe requests (POST, PUT, etc.) without a valid CSRF token,
+// sent in the csrf_field form field or an X-CSRF-Token header. By default
+// only requests another site could forge with a form are checked; set
+// csrf_enable (per route with csrf_enable:<route>) to true to check all
+// unsafe requests, or false for none. Get the token with g.CSRFToken() or
+// the csrfToken and csrfField template funcs.
+func (a *App) CSRFMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			if g.W == nil || !g.csrfRequired() {
+				return next(g)
+			}
+			token := g.R.Header.Get(csrfHeader)
+			if token == "" {
+				field, _ := g.Cfg.Get("gop", "csrf_field", "csrf_token")
+				token = g.R.PostFormValue(field)
+			}
+			if !a.csrfTokenValid(g, token) {
+				a.Stats.Inc("csrf.failed", 1)
+				g.Info("Rejecting %s [%s] from [%s] - bad CSRF token", g.R.Method, g.R.URL, g.RealRemoteIP)
+				return ErrCSRF
+			}
+			return next(g)
+		}
+	}
+}
+
+// The CSRF token to send with unsafe requests. The token is tied to a
+// random value in the client's csrf cookie, which is set if need be, so
+// call this before writing the body. Render does so for you.
+func (g *Req) CSRFToken() string {
+	if g.csrfToken != "" {
+		return g.csrfToken
+	}
+	cookieName, _ := g.Cfg.Get("gop", "csrf_cookie", "gop_csrf")
+	var seed string
+	if cookie, err := g.R.Cookie(cookieName); err == nil && len(cookie.Value) == csrfSeedLen {
+		seed = cookie.Value
+	} else {
+		buf := make([]byte, 32)
+		rand.Read(buf)
+		seed = base64.RawURLEncoding.EncodeToString(buf)
+		g.SetCookie(&http.Cookie{
+			Name:     cookieName,
+			Value:    seed,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   g.IsHTTPS,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	g.csrfToken = g.app.signCSRFSeed(seed)
+	return g.csrfToken
+}
+
+// Length of the base64 of 32 random bytes
+const csrfSeedLen = 43
+
+// The token is an HMAC of the cookie, so an attacker who can plant a cookie
+// (e.g. from a sibling subdomain) still can't make a matching token
+func (a *App) signCSRFSeed(seed string) string {
+	mac := hmac.New(sha256.New, a.csrfSecret())
+	mac.Write([]byte(seed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *App) csrfTokenValid(g *Req, token string) bool {
+	cookieName, _ := g.Cfg.Get("gop", "csrf_cookie", "gop_csrf")
+	cookie, err := g.R.Cookie(cookieName)
+	if err != nil || token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(a.signCSRFSeed(cookie.Value)))
+}
+
+// csrf_secret, or a random one for this process if it isn't set
+func (a *App) csrfSecret() []byte {
+	if secret, _ := a.Cfg.Get("gop", "csrf_secret", ""); secret != "" {
+		return []byte(secret)
+	}
+	a.csrfSecretOnce.Do(func() {
+		a.Error("No csrf_secret set - CSRF tokens won't survive a restart or work across instances")
+		a.randomCSRFSecret = make([]byte, 32)
+		rand.Read(a.randomCSRFSecret)
+	})
+	return a.randomCSRFSecret
+}
+
+// Template funcs for the CSRF token: {{csrfToken}} for the bare token
+// (e.g. for a meta tag read by scripts) and {{csrfField}} for a hidden
+// form input.
+func (g *Req) csrfTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": g.CSRFToken,
+		"csrfField": func() template.HTML {
+			field, _ := g.Cfg.Get("gop", "csrf_field", "csrf_token")
+			return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(field) +
+				`" value="` + g.CSRFToken() + `">`)
+		},
+	}
+}
+
+// csrf_enable settings
+const (
+	csrfOff   = "false"
+	csrfForms = "forms" // Only requests with form-like bodies
+	csrfAll   = "true"
+)
+
+// The request's route's csrf_enable setting
+func (g *Req) csrfMode() string {
+	mode := g.routeSetting("csrf_enable", csrfForms)
+	if mode == csrfForms {
+		return mode
+	}
+	enabled, err := strconv.ParseBool(mode)
+	if err != nil {
+		g.Error("Bad csrf_enable [%s] - checking forms only", mode)
+		return csrfForms
+	}
+	if enabled {
+		return csrfAll
+	}
+	return csrfOff
+}
+
+// Whether the request needs a CSRF token
+func (g *Req) csrfRequired() bool {
+	if csrfSafeMethod(g.R.Method) {
+		return false
+	}
+	switch g.csrfMode() {
+	case csrfAll:
+		return true
+	case csrfForms:
+		return csrfSimpleContentType(g.R.Header.Get("Content-Type"))
+	}
+	return false
+}
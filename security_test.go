@@ -0,0 +1,171 @@
+package gop
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	a, srv := newTestApp(t, "security")
+	for _, kv := range [][2]string{
+		{"trusted_proxies", "127.0.0.1"},
+		{"hsts_max_age", "24h"},
+		{"hsts_include_subdomains", "true"},
+		{"content_security_policy", "default-src 'self'"},
+		{"frame_options:/embed", ""},
+		{"referrer_policy:/embed", "no-referrer"},
+	} {
+		a.Cfg.TransientOverride("gop", kv[0], kv[1])
+	}
+	a.HandleFunc("/page", func(g *Req) error {
+		return g.SendText([]byte("page"))
+	})
+	a.HandleFunc("/embed", func(g *Req) error {
+		return g.SendText([]byte("embed"))
+	})
+	a.HandleFunc("/own", func(g *Req) error {
+		g.W.Header().Set("X-Frame-Options", "DENY")
+		return g.SendText([]byte("own"))
+	})
+
+	tests := []struct {
+		path  string
+		https bool
+		want  map[string]string
+	}{
+		{"/page", false, map[string]string{
+			"Strict-Transport-Security": "",
+			"Content-Security-Policy":   "default-src 'self'",
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "SAMEORIGIN",
+			"Referrer-Policy":           "strict-origin-when-cross-origin",
+		}},
+		{"/page", true, map[string]string{
+			"Strict-Transport-Security": "max-age=86400; includeSubDomains",
+		}},
+		{"/embed", false, map[string]string{
+			"X-Frame-Options": "",
+			"Referrer-Policy": "no-referrer",
+		}},
+		{"/own", false, map[string]string{
+			"X-Frame-Options": "DENY",
+		}},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		if test.https {
+			req.Header.Set("X-Forwarded-For", "1.2.3.4")
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		resp.Body.Close()
+		for name, want := range test.want {
+			if got := resp.Header.Get(name); got != want {
+				t.Errorf("%s (HTTPS %v): %s %q, want %q", test.path, test.https, name, got, want)
+			}
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	a, srv := newTestApp(t, "security")
+	a.Cfg.TransientOverride("gop", "csrf_secret", "sssh")
+	a.Cfg.TransientOverride("gop", "csrf_enable:/all", "true")
+	a.Cfg.TransientOverride("gop", "csrf_enable:/none", "false")
+	a.HandleFunc("/token", func(g *Req) error {
+		return g.SendText([]byte(g.CSRFToken()))
+	})
+	for _, path := range []string{"/forms", "/all", "/none"} {
+		a.HandleFunc(path, func(g *Req) error {
+			return g.SendText([]byte("ok"))
+		})
+	}
+
+	resp, err := http.Get(srv.URL + "/token")
+	if err != nil {
+		t.Fatalf("GET /token: %s", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	token := string(data)
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "gop_csrf" || !cookies[0].HttpOnly {
+		t.Fatalf("Got cookies %v, want an HttpOnly gop_csrf", cookies)
+	}
+	cookie := cookies[0]
+
+	form := func(token string) string { return url.Values{"csrf_token": {token}, "name": {"bob"}}.Encode() }
+	tests := []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		header      string // X-CSRF-Token
+		cookie      bool
+		code        int
+	}{
+		{"GET", "/forms", "", "", "", false, http.StatusOK},
+		{"POST", "/forms", "application/x-www-form-urlencoded", form(token), "", true, http.StatusOK},
+		{"POST", "/forms", "application/x-www-form-urlencoded", "name=bob", token, true, http.StatusOK},
+		{"POST", "/forms", "application/x-www-form-urlencoded", "name=bob", "", true, http.StatusForbidden},
+		{"POST", "/forms", "application/x-www-form-urlencoded", form("forged"), "", true, http.StatusForbidden},
+		// The token is only good with its cookie
+		{"POST", "/forms", "application/x-www-form-urlencoded", form(token), "", false, http.StatusForbidden},
+		{"POST", "/forms", "multipart/form-data; boundary=x", "--x--\r\n", "", true, http.StatusForbidden},
+		{"POST", "/forms", "text/plain; charset=utf-8", "hi", "", true, http.StatusForbidden},
+		{"DELETE", "/forms", "", "", "", true, http.StatusForbidden},
+		// Cross-site pages can't send JSON without a CORS preflight
+		{"POST", "/forms", "application/json", "{}", "", true, http.StatusOK},
+		{"POST", "/all", "application/json", "{}", "", true, http.StatusForbidden},
+		{"POST", "/all", "application/json", "{}", token, true, http.StatusOK},
+		{"POST", "/none", "application/x-www-form-urlencoded", "name=bob", "", false, http.StatusOK},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, srv.URL+test.path, strings.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		if test.header != "" {
+			req.Header.Set("X-CSRF-Token", test.header)
+		}
+		if test.cookie {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", test.method, test.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s %s %q %q (header %q, cookie %v): got %d, want %d", test.method, test.path,
+				test.contentType, test.body, test.header, test.cookie, resp.StatusCode, test.code)
+		}
+	}
+}
+
+func TestCSRFSimpleContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"", true},
+		{"application/x-www-form-urlencoded", true},
+		{"Multipart/Form-Data; boundary=x", true},
+		{"text/plain;charset=UTF-8", true},
+		{"not a type;;", true},
+		{"application/json", false},
+		{"application/vnd.api+json", false},
+		{"text/html", false},
+	}
+	for _, test := range tests {
+		if got := csrfSimpleContentType(test.contentType); got != test.want {
+			t.Errorf("csrfSimpleContentType(%q) = %v, want %v", test.contentType, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package gop
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Register f to be called as connections change state (see
+// http.Server.ConnState), e.g. to track idle connections. Call before Run.
+func (a *App) OnConnState(f func(net.Conn, http.ConnState)) {
+	a.connStateHooksMu.Lock()
+	defer a.connStateHooksMu.Unlock()
+	a.connStateHooks = append(a.connStateHooks, f)
+}
+
+// Build an http.Server for h from the http_* config. Settings are read
+// once, as the listener starts serving.
+func (a *App) newHTTPServer(h http.Handler) *http.Server {
+	readTimeout, _ := a.Cfg.GetDuration("gop", "http_read_timeout", 0)
+	readHeaderTimeout, _ := a.Cfg.GetDuration("gop", "http_read_header_timeout", 10*time.Second)
+	writeTimeout, _ := a.Cfg.GetDuration("gop", "http_write_timeout", 0)
+	idleTimeout, _ := a.Cfg.GetDuration("gop", "http_idle_timeout", 120*time.Second)
+	maxHeaderBytes, _ := a.Cfg.GetInt("gop", "http_max_header_bytes", http.DefaultMaxHeaderBytes)
+	keepAlive, _ := a.Cfg.GetBool("gop", "http_keepalive", true)
+	enableHTTP2, _ := a.Cfg.GetBool("gop", "http2_enable", true)
+	enableH2C, _ := a.Cfg.GetBool("gop", "h2c_enable", false)
+
+	handler := proxyRemoteAddr(h)
+	if enableH2C {
+		// HTTP/2 without TLS, by upgrade or prior knowledge. TLS
+		// connections negotiate HTTP/2 in the handshake instead.
+		plain := handler
+		h2cHandler := h2c.NewHandler(plain, &http2.Server{IdleTimeout: idleTimeout})
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				plain.ServeHTTP(w, r)
+				return
+			}
+			h2cHandler.ServeHTTP(w, r)
+		})
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		ErrorLog:          log.New(serverErrorLog{a}, "", 0),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	if !enableHTTP2 {
+		// tls.go doesn't offer "h2" either, but a non-nil map stops
+		// net/http setting HTTP/2 up for us
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	srv.SetKeepAlivesEnabled(keepAlive)
+
+	a.connStateHooksMu.Lock()
+	hooks := a.connStateHooks
+	a.connStateHooksMu.Unlock()
+	if len(hooks) > 0 {
+		srv.ConnState = func(c net.Conn, state http.ConnState) {
+			for _, hook := range hooks {
+				hook(c, state)
+			}
+		}
+	}
+	return srv
+}
+
+// Sends net/http's own errors (bad requests, TLS handshake failures,
+// handler panics outside gop) to the gop log
+type serverErrorLog struct {
+	logger Logger
+}
+
+func (l serverErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.Contains(msg, "TLS handshake error") {
+		// Usually scanners and clients hanging up, so too noisy for ERROR
+		l.logger.Debug("%s", msg)
+	} else {
+		l.logger.Error("%s", msg)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,161 @@
+package gop
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestNewHTTPServer(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides []string
+		check     func(srv *http.Server) error
+	}{
+		{"defaults", nil, func(srv *http.Server) error {
+			if srv.ReadTimeout != 0 || srv.ReadHeaderTimeout != 10*time.Second || srv.WriteTimeout != 0 ||
+				srv.IdleTimeout != 120*time.Second || srv.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+				return fmt.Errorf("got %v %v %v %v %d", srv.ReadTimeout, srv.ReadHeaderTimeout,
+					srv.WriteTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+			}
+			if srv.TLSNextProto != nil || srv.ConnState != nil {
+				return fmt.Errorf("HTTP/2 or ConnState set up unasked")
+			}
+			return nil
+		}},
+		{"timeouts", []string{"http_read_timeout", "5s", "http_read_header_timeout", "2s", "http_write_timeout", "30s",
+			"http_idle_timeout", "1m", "http_max_header_bytes", "4096"}, func(srv *http.Server) error {
+			if srv.ReadTimeout != 5*time.Second || srv.ReadHeaderTimeout != 2*time.Second || srv.WriteTimeout != 30*time.Second ||
+				srv.IdleTimeout != time.Minute || srv.MaxHeaderBytes != 4096 {
+				return fmt.Errorf("got %v %v %v %v %d", srv.ReadTimeout, srv.ReadHeaderTimeout,
+					srv.WriteTimeout, srv.IdleTimeout, srv.MaxHeaderBytes)
+			}
+			return nil
+		}},
+		{"no HTTP/2", []string{"http2_enable", "false"}, func(srv *http.Server) error {
+			if srv.TLSNextProto == nil || len(srv.TLSNextProto) != 0 {
+				return fmt.Errorf("TLSNextProto %v, want empty", srv.TLSNextProto)
+			}
+			return nil
+		}},
+	}
+	for _, test := range tests {
+		a := InitCmd("gop_test", "server")
+		for i := 0; i+1 < len(test.overrides); i += 2 {
+			a.Cfg.TransientOverride("gop", test.overrides[i], test.overrides[i+1])
+		}
+		if err := test.check(a.newHTTPServer(http.NotFoundHandler())); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+}
+
+// Serve h with the app's server settings, returning the address
+func serveTestHTTP(t *testing.T, a *App, h http.Handler) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	srv := a.newHTTPServer(h)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+func TestH2C(t *testing.T) {
+	proto := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	// Speaks HTTP/2 with prior knowledge, as proxies such as envoy do
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	for _, enabled := range []bool{true, false} {
+		a := InitCmd("gop_test", "server")
+		a.Cfg.TransientOverride("gop", "h2c_enable", fmt.Sprint(enabled))
+		addr := serveTestHTTP(t, a, proto)
+
+		code, body := getBody(t, "http://"+addr+"/")
+		if code != http.StatusOK || body != "HTTP/1.1" {
+			t.Errorf("h2c_enable %v: HTTP/1.1 client got %d %q", enabled, code, body)
+		}
+		resp, err := client.Get("http://" + addr + "/")
+		if !enabled {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("h2c_enable false: HTTP/2 client got %d", resp.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("h2c_enable true: %s", err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(data) != "HTTP/2.0" {
+			t.Errorf("h2c_enable true: HTTP/2 client got %q", data)
+		}
+	}
+}
+
+func TestConnStateHooks(t *testing.T) {
+	a := InitCmd("gop_test", "server")
+	states := make(chan http.ConnState, 10)
+	a.OnConnState(func(c net.Conn, state http.ConnState) { states <- state })
+	addr := serveTestHTTP(t, a, http.NotFoundHandler())
+
+	getBody(t, "http://"+addr+"/")
+	if state := <-states; state != http.StateNew {
+		t.Errorf("First state %v, want %v", state, http.StateNew)
+	}
+}
+
+// Records what's logged at DEBUG and ERROR
+type recordingLogger struct {
+	Logger
+	debug, errors []string
+}
+
+func (l *recordingLogger) Debug(arg0 interface{}, args ...interface{}) {
+	l.debug = append(l.debug, fmt.Sprintf(arg0.(string), args...))
+}
+
+func (l *recordingLogger) Error(arg0 interface{}, args ...interface{}) error {
+	l.errors = append(l.errors, fmt.Sprintf(arg0.(string), args...))
+	return nil
+}
+
+func TestServerErrorLog(t *testing.T) {
+	tests := []struct {
+		line  string
+		error bool
+	}{
+		{"http: TLS handshake error from 1.2.3.4:5678: EOF\n", false},
+		{"http: panic serving 1.2.3.4:5678: oops\n", true},
+		{"http: Accept error: too many open files; retrying in 5ms\n", true},
+	}
+	for _, test := range tests {
+		logger := &recordingLogger{}
+		n, err := serverErrorLog{logger}.Write([]byte(test.line))
+		if n != len(test.line) || err != nil {
+			t.Errorf("Write(%q) = %d, %v", test.line, n, err)
+		}
+		got, other := logger.debug, logger.errors
+		if test.error {
+			got, other = other, got
+		}
+		if len(got) != 1 || len(other) != 0 || got[0]+"\n" != test.line {
+			t.Errorf("%q: logged %q at DEBUG, %q at ERROR", test.line, logger.debug, logger.errors)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+package gop
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a SessionStore keeps for a session
+type SessionData struct {
+	ID      string // Random, and replaced when the session is rotated
+	Values  map[string]interface{}
+	Created time.Time
+	Renewed time.Time // When the ID was last issued
+	Expires time.Time
+	// Set on a session rotated out by session_rotate: the cookie value of
+	// its replacement, which requests still carrying the old cookie get
+	ReplacedBy string `json:",omitempty"`
+	Stale      bool   `json:"-"` // Set by Load to have the session saved again, e.g. as it's under an old key
+}
+
+// Keeps session data between requests. The cookie value is whatever the
+// store needs to find the session again: its ID for server-side stores,
+// or the data itself for the cookie store.
+type SessionStore interface {
+	// Get the session for a cookie value, or nil if there isn't one
+	Load(cookie string) (*SessionData, error)
+	// Store the session, returning the cookie value to send
+	Save(data *SessionData) (string, error)
+	// Forget the session for a cookie value, so it no longer loads. Stores
+	// without server-side state may not be able to.
+	Delete(cookie string) error
+}
+
+// Use store for sessions in place of the session_store config
+func (a *App) SetSessionStore(store SessionStore) {
+	a.sessionStoreMu.Lock()
+	defer a.sessionStoreMu.Unlock()
+	a.sessionStore = store
+	a.sessionStoreSet = true
+}
+
+// The store to use, rebuilt if its config changes
+func (a *App) getSessionStore() (SessionStore, error) {
+	a.sessionStoreMu.Lock()
+	defer a.sessionStoreMu.Unlock()
+	if a.sessionStoreSet {
+		return a.sessionStore, nil
+	}
+	kind, _ := a.Cfg.Get("gop", "session_store", "cookie")
+	key := kind
+	switch kind {
+	case "cookie":
+		keys, _ := a.Cfg.Get("gop", "session_keys", "")
+		key += "|" + keys
+	case "memory":
+	case "file":
+		dir, _ := a.Cfg.Get("gop", "session_dir", filepath.Join(os.TempDir(), a.ProjectName+"-"+a.AppName+"-sessions"))
+		key += "|" + dir
+	default:
+		return nil, fmt.Errorf("unknown session_store [%s]", kind)
+	}
+	if a.sessionStore != nil && key == a.sessionStoreKey {
+		return a.sessionStore, nil
+	}
+
+	var store SessionStore
+	switch kind {
+	case "cookie":
+		store = NewCookieSessionStore(a.sessionKeys()...)
+	case "memory":
+		store = NewMemorySessionStore()
+	case "file":
+		fileStore, err := NewFileSessionStore(strings.TrimPrefix(key, "file|"))
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	}
+	a.sessionStore = store
+	a.sessionStoreKey = key
+	return store, nil
+}
+
+// session_keys, or a random one for this process if it isn't set
+func (a *App) sessionKeys() [][]byte {
+	var keys [][]byte
+	secrets, _ := a.Cfg.Get("gop", "session_keys", "")
+	for _, secret := range splitList(secrets) {
+		keys = append(keys, []byte(secret))
+	}
+	if len(keys) > 0 {
+		return keys
+	}
+	a.sessionKeyOnce.Do(func() {
+		a.Error("No session_keys set - cookie sessions won't survive a restart or work across instances")
+		a.randomSessionKey = make([]byte, 32)
+		rand.Read(a.randomSessionKey)
+	})
+	return [][]byte{a.randomSessionKey}
+}
+
+// A client's session. Values must be JSON-encodable, and come back from
+// the store as JSON decodes them (so numbers are float64 - see GetInt).
+// Changes are saved as the response headers are sent.
+type Session struct {
+	g         *Req
+	mu        sync.Mutex
+	data      *SessionData
+	cookie    string // As sent by the client
+	dirty     bool
+	rotate    bool
+	keepOld   bool // Rotating on schedule, so the old ID still works for a while
+	destroyed bool
+	saved     bool
+}
+
+// The client's session, loaded on first use. Changes made after the
+// response headers have been sent are lost.
+func (g *Req) Session() *Session {
+	if g.session != nil {
+		return g.session
+	}
+	s := &Session{g: g}
+	g.session = s
+	now := time.Now()
+
+	store, err := g.app.getSessionStore()
+	if err != nil {
+		g.Error("Can't get session store: %s", err.Error())
+	}
+	cookieName, _ := g.Cfg.Get("gop", "session_cookie", "gop_session")
+	if cookie, cookieErr := g.R.Cookie(cookieName); cookieErr == nil && cookie.Value != "" && store != nil {
+		s.cookie = cookie.Value
+		data, err := store.Load(cookie.Value)
+		if err == nil && data != nil && data.ReplacedBy != "" && now.Before(data.Expires) {
+			// Sent before the client got the rotated cookie, e.g. by a
+			// parallel request
+			s.cookie = data.ReplacedBy
+			data, err = store.Load(data.ReplacedBy)
+		}
+		if err != nil {
+			g.Error("Can't load session: %s", err.Error())
+		} else if data != nil && data.ReplacedBy == "" && now.Before(data.Expires) {
+			s.data = data
+			s.dirty = data.Stale
+		}
+	}
+	if s.data == nil {
+		s.data = &SessionData{Values: make(map[string]interface{}), Created: now}
+		// Send the client a new session or, if nothing is set, an expired cookie
+		s.destroyed = s.cookie != ""
+	} else if rotate, _ := g.Cfg.GetDuration("gop", "session_rotate", time.Hour); rotate > 0 && now.Sub(s.data.Renewed) > rotate {
+		s.rotate = true
+		s.keepOld = true
+	}
+	if s.data.Values == nil {
+		s.data.Values = make(map[string]interface{})
+	}
+	if g.W != nil {
+		g.W.beforeHeader(s.save)
+	}
+	return s
+}
+
+// The session's ID, or "" if it hasn't been saved yet
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.ID
+}
+
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data.Values[key]
+	return v, ok
+}
+
+func (s *Session) GetString(key string) string {
+	v, _ := s.Get(key)
+	str, _ := v.(string)
+	return str
+}
+
+// Gets numbers set in this request or decoded from the store
+func (s *Session) GetInt(key string) int {
+	v, _ := s.Get(key)
+	switch n := v.(type) {
+	case int:
+		return n
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+func (s *Session) Set(key string, v interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Values[key] = v
+	s.changed()
+}
+
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Values[key]; ok {
+		delete(s.data.Values, key)
+		s.changed()
+	}
+}
+
+// Give the session a new ID, keeping its values. Do this when a user logs
+// in, so a session ID planted by an attacker is no use to them. With the
+// cookie store the old cookie still loads (with the old values) until it
+// expires, as there's nowhere to record that it was replaced.
+func (s *Session) Rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate = true
+	s.keepOld = false
+	s.changed()
+}
+
+// End the session, e.g. on logout. Anything Set afterwards goes in a new
+// session. The client is told to drop the cookie, but with the cookie store
+// a copy kept elsewhere still loads until it expires; use a server-side
+// store if sessions must be revocable.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = &SessionData{Values: make(map[string]interface{}), Created: time.Now()}
+	s.destroyed = true
+	s.dirty = false
+	s.rotate = false
+	if s.saved {
+		s.g.Error("Session destroyed after the response headers were sent - the client keeps it")
+	}
+}
+
+// Must hold s.mu
+func (s *Session) changed() {
+	s.dirty = true
+	if s.saved {
+		s.g.Error("Session changed after the response headers were sent - the change is lost")
+	}
+}
+
+// Called as the response headers are sent
+func (s *Session) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = true
+	g := s.g
+	if !s.dirty && !s.rotate && !s.destroyed {
+		return
+	}
+	store, err := g.app.getSessionStore()
+	if err != nil {
+		g.Error("Can't get session store: %s", err.Error())
+		return
+	}
+	cookieName, _ := g.Cfg.Get("gop", "session_cookie", "gop_session")
+	grace, _ := g.Cfg.GetDuration("gop", "session_rotate_grace", 30*time.Second)
+	oldID := ""
+	if s.cookie != "" && (s.destroyed || s.rotate) {
+		if s.destroyed || !s.keepOld || grace <= 0 {
+			if err := store.Delete(s.cookie); err != nil {
+				g.Error("Can't delete session: %s", err.Error())
+			}
+		} else {
+			// Replaced below, once we have the new cookie
+			oldID = s.data.ID
+		}
+		s.data.ID = ""
+	}
+	if !s.dirty && !s.rotate {
+		if s.cookie != "" {
+			g.ClearCookie(cookieName, "/")
+		}
+		return
+	}
+
+	now := time.Now()
+	lifetime, _ := g.Cfg.GetDuration("gop", "session_lifetime", 24*time.Hour)
+	if s.data.ID == "" {
+		s.data.ID = newSessionID()
+		s.data.Renewed = now
+	}
+	s.data.Expires = now.Add(lifetime)
+	value, err := store.Save(s.data)
+	if err != nil {
+		g.Error("Can't save session: %s", err.Error())
+		return
+	}
+	if oldID != "" {
+		// Requests sent with the old cookie before this response arrives
+		// get the new session
+		_, err := store.Save(&SessionData{ID: oldID, Expires: now.Add(grace), ReplacedBy: value})
+		if err != nil {
+			g.Error("Can't save rotated-out session: %s", err.Error())
+		}
+	}
+	g.SetCookie(&http.Cookie{
+		Name:     cookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  s.data.Expires,
+		MaxAge:   int(lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   g.IsHTTPS,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Sessions are saved as the response headers are sent. This sends them
+// for handlers which return without writing anything.
+func (a *App) SessionMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			err := next(g)
+			if err == nil && g.session != nil && g.W != nil {
+				g.W.sendHeader()
+			}
+			return err
+		}
+	}
+}
+
+func newSessionID() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func validSessionID(id string) bool {
+	if len(id) != 43 {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil
+}
+
+// Keeps the whole session in the cookie, encrypted and authenticated with
+// AES-GCM, so needs no server-side state. Values are limited to what fits
+// in a 4KB cookie. With no state, sessions can't be revoked: a cookie
+// stays valid until it expires, even after Destroy or Rotate.
+type cookieSessionStore struct {
+	aeads []cipher.AEAD
+}
+
+// Sessions are encrypted with the first key. The rest are still accepted,
+// so keys can be rotated by putting a new one first. Sessions under old
+// keys are re-encrypted as they're used.
+func NewCookieSessionStore(keys ...[]byte) SessionStore {
+	s := &cookieSessionStore{}
+	for _, key := range keys {
+		// Keys of any length are stretched to AES-256
+		sum := sha256.Sum256(append([]byte("gop-session:"), key...))
+		block, _ := aes.NewCipher(sum[:])
+		aead, _ := cipher.NewGCM(block)
+		s.aeads = append(s.aeads, aead)
+	}
+	return s
+}
+
+// Binds the ciphertext to its purpose, so other values encrypted with the
+// same key can't be passed off as sessions
+var cookieSessionAD = []byte("gop-session")
+
+// Cookies over this are dropped by browsers
+const maxSessionCookieLen = 4000
+
+func (s *cookieSessionStore) Load(cookie string) (*SessionData, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil {
+		return nil, nil
+	}
+	for i, aead := range s.aeads {
+		if len(sealed) < aead.NonceSize() {
+			return nil, nil
+		}
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], cookieSessionAD)
+		if err != nil {
+			continue
+		}
+		data := &SessionData{}
+		if err := json.Unmarshal(plain, data); err != nil {
+			return nil, err
+		}
+		data.Stale = i > 0
+		return data, nil
+	}
+	// Tampered with, or under a key we no longer have
+	return nil, nil
+}
+
+func (s *cookieSessionStore) Save(data *SessionData) (string, error) {
+	if len(s.aeads) == 0 {
+		return "", errors.New("no session keys")
+	}
+	plain, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	value := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, cookieSessionAD))
+	if len(value) > maxSessionCookieLen {
+		return "", fmt.Errorf("session too big for a cookie (%d bytes)", len(value))
+	}
+	return value, nil
+}
+
+// Nothing we can do - the cookie carries the whole session, so it loads
+// until it expires (or its key is dropped from session_keys)
+func (s *cookieSessionStore) Delete(cookie string) error {
+	return nil
+}
+
+// How often server-side stores clear out expired sessions
+const sessionSweepInterval = 10 * time.Minute
+
+type memorySession struct {
+	data    []byte
+	expires time.Time
+}
+
+// Keeps sessions in memory, so they're lost on restart and not shared
+// between instances
+type memorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]memorySession), lastSweep: time.Now()}
+}
+
+func (s *memorySessionStore) Load(cookie string) (*SessionData, error) {
+	s.mu.Lock()
+	session, ok := s.sessions[cookie]
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	// Stored encoded, so values behave as they would with other stores
+	data := &SessionData{}
+	return data, json.Unmarshal(session.data, data)
+}
+
+func (s *memorySessionStore) Save(data *SessionData) (string, error) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[data.ID] = memorySession{data: buf, expires: data.Expires}
+	if now.Sub(s.lastSweep) > sessionSweepInterval {
+		s.lastSweep = now
+		for id, session := range s.sessions {
+			if now.After(session.expires) {
+				delete(s.sessions, id)
+			}
+		}
+	}
+	return data.ID, nil
+}
+
+func (s *memorySessionStore) Delete(cookie string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, cookie)
+	return nil
+}
+
+// Keeps each session in a file under dir, so they survive restarts and
+// can be shared by instances on the same host
+type fileSessionStore struct {
+	dir       string
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func NewFileSessionStore(dir string) (SessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileSessionStore{dir: dir, lastSweep: time.Now()}, nil
+}
+
+func (s *fileSessionStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *fileSessionStore) Load(cookie string) (*SessionData, error) {
+	// The cookie is a filename, so must be checked
+	if !validSessionID(cookie) {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(s.path(cookie))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := &SessionData{}
+	return data, json.Unmarshal(buf, data)
+}
+
+func (s *fileSessionStore) Save(data *SessionData) (string, error) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	// Written whole then renamed, so readers never see part of a session
+	tmp, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(buf)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path(data.ID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	s.mu.Lock()
+	sweep := time.Since(s.lastSweep) > sessionSweepInterval
+	if sweep {
+		s.lastSweep = time.Now()
+	}
+	s.mu.Unlock()
+	if sweep {
+		go s.sweep()
+	}
+	return data.ID, nil
+}
+
+func (s *fileSessionStore) Delete(cookie string) error {
+	if !validSessionID(cookie) {
+		return nil
+	}
+	err := os.Remove(s.path(cookie))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Remove expired sessions
+func (s *fileSessionStore) sweep() {
+	paths, _ := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	now := time.Now()
+	for _, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		data := &SessionData{}
+		if json.Unmarshal(buf, data) != nil || now.After(data.Expires) {
+			os.Remove(path)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package gop
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreRoundTrip(t *testing.T) {
+	fileStore, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileSessionStore: %s", err)
+	}
+	stores := []struct {
+		name      string
+		store     SessionStore
+		revocable bool
+	}{
+		{"cookie", NewCookieSessionStore([]byte("key")), false},
+		{"memory", NewMemorySessionStore(), true},
+		{"file", fileStore, true},
+	}
+	now := time.Now().Truncate(time.Second)
+	for _, test := range stores {
+		data := &SessionData{
+			ID:      newSessionID(),
+			Values:  map[string]interface{}{"user": "bob", "n": 3},
+			Created: now.Add(-time.Hour),
+			Renewed: now,
+			Expires: now.Add(time.Hour),
+		}
+		cookie, err := test.store.Save(data)
+		if err != nil {
+			t.Fatalf("%s: Save: %s", test.name, err)
+		}
+		got, err := test.store.Load(cookie)
+		if err != nil || got == nil {
+			t.Fatalf("%s: Load = %v, %v", test.name, got, err)
+		}
+		// Values come back as JSON decodes them
+		wantValues := map[string]interface{}{"user": "bob", "n": float64(3)}
+		if got.ID != data.ID || !reflect.DeepEqual(got.Values, wantValues) ||
+			!got.Created.Equal(data.Created) || !got.Renewed.Equal(data.Renewed) || !got.Expires.Equal(data.Expires) {
+			t.Errorf("%s: Load = %+v, want %+v", test.name, got, data)
+		}
+		if got.Stale {
+			t.Errorf("%s: fresh session loaded as stale", test.name)
+		}
+
+		if got, err := test.store.Load("garbage"); got != nil || err != nil {
+			t.Errorf("%s: Load(garbage) = %v, %v", test.name, got, err)
+		}
+
+		err = test.store.Delete(cookie)
+		if err != nil {
+			t.Errorf("%s: Delete: %s", test.name, err)
+		}
+		got, _ = test.store.Load(cookie)
+		if test.revocable && got != nil {
+			t.Errorf("%s: session still loads after Delete", test.name)
+		}
+		// The documented limitation of the cookie store
+		if !test.revocable && got == nil {
+			t.Errorf("%s: expected the cookie to load until it expires", test.name)
+		}
+	}
+}
+
+func TestCookieSessionStoreKeys(t *testing.T) {
+	data := &SessionData{ID: newSessionID(), Values: map[string]interface{}{"a": "b"}}
+	cookie, err := NewCookieSessionStore([]byte("old")).Save(data)
+	if err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	got, err := NewCookieSessionStore([]byte("new"), []byte("old")).Load(cookie)
+	if err != nil || got == nil || got.ID != data.ID {
+		t.Fatalf("Load under a retired key = %v, %v", got, err)
+	}
+	if !got.Stale {
+		t.Errorf("Session under a retired key not marked stale")
+	}
+	if got, _ := NewCookieSessionStore([]byte("new")).Load(cookie); got != nil {
+		t.Errorf("Session under a dropped key still loads")
+	}
+
+	tampered := []byte(cookie)
+	tampered[len(tampered)/2] ^= 1
+	if got, _ := NewCookieSessionStore([]byte("old")).Load(string(tampered)); got != nil {
+		t.Errorf("Tampered session loads")
+	}
+}
+
+func TestSessionRotateAndDestroy(t *testing.T) {
+	a, srv := newTestApp(t, "sessions")
+	a.SetSessionStore(NewMemorySessionStore())
+	a.HandleFunc("/login", func(g *Req) error {
+		s := g.Session()
+		s.Rotate()
+		s.Set("user", "bob")
+		return nil
+	})
+	a.HandleFunc("/whoami", func(g *Req) error {
+		g.SendText([]byte(g.Session().GetString("user")))
+		return nil
+	})
+	a.HandleFunc("/logout", func(g *Req) error {
+		g.Session().Destroy()
+		return nil
+	})
+
+	// Returns the body and the session cookie sent back, if any
+	get := func(path, cookie string) (string, *http.Cookie) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "gop_session", Value: cookie})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		for _, c := range resp.Cookies() {
+			if c.Name == "gop_session" {
+				return strings.TrimSpace(string(body)), c
+			}
+		}
+		return strings.TrimSpace(string(body)), nil
+	}
+
+	_, c1 := get("/login", "")
+	if c1 == nil || c1.Value == "" {
+		t.Fatalf("No session cookie from /login")
+	}
+	if user, _ := get("/whoami", c1.Value); user != "bob" {
+		t.Errorf("whoami = %q, want bob", user)
+	}
+
+	_, c2 := get("/login", c1.Value)
+	if c2 == nil || c2.Value == c1.Value {
+		t.Fatalf("Session not rotated on login: %v", c2)
+	}
+	if user, _ := get("/whoami", c1.Value); user != "" {
+		t.Errorf("Rotated-out session still has user %q", user)
+	}
+	if user, _ := get("/whoami", c2.Value); user != "bob" {
+		t.Errorf("Rotated session lost its values: user %q", user)
+	}
+
+	_, cleared := get("/logout", c2.Value)
+	if cleared == nil || cleared.MaxAge >= 0 {
+		t.Errorf("Logout didn't clear the cookie: %v", cleared)
+	}
+	if user, _ := get("/whoami", c2.Value); user != "" {
+		t.Errorf("Destroyed session still has user %q", user)
+	}
+}
+
+func TestSessionRotateGrace(t *testing.T) {
+	for _, grace := range []string{"30s", "0s"} {
+		a, srv := newTestApp(t, "sessions")
+		a.Cfg.TransientOverride("gop", "session_rotate_grace", grace)
+		store := NewMemorySessionStore()
+		a.SetSessionStore(store)
+		a.HandleFunc("/whoami", func(g *Req) error {
+			return g.SendText([]byte(g.Session().GetString("user")))
+		})
+		a.HandleFunc("/visit", func(g *Req) error {
+			s := g.Session()
+			s.Set("visits", s.GetInt("visits")+1)
+			return nil
+		})
+
+		// Due for rotation
+		now := time.Now()
+		oldID := newSessionID()
+		store.Save(&SessionData{ID: oldID, Values: map[string]interface{}{"user": "bob"},
+			Renewed: now.Add(-2 * time.Hour), Expires: now.Add(time.Hour)})
+
+		get := func(path, cookie string) (string, string) {
+			req, _ := http.NewRequest("GET", srv.URL+path, nil)
+			req.AddCookie(&http.Cookie{Name: "gop_session", Value: cookie})
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s: %s", path, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			for _, c := range resp.Cookies() {
+				if c.Name == "gop_session" {
+					return string(body), c.Value
+				}
+			}
+			return string(body), ""
+		}
+
+		user, newID := get("/whoami", oldID)
+		if user != "bob" || newID == "" || newID == oldID {
+			t.Fatalf("grace %s: got %q with cookie %q, want bob with a new one", grace, user, newID)
+		}
+		user, cookie := get("/whoami", oldID)
+		if grace == "0s" {
+			if user != "" {
+				t.Errorf("grace 0s: old ID still loads user %q", user)
+			}
+			continue
+		}
+		// The old ID leads to the new session, which isn't rotated again
+		if user != "bob" || cookie != "" {
+			t.Errorf("grace %s: old ID got %q with cookie %q, want bob and no cookie", grace, user, cookie)
+		}
+		if _, cookie := get("/visit", oldID); cookie != newID {
+			t.Errorf("grace %s: change with the old ID saved under %q, want %q", grace, cookie, newID)
+		}
+		data, _ := store.Load(newID)
+		if data == nil || data.Values["visits"] != float64(1) {
+			t.Errorf("grace %s: change with the old ID was lost: %+v", grace, data)
+		}
+
+		// Once the grace period is up, the old ID is no good
+		stub, _ := store.Load(oldID)
+		stub.Expires = now.Add(-time.Second)
+		store.Save(stub)
+		if user, _ := get("/whoami", oldID); user != "" {
+			t.Errorf("grace %s: old ID loads user %q after the grace period", grace, user)
+		}
+	}
+}
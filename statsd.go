@@ -1,8 +1,10 @@
 package gop
 
 import (
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/cactus/go-statsd-client/statsd"
 )
@@ -33,6 +35,14 @@ func (a *App) initStatsd() {
 	}
 }
 
+// Return a copy of the client which sends at the given sample rate
+// rather than the global statsd_rate, e.g. g.Stats.WithRate(0.1).Inc("hits", 1)
+func (s *StatsdClient) WithRate(rate float32) *StatsdClient {
+	c := *s
+	c.rate = rate
+	return &c
+}
+
 func (s *StatsdClient) Dec(stat string, value int64) {
 	s.app.Debug("STATSD DEC %s %d", stat, value)
 	_ = s.client.Dec(stat, value, s.rate)
@@ -57,3 +67,35 @@ func (s *StatsdClient) Timing(stat string, delta int64) {
 	s.app.Debug("STATSD TIMING %s %d", stat, delta)
 	_ = s.client.Timing(stat, delta, s.rate)
 }
+
+func (s *StatsdClient) TimingDuration(stat string, delta time.Duration) {
+	s.Timing(stat, int64(delta/time.Millisecond))
+}
+
+// Start a timer, returning a func which records the elapsed time when called.
+// Intended for use with defer:
+//
+//	defer g.Stats.Time("db.query")()
+func (s *StatsdClient) Time(stat string) func() {
+	start := time.Now()
+	return func() {
+		s.TimingDuration(stat, time.Since(start))
+	}
+}
+
+// Run f, recording how long it took
+func (s *StatsdClient) TimeFunc(stat string, f func()) {
+	defer s.Time(stat)()
+	f()
+}
+
+func (s *StatsdClient) Histogram(stat string, value int64) {
+	s.app.Debug("STATSD HISTOGRAM %s %d", stat, value)
+	_ = s.client.Raw(stat, fmt.Sprintf("%d|h", value), s.rate)
+}
+
+// Count unique occurences of value (e.g. user ids) in the stat
+func (s *StatsdClient) Set(stat string, value string) {
+	s.app.Debug("STATSD SET %s %s", stat, value)
+	_ = s.client.Set(stat, value, s.rate)
+}
@@ -0,0 +1,19 @@
+package gop
+
+import "testing"
+
+func TestStatsdWithRate(t *testing.T) {
+	a := InitCmd("gop_test", "statsd")
+	g := &Req{common: a.common, app: a}
+
+	// As documented
+	g.Stats.WithRate(0.1).Inc("hits", 1)
+
+	sampled := a.Stats.WithRate(0.25)
+	if sampled.rate != 0.25 {
+		t.Errorf("WithRate gave rate %v, want 0.25", sampled.rate)
+	}
+	if a.Stats.rate == 0.25 {
+		t.Errorf("WithRate changed the original client's rate")
+	}
+}
@@ -2,24 +2,142 @@ package gop
 
 import (
 	"html/template"
+	"path/filepath"
 )
 
 func (g *Req) Render(templateData interface{}, templates ...string) error {
+	if len(templates) == 0 {
+		return ServerError("No templates given to Render")
+	}
 	templateDir, _ := g.Cfg.GetPath("gop", "template_dir", "./templates")
 
 	templateFilenames := make([]string, len(templates))
 	for i := range templates {
 		templateFilenames[i] = templateDir + "/" + templates[i] + ".ght"
 	}
-	tmpl, err := template.ParseFiles(templateFilenames...)
+	// Named for the first file, so that's the one executed
+	tmpl := template.New(filepath.Base(templateFilenames[0])).Funcs(g.templateFuncs())
+	tmpl, err := tmpl.ParseFiles(templateFilenames...)
 	if err != nil {
 		return err
 	}
+	return g.renderTemplate(tmpl, templateData)
+}
 
+// Funcs available in templates rendered by Render
+func (g *Req) templateFuncs() template.FuncMap {
+	funcs := template.FuncMap{}
+	for name, f := range g.csrfTemplateFuncs() {
+		funcs[name] = f
+	}
+	for name, f := range g.urlTemplateFuncs() {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+func (g *Req) renderTemplate(tmpl *template.Template, templateData interface{}) error {
+	if g.csrfMode() != csrfOff {
+		// The token may need a cookie, which must go before the body
+		g.CSRFToken()
+	}
 	g.W.Header().Set("Content-Type", "text/html")
-	err = tmpl.Execute(g.W, templateData)
+	err := tmpl.Execute(g.W, templateData)
 	if err != nil {
 		return ServerError("Failed to execute template: " + err.Error())
 	}
 	return nil
 }
+
+// HTML view of /gop/status, for browsers
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>{{.ProjectName}} - {{.AppName}} status</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.ProjectName}} - {{.AppName}}</h1>
+
+<h2>Process</h2>
+<table>
+<tr><th>Pid</th><td>{{.Pid}}</td></tr>
+<tr><th>Started</th><td>{{.StartTime}}</td></tr>
+<tr><th>Uptime (secs)</th><td>{{printf "%.0f" .UptimeSeconds}}</td></tr>
+<tr><th>Go version</th><td>{{.GoVersion}}</td></tr>
+<tr><th>Goroutines</th><td>{{.NumGoros}}</td></tr>
+{{with .Build}}<tr><th>Build</th><td>{{.Path}} {{.Version}}{{with index .Settings "vcs.revision"}} ({{.}}){{end}}</td></tr>{{end}}
+<tr><th>Config profile</th><td>{{.Config.Profile}}</td></tr>
+<tr><th>Config file</th><td>{{.Config.File}}</td></tr>
+</table>
+
+{{with .TLS}}<h2>TLS</h2>
+<table>
+<tr><th>Certificate</th><td>{{.Subject}} ({{.CertFile}})</td></tr>
+<tr><th>Names</th><td>{{range .DNSNames}}{{.}} {{end}}</td></tr>
+<tr><th>Expires</th><td>{{.NotAfter}}</td></tr>
+<tr><th>Loaded</th><td>{{.LoadedAt}}</td></tr>
+</table>
+{{end}}
+<h2>Other listeners</h2>
+<table>
+<tr><th>Name</th><th>Address</th><th>TLS</th><th>Inherited</th></tr>
+{{range .Listeners}}<tr><td>{{.Name}}</td><td>{{.Net}}:{{.Addr}}</td><td>{{.TLS}}</td><td>{{.Inherited}}</td></tr>
+{{end}}</table>
+
+<h2>Limits</h2>
+<table>
+<tr><th></th><th>Current</th><th>Limit</th></tr>
+<tr><th>Sys mem bytes</th><td>{{.Limits.SysMemBytes}}</td><td>{{.Limits.SysMemBytesLimit}}</td></tr>
+<tr><th>Alloc mem bytes</th><td>{{.Limits.AllocMemBytes}}</td><td>{{.Limits.AllocMemBytesLimit}}</td></tr>
+<tr><th>FDs</th><td>{{.Limits.NumFDs}}</td><td>{{.Limits.NumFDsLimit}}</td></tr>
+<tr><th>Goroutines</th><td>{{.Limits.NumGoros}}</td><td>{{.Limits.NumGorosLimit}}</td></tr>
+<tr><th>Uptime (secs)</th><td>{{printf "%.0f" .UptimeSeconds}}</td><td>{{.Limits.RestartAfterSecs}}</td></tr>
+<tr><th>Requests</th><td>{{.TotalReqs}}</td><td>{{.Limits.MaxRequests}}</td></tr>
+</table>
+
+<h2>Requests</h2>
+<table>
+<tr><th>Total</th><td>{{.TotalReqs}}</td></tr>
+<tr><th>Current</th><td>{{.CurrentReqs}}</td></tr>
+<tr><th>Current websocket</th><td>{{.CurrentWSReqs}}</td></tr>
+<tr><th>Total slow</th><td>{{.TotalSlowReqs}}</td></tr>
+{{range $code, $n := .StatusCounts}}<tr><th>Status {{$code}}</th><td>{{$n}}</td></tr>
+{{end}}</table>
+
+<h2>Concurrency limits</h2>
+<table>
+<tr><th>Route</th><th>Active</th><th>Max</th><th>Queued</th><th>Max queue</th><th>Queue latency (ms)</th><th>Shed</th><th>Timed out</th></tr>
+{{range .Concurrency}}<tr><td>{{or .Route "(all)"}}</td><td>{{.Active}}</td><td>{{.Max}}</td><td>{{.Queued}}</td><td>{{.MaxQueue}}</td><td>{{printf "%.1f" .QueueLatencyMs}}</td><td>{{.Shed}}</td><td>{{.TimedOut}}</td></tr>
+{{end}}</table>
+
+<h2>Rate limiters</h2>
+<table>
+<tr><th>Name</th><th>Limit</th><th>Keys</th><th>Limited now</th><th>Rejected</th></tr>
+{{range .RateLimiters}}<tr><td>{{.Name}}</td><td>{{.Limit}}</td><td>{{.Keys}}</td><td>{{range .Limited}}{{.}} {{end}}</td><td>{{.Rejected}}</td></tr>
+{{end}}</table>
+
+<h2>Open requests</h2>
+<table>
+<tr><th>Id</th><th>Method</th><th>Url</th><th>Duration</th><th>Remote IP</th><th>HTTPS</th></tr>
+{{range .RequestInfo}}<tr><td>{{.Id}}</td><td>{{.Method}}</td><td>{{.Url}}</td><td>{{printf "%.3f" .Duration}}</td><td>{{.RemoteIP}}</td><td>{{.IsHTTPS}}</td></tr>
+{{end}}</table>
+
+<h2>Recent slow requests</h2>
+<table>
+<tr><th>Id</th><th>Started</th><th>Method</th><th>Url</th><th>Code</th><th>Duration</th></tr>
+{{range .SlowRequests}}<tr><td>{{.Id}}</td><td>{{.StartTime}}</td><td>{{.Method}}</td><td>{{.Url}}</td><td>{{.Code}}</td><td>{{printf "%.3f" .DurationSecs}}</td></tr>
+{{end}}</table>
+
+<h2>Recent graceful restarts</h2>
+<table>
+<tr><th>Time</th><th>Pid</th><th>Reason</th></tr>
+{{range .RestartHistory}}<tr><td>{{.Time}}</td><td>{{.Pid}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,16 @@
+package gop
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRenderNoTemplates(t *testing.T) {
+	a := InitCmd("gop_test", "security")
+	g := &Req{common: a.common, app: a, R: httptest.NewRequest("GET", "/", nil)}
+	g.W = &responseWriter{code: http.StatusOK, ResponseWriter: httptest.NewRecorder(), req: g}
+	if err := g.Render(nil); err == nil {
+		t.Errorf("Render without templates didn't fail")
+	}
+}
@@ -0,0 +1,214 @@
+package gop
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Enforcement state for a request timeout. The timer fires on its own goro.
+type reqTimeout struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	fired    bool
+	disabled bool
+}
+
+// The timeout for this request: per-route config, then the route's group,
+// then the global default
+func (g *Req) configuredTimeout() time.Duration {
+	d, _ := g.Cfg.GetDuration("gop", "request_timeout", 0)
+	if g.group != nil && g.group.timeout != 0 {
+		d = g.group.timeout
+	}
+	if tmpl := g.routeTemplate(); tmpl != "" {
+		d, _ = g.Cfg.GetDuration("gop", "request_timeout:"+tmpl, d)
+	}
+	return d
+}
+
+// The path template of the matched route, used to key per-route config
+func (g *Req) routeTemplate() string {
+	route := mux.CurrentRoute(g.R)
+	if route == nil {
+		return ""
+	}
+	tmpl, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return tmpl
+}
+
+// A gop config setting, overridden by <key>:<route> for the matched route
+func (g *Req) routeSetting(key, def string) string {
+	v, _ := g.Cfg.Get("gop", key, def)
+	if tmpl := g.routeTemplate(); tmpl != "" {
+		v, _ = g.Cfg.Get("gop", key+":"+tmpl, v)
+	}
+	return v
+}
+
+// Cancel the request and send a timeout error if the handler takes longer
+// than request_timeout (or the per-route request_timeout:<path> setting).
+// Requests marked CanBeSlow by the time it would fire are exempt.
+func (a *App) TimeoutMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(g *Req) error {
+			// Can't usefully send an error on a websocket
+			if g.W == nil {
+				return next(g)
+			}
+			d := g.configuredTimeout()
+
+			ctx, cancel := context.WithCancelCause(g.Context())
+			defer cancel(nil)
+			g.setContext(ctx)
+			g.W.bufferHeaders()
+
+			// Always arm the enforcement, so route middleware can SetTimeout
+			// even when there is no default
+			// The handler may change these while the timer runs
+			url, span := g.R.URL.String(), g.Span
+			g.timeout = &reqTimeout{}
+			g.timeout.timer = time.AfterFunc(time.Hour, func() { a.fireTimeout(g, url, span, cancel) })
+			g.timeout.timer.Stop()
+			if d > 0 {
+				g.timeout.timer.Reset(d)
+			}
+
+			err := next(g)
+
+			// Waits for any in-progress firing to complete
+			g.timeout.mu.Lock()
+			g.timeout.timer.Stop()
+			g.timeout.disabled = true
+			g.timeout.mu.Unlock()
+			return err
+		}
+	}
+}
+
+func (a *App) fireTimeout(g *Req, url string, span *Span, cancel context.CancelCauseFunc) {
+	g.timeout.mu.Lock()
+	defer g.timeout.mu.Unlock()
+	if g.timeout.fired || g.timeout.disabled || g.canBeSlow() {
+		return
+	}
+	g.timeout.fired = true
+
+	g.Error("Request [%s] timed out after %s", url, time.Since(g.startTime))
+	a.Stats.Inc("timeout", 1)
+
+	code, _ := g.Cfg.GetInt("gop", "request_timeout_code", http.StatusServiceUnavailable)
+	body, _ := g.Cfg.Get("gop", "request_timeout_message", "Request timed out")
+	httpErr := HTTPError{Code: code, Body: body}
+	span.SetError(httpErr)
+	// Send the error before cancelling, so the handler can't get in first
+	if !g.W.writeTimeout(httpErr) {
+		g.Error("Request timed out after handler had written data - can't send error")
+	}
+	cancel(context.DeadlineExceeded)
+}
+
+// Captures an error response so it can be written in one go
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(code int)        { b.code = code }
+
+// Write httpErr (if nothing has been written yet) and drop all further
+// writes from the handler. Returns false if it was too late to send.
+func (w *responseWriter) writeTimeout(httpErr HTTPError) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timedOut = true
+	if w.headerSent() {
+		return false
+	}
+	if w.compress != nil {
+		// Drop the handler's response, held back until we knew whether to
+		// compress it, and anything it said about its encoding
+		w.compress.buf = nil
+		h := w.ResponseWriter.Header()
+		h.Del("Content-Encoding")
+		h.Del("Content-Type")
+	}
+
+	rec := &bufferedResponse{header: make(http.Header), code: http.StatusOK}
+	httpErr.Write(&responseWriter{ResponseWriter: rec, code: http.StatusOK, req: w.req})
+
+	h := w.ResponseWriter.Header()
+	for k, v := range rec.header {
+		h[k] = v
+	}
+	// So the client sees a complete response while the handler winds down
+	h.Set("Content-Length", strconv.Itoa(rec.body.Len()))
+	w.ResponseWriter.WriteHeader(rec.code)
+	w.ResponseWriter.Write(rec.body.Bytes())
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+	w.wroteHeader = true
+	w.code = rec.code
+	w.size += rec.body.Len()
+	w.wireSize += rec.body.Len()
+	// Nothing was held back, so there's nothing left to compress
+	w.compress = nil
+	return true
+}
+
+// Handlers set CanBeSlow without locking, so the timer can't read it
+// race-free. A stale read only costs a timeout the handler didn't want.
+//
+//go:norace
+func (g *Req) canBeSlow() bool {
+	return g.CanBeSlow
+}
+
+// Change this request's timeout to d from now. Zero or less removes it.
+// Without enforcement (e.g. websockets) this just limits the context.
+func (g *Req) SetTimeout(d time.Duration) {
+	if g.timeout == nil {
+		if d > 0 {
+			// Released with the parent context at the end of the request
+			g.WithTimeout(d)
+		}
+		return
+	}
+	g.timeout.mu.Lock()
+	defer g.timeout.mu.Unlock()
+	if g.timeout.fired || g.timeout.disabled {
+		return
+	}
+	g.timeout.timer.Stop()
+	if d > 0 {
+		g.timeout.timer.Reset(d)
+	}
+}
+
+// Mark the request as expected to be slow (e.g. long polling). This sets
+// CanBeSlow and removes any request timeout.
+func (g *Req) AllowSlow() {
+	g.CanBeSlow = true
+	g.SetTimeout(0)
+}
+
+// Middleware for routes which are expected to be slow, such as long
+// polling. See Req.AllowSlow.
+func LongRunning(next HandlerFunc) HandlerFunc {
+	return func(g *Req) error {
+		g.AllowSlow()
+		return next(g)
+	}
+}
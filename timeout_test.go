@@ -0,0 +1,91 @@
+package gop
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutResponse(t *testing.T) {
+	a, srv := newTestApp(t, "timeout")
+	a.Cfg.TransientOverride("gop", "request_timeout", "50ms")
+	a.Cfg.TransientOverride("gop", "compression_enable", "true")
+
+	// Wait out the timeout, then try to write more
+	slow := func(first string) HandlerFunc {
+		return func(g *Req) error {
+			g.W.Header().Set("Content-Type", "application/json")
+			if first != "" {
+				g.W.Write([]byte(first))
+			}
+			<-g.Context().Done()
+			g.W.Write([]byte("more"))
+			return nil
+		}
+	}
+	a.HandleFunc("/nothing", slow(""))
+	// Less than compression_min_bytes, so held back by compression
+	a.HandleFunc("/held", slow(`{"partial":`))
+	a.HandleFunc("/sent", func(g *Req) error {
+		g.W.Write([]byte("early"))
+		g.W.Flush()
+		<-g.Context().Done()
+		return nil
+	})
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/nothing", http.StatusServiceUnavailable, "Request timed out"},
+		{"/held", http.StatusServiceUnavailable, "Request timed out"},
+		// Too late for an error, so the client gets what was sent
+		{"/sent", http.StatusOK, "early"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code || strings.TrimSpace(string(body)) != test.body {
+			t.Errorf("%s: got %d %q, want %d %q", test.path, resp.StatusCode, body, test.code, test.body)
+		}
+		if test.code != http.StatusOK && resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: timeout error sent with Content-Encoding %q", test.path, resp.Header.Get("Content-Encoding"))
+		}
+	}
+}
+
+func TestTimeoutCanBeSlow(t *testing.T) {
+	a, srv := newTestApp(t, "timeout")
+	a.Cfg.TransientOverride("gop", "request_timeout", "50ms")
+	slow := func(mark func(g *Req)) HandlerFunc {
+		return func(g *Req) error {
+			mark(g)
+			time.Sleep(150 * time.Millisecond)
+			g.SendText([]byte("done"))
+			return nil
+		}
+	}
+	a.HandleFunc("/canbeslow", slow(func(g *Req) { g.CanBeSlow = true }))
+	a.HandleFunc("/allowslow", slow(func(g *Req) { g.AllowSlow() }))
+
+	for _, path := range []string{"/canbeslow", "/allowslow"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "done" {
+			t.Errorf("%s: got %d %q, want 200 \"done\"", path, resp.StatusCode, body)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package gop
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often to check the cert and key files for changes
+const certCheckInterval = time.Second
+
+// A certificate loaded from files, re-read when they change
+type certReloader struct {
+	certFile, keyFile string
+	logger            Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+	loadedAt  time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger Logger) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	err := c.reload(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load the cert if either file has changed. Must hold c.mu (or be new).
+func (c *certReloader) reload(now time.Time) error {
+	c.lastCheck = now
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.certMod, c.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	c.loadedAt = now
+	if c.logger != nil {
+		c.logger.Info("Loaded TLS certificate [%s] from %s (expires %s)",
+			cert.Leaf.Subject.CommonName, c.certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Check for new files now, rather than waiting for the next handshake
+func (c *certReloader) forceCheck() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.reload(time.Now())
+	if err != nil && c.logger != nil {
+		c.logger.Error("Failed to reload TLS certificate from %s: %s", c.certFile, err.Error())
+	}
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastCheck) >= certCheckInterval {
+		err := c.reload(now)
+		if err != nil && c.logger != nil {
+			// The files may be part-written, so carry on with what we had
+			c.logger.Error("Failed to reload TLS certificate from %s: %s", c.certFile, err.Error())
+		}
+	}
+	return c.cert, nil
+}
+
+func (a *App) tlsEnabled() bool {
+	certFile, _ := a.Cfg.Get("gop", "tls_cert_file", "")
+	keyFile, _ := a.Cfg.Get("gop", "tls_key_file", "")
+	return certFile != "" && keyFile != ""
+}
+
+// Build the TLS config from tls_* config, now and whenever it changes.
+// Returns false if TLS isn't configured.
+func (a *App) initTLS() bool {
+	if !a.tlsEnabled() {
+		return false
+	}
+	err := a.loadTLSConfig()
+	if err != nil {
+		a.Fatalf("Can't set up TLS: %s", err.Error())
+	}
+	a.Cfg.AddOnChangeCallback(func(cfg *Config) {
+		err := a.loadTLSConfig()
+		if err != nil {
+			a.Error("Keeping old TLS settings: %s", err.Error())
+		}
+	})
+	return true
+}
+
+func (a *App) loadTLSConfig() error {
+	certFile, _ := a.Cfg.Get("gop", "tls_cert_file", "")
+	keyFile, _ := a.Cfg.Get("gop", "tls_key_file", "")
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("tls_cert_file and tls_key_file must both be set")
+	}
+
+	a.tlsMu.Lock()
+	certs := a.tlsCerts
+	a.tlsMu.Unlock()
+	if certs == nil || certs.certFile != certFile || certs.keyFile != keyFile {
+		var err error
+		certs, err = newCertReloader(certFile, keyFile, a)
+		if err != nil {
+			return fmt.Errorf("Can't load certificate: %s", err.Error())
+		}
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if enableHTTP2, _ := a.Cfg.GetBool("gop", "http2_enable", true); enableHTTP2 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	minVersion, _ := a.Cfg.Get("gop", "tls_min_version", "1.2")
+	switch minVersion {
+	case "1.0":
+		cfg.MinVersion = tls.VersionTLS10
+	case "1.1":
+		cfg.MinVersion = tls.VersionTLS11
+	case "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("Bad tls_min_version [%s]", minVersion)
+	}
+
+	if names, _ := a.Cfg.Get("gop", "tls_cipher_suites", ""); names != "" {
+		ids := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			ids[suite.Name] = suite.ID
+		}
+		for _, name := range splitList(names) {
+			id, ok := ids[name]
+			if !ok {
+				return fmt.Errorf("Unknown or insecure cipher suite [%s] in tls_cipher_suites", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	caFile, _ := a.Cfg.Get("gop", "tls_client_ca_file", "")
+	defaultClientAuth := "none"
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("Can't read tls_client_ca_file: %s", err.Error())
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in tls_client_ca_file [%s]", caFile)
+		}
+		defaultClientAuth = "verify_if_given"
+	}
+	clientAuth, _ := a.Cfg.Get("gop", "tls_client_auth", defaultClientAuth)
+	switch clientAuth {
+	case "none":
+		cfg.ClientAuth = tls.NoClientCert
+	case "request":
+		cfg.ClientAuth = tls.RequestClientCert
+	case "require":
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	case "verify_if_given":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require_and_verify":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("Bad tls_client_auth [%s]", clientAuth)
+	}
+	if cfg.ClientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCAs == nil {
+		return fmt.Errorf("tls_client_auth [%s] needs tls_client_ca_file", clientAuth)
+	}
+
+	a.tlsMu.Lock()
+	a.tlsCerts = certs
+	a.tlsConfig = cfg
+	a.tlsMu.Unlock()
+	return nil
+}
+
+// Wrap l to serve TLS with the current settings. Settings (and
+// certificates) are picked up by each new connection, so the listener
+// itself never needs replacing.
+func (a *App) tlsListener(l net.Listener) net.Listener {
+	return tls.NewListener(l, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			a.tlsMu.Lock()
+			defer a.tlsMu.Unlock()
+			return a.tlsConfig, nil
+		},
+	})
+}
+
+// Re-read the certificate files, if they have changed
+func (a *App) reloadTLSCerts() {
+	a.tlsMu.Lock()
+	certs := a.tlsCerts
+	a.tlsMu.Unlock()
+	if certs != nil {
+		certs.forceCheck()
+	}
+}
+
+// Handles requests on tls_redirect_addr, redirecting everything to HTTPS
+func (a *App) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		// IPv6
+		host = "[" + host + "]"
+	}
+	listenAddr, _ := a.Cfg.Get("gop", "listen_addr", ":https")
+	if _, port, err := net.SplitHostPort(listenAddr); err == nil && port != "" && port != "443" && port != "https" {
+		host += ":" + port
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		// So the method and body are kept
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
+
+type tlsStatus struct {
+	CertFile string
+	Subject  string
+	DNSNames []string `json:",omitempty"`
+	NotAfter time.Time
+	LoadedAt time.Time
+}
+
+func (a *App) getTLSStatus() *tlsStatus {
+	a.tlsMu.Lock()
+	certs := a.tlsCerts
+	a.tlsMu.Unlock()
+	if certs == nil {
+		return nil
+	}
+	certs.mu.Lock()
+	defer certs.mu.Unlock()
+	leaf := certs.cert.Leaf
+	return &tlsStatus{
+		CertFile: certs.certFile,
+		Subject:  leaf.Subject.String(),
+		DNSNames: leaf.DNSNames,
+		NotAfter: leaf.NotAfter,
+		LoadedAt: certs.loadedAt,
+	}
+}
@@ -0,0 +1,182 @@
+package gop
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a self-signed cert and its key to dir, returning the file names
+func writeTestCert(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Can't generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Can't create cert: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Can't marshal key: %s", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		t.Fatalf("Can't write cert: %s", err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "test")
+	tests := []struct {
+		name       string
+		overrides  []string
+		minVersion uint16
+		ciphers    []uint16
+		clientAuth tls.ClientAuthType
+		wantErr    bool
+	}{
+		{"defaults", nil, tls.VersionTLS12, nil, tls.NoClientCert, false},
+		{"min version", []string{"tls_min_version", "1.3"}, tls.VersionTLS13, nil, tls.NoClientCert, false},
+		{"bad min version", []string{"tls_min_version", "1.4"}, 0, nil, 0, true},
+		{"ciphers", []string{"tls_cipher_suites", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+			tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+			tls.NoClientCert, false},
+		{"insecure cipher", []string{"tls_cipher_suites", "TLS_RSA_WITH_RC4_128_SHA"}, 0, nil, 0, true},
+		{"client CA", []string{"tls_client_ca_file", certFile}, tls.VersionTLS12, nil, tls.VerifyClientCertIfGiven, false},
+		{"client auth", []string{"tls_client_ca_file", certFile, "tls_client_auth", "require_and_verify"},
+			tls.VersionTLS12, nil, tls.RequireAndVerifyClientCert, false},
+		{"request", []string{"tls_client_auth", "request"}, tls.VersionTLS12, nil, tls.RequestClientCert, false},
+		{"verify without CA", []string{"tls_client_auth", "require_and_verify"}, 0, nil, 0, true},
+		{"bad client auth", []string{"tls_client_auth", "maybe"}, 0, nil, 0, true},
+		{"CA file without certs", []string{"tls_client_ca_file", keyFile}, 0, nil, 0, true},
+	}
+	for _, test := range tests {
+		a := InitCmd("gop_test", "tls")
+		a.Cfg.TransientOverride("gop", "tls_cert_file", certFile)
+		a.Cfg.TransientOverride("gop", "tls_key_file", keyFile)
+		for i := 0; i+1 < len(test.overrides); i += 2 {
+			a.Cfg.TransientOverride("gop", test.overrides[i], test.overrides[i+1])
+		}
+		err := a.loadTLSConfig()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		cfg := a.tlsConfig
+		if cfg.MinVersion != test.minVersion || cfg.ClientAuth != test.clientAuth {
+			t.Errorf("%s: got min version %x, client auth %v, want %x, %v",
+				test.name, cfg.MinVersion, cfg.ClientAuth, test.minVersion, test.clientAuth)
+		}
+		if len(cfg.CipherSuites) != len(test.ciphers) {
+			t.Errorf("%s: got ciphers %v, want %v", test.name, cfg.CipherSuites, test.ciphers)
+			continue
+		}
+		for i := range cfg.CipherSuites {
+			if cfg.CipherSuites[i] != test.ciphers[i] {
+				t.Errorf("%s: got ciphers %v, want %v", test.name, cfg.CipherSuites, test.ciphers)
+				break
+			}
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "one")
+	c, err := newCertReloader(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatalf("newCertReloader: %s", err)
+	}
+	commonName := func() string {
+		cert, _ := c.getCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+	if got := commonName(); got != "one" {
+		t.Fatalf("Got cert %q, want one", got)
+	}
+
+	// Make sure the new files look changed, however coarse the mtimes
+	later := time.Now().Add(time.Minute)
+	touch := func() {
+		os.Chtimes(certFile, later, later)
+		os.Chtimes(keyFile, later, later)
+		later = later.Add(time.Minute)
+	}
+	writeTestCert(t, dir, "two")
+	touch()
+	c.forceCheck()
+	if got := commonName(); got != "two" {
+		t.Errorf("After rewriting the files, got cert %q, want two", got)
+	}
+
+	// Part-written files leave the old cert in place
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	touch()
+	c.forceCheck()
+	if got := commonName(); got != "two" {
+		t.Errorf("With a bad key, got cert %q, want two", got)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		listenAddr string
+		method     string
+		host       string
+		uri        string
+		code       int
+		location   string
+	}{
+		{":https", "GET", "example.com", "/a?b=c", http.StatusMovedPermanently, "https://example.com/a?b=c"},
+		{":443", "GET", "example.com:80", "/", http.StatusMovedPermanently, "https://example.com/"},
+		{":8443", "GET", "example.com:8080", "/a", http.StatusMovedPermanently, "https://example.com:8443/a"},
+		{"127.0.0.1:8443", "HEAD", "example.com", "/", http.StatusMovedPermanently, "https://example.com:8443/"},
+		{":https", "GET", "[::1]:80", "/", http.StatusMovedPermanently, "https://[::1]/"},
+		{":8443", "GET", "[::1]", "/", http.StatusMovedPermanently, "https://[::1]:8443/"},
+		// Keep the method and body
+		{":https", "POST", "example.com", "/form", http.StatusPermanentRedirect, "https://example.com/form"},
+	}
+	for _, test := range tests {
+		a := InitCmd("gop_test", "tls")
+		a.Cfg.TransientOverride("gop", "listen_addr", test.listenAddr)
+		r := httptest.NewRequest(test.method, "http://"+test.host+test.uri, nil)
+		w := httptest.NewRecorder()
+		a.redirectToHTTPS(w, r)
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Errorf("%s %s%s listening on %s: got %d %q, want %d %q", test.method, test.host, test.uri,
+				test.listenAddr, w.Code, w.Header().Get("Location"), test.code, test.location)
+		}
+	}
+}
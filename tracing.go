@@ -0,0 +1,503 @@
+package gop
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Span kinds and status codes, as numbered by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusUnset = 0
+	spanStatusOK    = 1
+	spanStatusError = 2
+
+	// W3C trace flag for traces which are being recorded. We record every
+	// trace we start, and pass on the caller's flags for those we continue
+	// (so spans in traces the caller isn't sampling aren't exported).
+	traceFlagSampled = 0x01
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// A single timed operation within a trace. Every gop request gets one
+// (g.Span) when tracing is enabled; handlers can hang child spans off it.
+// All methods are safe to call on a nil *Span, which is what you get when
+// tracing is disabled.
+type Span struct {
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Name         string
+	StartTime    time.Time
+	EndTime      time.Time
+
+	kind          int
+	flags         byte // W3C trace flags
+	statusCode    int
+	statusMessage string
+	attributes    map[string]interface{}
+	tracer        *tracer
+	mu            sync.Mutex
+}
+
+// Start a child span of this one. Call End() on it when done.
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(name, spanKindInternal, s.TraceID, s.SpanID, s.flags)
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// Mark the span as failed. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.statusCode = spanStatusError
+	s.statusMessage = err.Error()
+	s.mu.Unlock()
+}
+
+// Finish the span and queue it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.EndTime.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+	s.tracer.export(s)
+}
+
+// The W3C traceparent header value identifying this span, for passing
+// on to downstream services
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-%02x", s.TraceID, s.SpanID, s.flags)
+}
+
+// Start a span as a child of the request span
+func (g *Req) StartSpan(name string) *Span {
+	return g.Span.StartChild(name)
+}
+
+type spanExporter interface {
+	exportSpans(spans []*Span) error
+	close()
+}
+
+type tracer struct {
+	app      *App
+	exporter spanExporter
+	spans    chan *Span
+	done     chan struct{}
+	mu       sync.Mutex // Guards sending on spans against closing it
+	closed   bool
+}
+
+func (a *App) initTracing() {
+	enabled, _ := a.Cfg.GetBool("gop", "tracing_enable", false)
+	if !enabled {
+		return
+	}
+
+	var exporter spanExporter
+	exporterName, _ := a.Cfg.Get("gop", "tracing_exporter", "otlp")
+	switch exporterName {
+	case "otlp":
+		endpoint, _ := a.Cfg.Get("gop", "tracing_otlp_endpoint", "http://localhost:4318/v1/traces")
+		timeout, _ := a.Cfg.GetDuration("gop", "tracing_otlp_timeout", 10*time.Second)
+		exporter = &otlpExporter{
+			app:      a,
+			endpoint: endpoint,
+			client:   &http.Client{Timeout: timeout},
+		}
+	case "file":
+		defaultFname := a.logDir + "/" + a.AppName + "-traces.json"
+		fname, _ := a.Cfg.GetPath("gop", "tracing_file", defaultFname)
+		f, err := os.OpenFile(fname, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			a.Error("Can't open trace file - tracing disabled: %s", err.Error())
+			return
+		}
+		exporter = &fileExporter{app: a, f: f}
+	default:
+		a.Error("Unknown tracing_exporter [%s] - tracing disabled", exporterName)
+		return
+	}
+
+	queueSize, _ := a.Cfg.GetInt("gop", "tracing_queue_size", 1000)
+	if queueSize <= 0 {
+		a.Error("Bad tracing_queue_size [%d] - using 1000", queueSize)
+		queueSize = 1000
+	}
+	a.tracer = &tracer{
+		app:      a,
+		exporter: exporter,
+		spans:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+	go a.tracer.run()
+}
+
+func (a *App) closeTracing() {
+	if a.tracer == nil {
+		return
+	}
+	// Spans may still end after this (e.g. in-flight requests), so stop
+	// accepting them before closing the channel
+	a.tracer.mu.Lock()
+	if !a.tracer.closed {
+		a.tracer.closed = true
+		close(a.tracer.spans)
+	}
+	a.tracer.mu.Unlock()
+	<-a.tracer.done
+}
+
+func newRandomID(buf []byte) {
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic("Failed to read random bytes for trace id: " + err.Error())
+	}
+}
+
+func (t *tracer) newSpan(name string, kind int, traceID TraceID, parentID SpanID, flags byte) *Span {
+	s := &Span{
+		TraceID:      traceID,
+		ParentSpanID: parentID,
+		Name:         name,
+		StartTime:    time.Now(),
+		kind:         kind,
+		flags:        flags,
+		attributes:   make(map[string]interface{}),
+		tracer:       t,
+	}
+	newRandomID(s.SpanID[:])
+	return s
+}
+
+// Parse a W3C traceparent header. ok is false if missing or malformed.
+func parseTraceParent(header string) (traceID TraceID, parentID SpanID, flags byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceID, parentID, 0, false
+	}
+	// Version 00 has exactly four fields. Later versions may add more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, 0, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, 0, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, 0, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, 0, false
+	}
+	var flagBuf [1]byte
+	if _, err := hex.Decode(flagBuf[:], []byte(parts[3])); err != nil {
+		return traceID, parentID, 0, false
+	}
+	// All-zero ids are invalid
+	if traceID == (TraceID{}) || parentID == (SpanID{}) {
+		return traceID, parentID, 0, false
+	}
+	return traceID, parentID, flagBuf[0], true
+}
+
+// Start the server span for a request, continuing the caller's trace if
+// they sent us a traceparent. Returns nil if tracing is disabled.
+func (a *App) startRequestSpan(g *Req) *Span {
+	if a.tracer == nil {
+		return nil
+	}
+	traceID, parentID, flags, ok := parseTraceParent(g.R.Header.Get("traceparent"))
+	if !ok {
+		newRandomID(traceID[:])
+		parentID = SpanID{}
+		flags = traceFlagSampled
+	}
+
+	name := g.R.Method
+	route := ""
+	if currentRoute := mux.CurrentRoute(g.R); currentRoute != nil {
+		route, _ = currentRoute.GetPathTemplate()
+	}
+	if route != "" {
+		name += " " + route
+	} else {
+		name += " " + g.R.URL.Path
+	}
+
+	span := a.tracer.newSpan(name, spanKindServer, traceID, parentID, flags)
+	span.SetAttribute("http.method", g.R.Method)
+	span.SetAttribute("http.target", g.R.RequestURI)
+	if route != "" {
+		span.SetAttribute("http.route", route)
+	}
+	span.SetAttribute("net.peer.ip", g.RealRemoteIP)
+	if g.IsHTTPS {
+		span.SetAttribute("http.scheme", "https")
+	} else {
+		span.SetAttribute("http.scheme", "http")
+	}
+	return span
+}
+
+// Record the outcome of the request and end its span
+func (g *Req) finishSpan() {
+	if g.Span == nil {
+		return
+	}
+	if g.W != nil {
+		g.Span.SetAttribute("http.status_code", g.W.code)
+		if g.W.code >= 500 {
+			g.Span.mu.Lock()
+			if g.Span.statusCode == spanStatusUnset {
+				g.Span.statusCode = spanStatusError
+				g.Span.statusMessage = http.StatusText(g.W.code)
+			}
+			g.Span.mu.Unlock()
+		}
+	}
+	g.Span.End()
+}
+
+func (t *tracer) export(s *Span) {
+	if s.flags&traceFlagSampled == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		t.app.Stats.Inc("tracing.dropped_spans", 1)
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		t.app.Stats.Inc("tracing.dropped_spans", 1)
+	}
+}
+
+// Batch up finished spans and hand them to the exporter
+func (t *tracer) run() {
+	defer close(t.done)
+	defer t.exporter.close()
+
+	batchSize, _ := t.app.Cfg.GetInt("gop", "tracing_batch_size", 100)
+	if batchSize <= 0 {
+		t.app.Error("Bad tracing_batch_size [%d] - using 100", batchSize)
+		batchSize = 100
+	}
+	flushInterval, _ := t.app.Cfg.GetDuration("gop", "tracing_flush_interval", 5*time.Second)
+	if flushInterval <= 0 {
+		t.app.Error("Bad tracing_flush_interval [%s] - using 5s", flushInterval)
+		flushInterval = 5 * time.Second
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.exporter.exportSpans(batch)
+		if err != nil {
+			t.app.Error("Failed to export %d spans: %s", len(batch), err.Error())
+			t.app.Stats.Inc("tracing.export_errors", 1)
+		}
+		batch = make([]*Span, 0, batchSize)
+	}
+
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// OTLP JSON encoding, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (s *Span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+		Status:            otlpStatus{Code: s.statusCode, Message: s.statusMessage},
+	}
+	if s.ParentSpanID != (SpanID{}) {
+		o.ParentSpanID = s.ParentSpanID.String()
+	}
+	for k, v := range s.attributes {
+		o.Attributes = append(o.Attributes, otlpKeyValue{Key: k, Value: otlpValue(v)})
+	}
+	return o
+}
+
+func (a *App) otlpPayload(spans []*Span) map[string]interface{} {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		otlpSpans[i] = s.toOTLP()
+	}
+	hostname, _ := os.Hostname()
+	resource := map[string]interface{}{
+		"attributes": []otlpKeyValue{
+			{Key: "service.namespace", Value: otlpValue(a.ProjectName)},
+			{Key: "service.name", Value: otlpValue(a.AppName)},
+			{Key: "host.name", Value: otlpValue(hostname)},
+			{Key: "process.pid", Value: otlpValue(os.Getpid())},
+		},
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": resource,
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "gop"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// Sends spans to an OTLP/HTTP collector using the JSON encoding
+type otlpExporter struct {
+	app      *App
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpExporter) exportSpans(spans []*Span) error {
+	body, err := json.Marshal(e.app.otlpPayload(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Collector at [%s] returned status %d", e.endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() {}
+
+// Appends one OTLP JSON document per batch to a local file
+type fileExporter struct {
+	app *App
+	f   *os.File
+}
+
+func (e *fileExporter) exportSpans(spans []*Span) error {
+	body, err := json.Marshal(e.app.otlpPayload(spans))
+	if err != nil {
+		return err
+	}
+	_, err = e.f.Write(append(body, '\n'))
+	return err
+}
+
+func (e *fileExporter) close() {
+	err := e.f.Close()
+	if err != nil {
+		e.app.Error("Error closing trace file: %s", err.Error())
+	}
+}
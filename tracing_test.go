@@ -0,0 +1,195 @@
+package gop
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+		flags  byte
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, 0x01},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, 0x00},
+		{" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ", true, 0x01},
+		// Later versions may add fields
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03-extra", true, 0x03},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, 0},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, 0},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", false, 0},
+		{"00-xyz92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, 0},
+		{"", false, 0},
+	}
+	for _, test := range tests {
+		traceID, parentID, flags, ok := parseTraceParent(test.header)
+		if ok != test.ok {
+			t.Errorf("parseTraceParent(%q) ok = %v, want %v", test.header, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if flags != test.flags {
+			t.Errorf("parseTraceParent(%q) flags = %02x, want %02x", test.header, flags, test.flags)
+		}
+		if traceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID.String() != "00f067aa0ba902b7" {
+			t.Errorf("parseTraceParent(%q) = %s, %s", test.header, traceID, parentID)
+		}
+	}
+}
+
+// Runs a stub OTLP collector, returning the app and a func which shuts
+// tracing down and returns the payloads received
+func newTracingTestApp(t *testing.T, overrides ...string) (*App, func() []map[string]interface{}) {
+	var mu sync.Mutex
+	var payloads []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("Collector got bad JSON: %s", err)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Collector got Content-Type %q", ct)
+		}
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	t.Cleanup(collector.Close)
+
+	a := InitCmd("gop_test", "tracing")
+	a.Cfg.TransientOverride("gop", "tracing_enable", "true")
+	a.Cfg.TransientOverride("gop", "tracing_otlp_endpoint", collector.URL+"/v1/traces")
+	for i := 0; i+1 < len(overrides); i += 2 {
+		a.Cfg.TransientOverride("gop", overrides[i], overrides[i+1])
+	}
+	a.initTracing()
+	return a, func() []map[string]interface{} {
+		a.closeTracing()
+		mu.Lock()
+		defer mu.Unlock()
+		return payloads
+	}
+}
+
+func TestTracingOTLPExport(t *testing.T) {
+	a, finish := newTracingTestApp(t)
+
+	r := httptest.NewRequest("GET", "/things/1", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	g := &Req{common: a.common, app: a, R: r, RealRemoteIP: "192.0.2.1"}
+	g.Span = a.startRequestSpan(g)
+	child := g.StartSpan("db.query")
+	child.SetAttribute("rows", 3)
+	if tp := child.TraceParent(); tp != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+child.SpanID.String()+"-01" {
+		t.Errorf("Child traceparent %q doesn't carry the caller's trace and flags", tp)
+	}
+	child.End()
+	g.finishSpan()
+
+	payloads := finish()
+	if len(payloads) != 1 {
+		t.Fatalf("Collector got %d payloads, want 1", len(payloads))
+	}
+	resourceSpans := payloads[0]["resourceSpans"].([]interface{})
+	resource := resourceSpans[0].(map[string]interface{})["resource"].(map[string]interface{})
+	attrs := otlpAttrs(resource["attributes"])
+	if attrs["service.name"] != "tracing" || attrs["service.namespace"] != "gop_test" {
+		t.Errorf("Unexpected resource attributes %v", attrs)
+	}
+	scopeSpans := resourceSpans[0].(map[string]interface{})["scopeSpans"].([]interface{})
+	spans := scopeSpans[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("Got %d spans, want 2", len(spans))
+	}
+
+	byName := make(map[string]map[string]interface{})
+	for _, s := range spans {
+		span := s.(map[string]interface{})
+		byName[span["name"].(string)] = span
+	}
+	server, db := byName["GET /things/1"], byName["db.query"]
+	if server == nil || db == nil {
+		t.Fatalf("Missing spans, got %v", byName)
+	}
+	if server["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || server["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Errorf("Server span didn't continue the caller's trace: %v", server)
+	}
+	if server["kind"] != float64(spanKindServer) || db["kind"] != float64(spanKindInternal) {
+		t.Errorf("Unexpected span kinds %v, %v", server["kind"], db["kind"])
+	}
+	if db["parentSpanId"] != server["spanId"] || db["traceId"] != server["traceId"] {
+		t.Errorf("Child span isn't parented on the server span")
+	}
+	if got := otlpAttrs(server["attributes"])["http.method"]; got != "GET" {
+		t.Errorf("http.method = %v", got)
+	}
+	if got := otlpAttrs(db["attributes"])["rows"]; got != "3" {
+		t.Errorf("rows = %v, want intValue \"3\"", got)
+	}
+}
+
+func TestTracingUnsampled(t *testing.T) {
+	a, finish := newTracingTestApp(t)
+
+	r := httptest.NewRequest("GET", "/things/1", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	g := &Req{common: a.common, app: a, R: r, RealRemoteIP: "192.0.2.1"}
+	g.Span = a.startRequestSpan(g)
+	child := g.StartSpan("db.query")
+	if tp := child.TraceParent(); tp != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+child.SpanID.String()+"-00" {
+		t.Errorf("Child traceparent %q doesn't carry the caller's flags", tp)
+	}
+	child.End()
+	g.finishSpan()
+
+	if payloads := finish(); len(payloads) != 0 {
+		t.Errorf("Collector got %d payloads for an unsampled trace, want 0", len(payloads))
+	}
+}
+
+func TestTracingBadConfig(t *testing.T) {
+	// Must fall back to the defaults, not panic
+	a, finish := newTracingTestApp(t,
+		"tracing_queue_size", "-1",
+		"tracing_batch_size", "-1",
+		"tracing_flush_interval", "0s")
+	a.tracer.newSpan("span", spanKindInternal, TraceID{1}, SpanID{}, traceFlagSampled).End()
+
+	if payloads := finish(); len(payloads) != 1 {
+		t.Errorf("Collector got %d payloads, want 1", len(payloads))
+	}
+}
+
+func TestTracingSpanAfterClose(t *testing.T) {
+	a, finish := newTracingTestApp(t)
+	span := a.tracer.newSpan("late", spanKindInternal, TraceID{1}, SpanID{}, traceFlagSampled)
+	finish()
+	// Must be dropped, not panic on the closed channel
+	span.End()
+	a.closeTracing()
+}
+
+// Flatten OTLP key/values to key -> the single value
+func otlpAttrs(v interface{}) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	list, _ := v.([]interface{})
+	for _, kv := range list {
+		m := kv.(map[string]interface{})
+		for _, value := range m["value"].(map[string]interface{}) {
+			attrs[m["key"].(string)] = value
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,78 @@
+package gop
+
+import (
+	"fmt"
+	"html/template"
+
+	"github.com/gorilla/mux"
+)
+
+// Build the URL for a named route from key/value pairs. Pairs which aren't
+// route variables go in the query string. Name routes as you register them:
+//
+//	app.HandleFunc("/users/{id:[0-9]+}", handleUser).Name("user")
+//	u, err := app.URL("user", "id", 42, "tab", "posts") // "/users/42?tab=posts"
+func (a *App) URL(name string, pairs ...interface{}) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("odd number of params for route [%s]", name)
+	}
+	route := a.namedRoute(name)
+	if route == nil {
+		return "", fmt.Errorf("no route named [%s]", name)
+	}
+	varNames, err := route.GetVarNames()
+	if err != nil {
+		return "", err
+	}
+	var vars []string
+	var query [][2]string
+	for i := 0; i < len(pairs); i += 2 {
+		key, value := fmt.Sprint(pairs[i]), fmt.Sprint(pairs[i+1])
+		isVar := false
+		for _, varName := range varNames {
+			if varName == key {
+				isVar = true
+				break
+			}
+		}
+		if isVar {
+			vars = append(vars, key, value)
+		} else {
+			query = append(query, [2]string{key, value})
+		}
+	}
+	u, err := route.URL(vars...)
+	if err != nil {
+		return "", fmt.Errorf("route [%s]: %s", name, err.Error())
+	}
+	if len(query) > 0 {
+		q := u.Query()
+		for _, kv := range query {
+			q.Add(kv[0], kv[1])
+		}
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// Look in the main routes, then those of each listener
+func (a *App) namedRoute(name string) *mux.Route {
+	if route := a.GorillaRouter.Get(name); route != nil {
+		return route
+	}
+	a.secondaryListenersMu.Lock()
+	defer a.secondaryListenersMu.Unlock()
+	for _, m := range a.listenerRouters {
+		if route := m.Get(name); route != nil {
+			return route
+		}
+	}
+	return nil
+}
+
+// {{url "user" "id" .ID}} in templates, as for App.URL
+func (g *Req) urlTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"url": g.app.URL,
+	}
+}
@@ -0,0 +1,41 @@
+package gop
+
+import (
+	"testing"
+)
+
+func TestURL(t *testing.T) {
+	a := InitCmd("gop_test", "urls")
+	a.HandleFunc("/users/{id:[0-9]+}", func(g *Req) error { return nil }).Name("user")
+	a.HandleFunc("/files/{dir}/{name}", func(g *Req) error { return nil }).Name("file")
+	a.ListenerRouter("internal").HandleFunc("/reindex", func(g *Req) error { return nil }).Name("reindex")
+
+	tests := []struct {
+		name    string
+		pairs   []interface{}
+		want    string
+		wantErr bool
+	}{
+		{"user", []interface{}{"id", 42}, "/users/42", false},
+		{"user", []interface{}{"id", 42, "tab", "posts", "q", "a b"}, "/users/42?q=a+b&tab=posts", false},
+		{"file", []interface{}{"name", "x.txt", "dir", "docs"}, "/files/docs/x.txt", false},
+		// Listeners' routes can be named too
+		{"reindex", nil, "/reindex", false},
+		{"user", []interface{}{"id", "bob"}, "", true},
+		{"user", nil, "", true},
+		{"user", []interface{}{"id"}, "", true},
+		{"nope", nil, "", true},
+	}
+	for _, test := range tests {
+		got, err := a.URL(test.name, test.pairs...)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("URL(%q, %v) = %q, want an error", test.name, test.pairs, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("URL(%q, %v) = %q, %v, want %q", test.name, test.pairs, got, err, test.want)
+		}
+	}
+}